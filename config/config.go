@@ -8,6 +8,13 @@ import (
 	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/joshvanl/yazbu/internal/backend"
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/compress"
+	"github.com/joshvanl/yazbu/internal/encrypt"
+	"github.com/joshvanl/yazbu/internal/schedule"
+	"github.com/joshvanl/yazbu/internal/zfs"
 )
 
 // Config is the top level config to configure backups.
@@ -15,21 +22,216 @@ type Config struct {
 	// Buckets is the configuration for the target S3 compatible buckets.
 	Buckets []Bucket `yaml:"buckets"`
 
-	// Filesystems is the set of ZFS dataset filesystems to backup.
-	Filesystems []string `yaml:"filesystems"`
+	// Filesystems is the set of ZFS dataset filesystems to backup. Each is
+	// either the name of the filesystem, or an object which may override the
+	// global config for that filesystem.
+	Filesystems []Filesystem `yaml:"filesystems"`
 
 	// Cadence describes the number of backups to keep for each filesystem.
 	// Generally backups begin to decay over time, resulting in less frequency of
 	// backups the further in the past from the current time.
 	Cadence Cadence `yaml:"cadence"`
+
+	// Snapshots configures the lifecycle of the local ZFS snapshots created by
+	// yazbu.
+	Snapshots Snapshots `yaml:"snapshots,omitempty"`
+
+	// Schedule configures when `yazbu daemon` runs each job for every
+	// filesystem. Filesystems may override the schedule.
+	Schedule Schedule `yaml:"schedule,omitempty"`
+
+	// MinRedundancy is the minimum number of buckets which must hold a
+	// consistent and restorable copy of the latest backup of each filesystem,
+	// below which `yazbu status` exits non-zero. Filesystems may override the
+	// minimum.
+	// Default DefaultMinRedundancy.
+	MinRedundancy uint `yaml:"minRedundancy,omitempty"`
+}
+
+// DefaultMinRedundancy is the default MinRedundancy.
+const DefaultMinRedundancy = 1
+
+// Schedule describes when `yazbu daemon` runs each job of a filesystem. Each
+// job is either an interval, for example "6h" or "7d", or a standard cron
+// expression in the local time zone, for example "0 3 * * *". Jobs which are
+// not set are not run. For example:
+//
+//	schedule:
+//	  full: "0 3 * * 0"
+//	  incremental: 1h
+//	  prune: 1d
+//	  verify: 7d
+type Schedule struct {
+	// Full is the schedule of full backups. Incremental backups due at the
+	// same time are skipped.
+	Full string `yaml:"full,omitempty"`
+
+	// Incremental is the schedule of incremental backups. A full backup is
+	// written instead once the cadence incrementalPerLastFull is reached, or
+	// the incremental base no longer exists.
+	Incremental string `yaml:"incremental,omitempty"`
+
+	// Prune is the schedule of deleting backups according to the cadence.
+	Prune string `yaml:"prune,omitempty"`
+
+	// Verify is the schedule of verifying a randomly chosen backup in each
+	// bucket.
+	Verify string `yaml:"verify,omitempty"`
+
+	// StateFile is the path to the file recording when each job last ran, so
+	// that runs missed while the host was asleep or yazbu was not running are
+	// caught up. Cannot be set for a filesystem.
+	// Default DefaultScheduleStateFile.
+	StateFile string `yaml:"stateFile,omitempty"`
+}
+
+// DefaultScheduleStateFile is the default path of the schedule StateFile.
+const DefaultScheduleStateFile = "/var/lib/yazbu/schedule.json"
+
+// Merge returns the schedule with the jobs which are set in override
+// replacing those of the schedule.
+func (s Schedule) Merge(override *Schedule) Schedule {
+	if override == nil {
+		return s
+	}
+	merge := func(p *string, o string) {
+		if len(o) > 0 {
+			*p = o
+		}
+	}
+	merge(&s.Full, override.Full)
+	merge(&s.Incremental, override.Incremental)
+	merge(&s.Prune, override.Prune)
+	merge(&s.Verify, override.Verify)
+	return s
+}
+
+// validate returns the reasons the schedule is not valid.
+func (s Schedule) validate() []string {
+	var errs []string
+	for _, job := range []struct {
+		name, spec string
+	}{
+		{"schedule.full", s.Full},
+		{"schedule.incremental", s.Incremental},
+		{"schedule.prune", s.Prune},
+		{"schedule.verify", s.Verify},
+	} {
+		if len(job.spec) == 0 {
+			continue
+		}
+		if _, err := schedule.Parse(job.spec); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", job.name, err))
+		}
+	}
+	return errs
+}
+
+// Snapshots describes how the local ZFS snapshots created by yazbu are kept.
+// Each snapshot is bookmarked once backed up, and incremental backups are sent
+// from the bookmark. Snapshots are destroyed once every bucket has a backup of
+// that snapshot or a later one. Incremental bases without a bookmark are kept.
+type Snapshots struct {
+	// Retain is the number of most recent yazbu snapshots of each filesystem
+	// to keep locally, regardless of whether they have been backed up.
+	// Default 0.
+	Retain uint `yaml:"retain,omitempty"`
+}
+
+// Filesystem is a ZFS dataset filesystem to backup. In the config, a
+// filesystem may be given as just its name, for example:
+//
+//	filesystems:
+//	- tank/media
+//	- name: tank/db
+//	  cadence:
+//	    incrementalPerLastFull: 24
+//	  buckets: [offsite]
+type Filesystem struct {
+	// Name is the name of the ZFS dataset filesystem, for example "tank/db".
+	Name string `yaml:"name"`
+
+	// Cadence overrides the global cadence for this filesystem. Fields which
+	// are not set are taken from the global cadence.
+	Cadence *Cadence `yaml:"cadence,omitempty"`
+
+	// Buckets is the names of the subset of buckets this filesystem is backed
+	// up to. If empty, the filesystem is backed up to all buckets.
+	Buckets []string `yaml:"buckets,omitempty"`
+
+	// SnapshotPrefix is the prefix of the names of the snapshots yazbu creates
+	// for this filesystem. Only snapshots with this prefix are destroyed by
+	// yazbu.
+	// Default "yazbu_".
+	SnapshotPrefix string `yaml:"snapshotPrefix,omitempty"`
+
+	// SendFlags are additional flags passed to zfs send for this filesystem.
+	// Streams are always sent raw. For example:
+	// ["--large-block", "--compressed"]
+	SendFlags []string `yaml:"sendFlags,omitempty"`
+
+	// Schedule overrides the global schedule for this filesystem. Jobs which
+	// are not set are taken from the global schedule.
+	Schedule *Schedule `yaml:"schedule,omitempty"`
+
+	// MinRedundancy overrides the global minimum redundancy for this
+	// filesystem. Cannot be greater than the number of buckets the filesystem
+	// is backed up to.
+	MinRedundancy uint `yaml:"minRedundancy,omitempty"`
+}
+
+// filesystem is used to decode the object form of a Filesystem.
+type filesystem Filesystem
+
+// UnmarshalYAML implements yaml.Unmarshaler, decoding a Filesystem from either
+// a string of its name, or an object.
+func (f *Filesystem) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*f = Filesystem{Name: value.Value}
+		return nil
+	}
+	return value.Decode((*filesystem)(f))
+}
+
+// MarshalYAML implements yaml.Marshaler, encoding a Filesystem as a string of
+// its name if it has no other fields set.
+func (f Filesystem) MarshalYAML() (interface{}, error) {
+	if f.Cadence == nil && len(f.Buckets) == 0 && len(f.SnapshotPrefix) == 0 && len(f.SendFlags) == 0 && f.Schedule == nil && f.MinRedundancy == 0 {
+		return f.Name, nil
+	}
+	return filesystem(f), nil
+}
+
+// HasBucket returns true if the filesystem is backed up to the bucket of the
+// given name.
+func (f Filesystem) HasBucket(name string) bool {
+	if len(f.Buckets) == 0 {
+		return true
+	}
+	for _, bucket := range f.Buckets {
+		if bucket == name {
+			return true
+		}
+	}
+	return false
 }
 
 // Bucket if the location and authentication configuration to write and read
 // backups from.
 type Bucket struct {
-	// Name is the name of the S3 bucket to store backups.
+	// Type is the type of storage backend of the bucket. One of "s3" or
+	// "local".
+	// Default "s3".
+	Type string `yaml:"type,omitempty"`
+
+	// Name is the name of the S3 bucket to store backups. For local buckets,
+	// the name is the directory within Path which backups are stored in.
 	Name string `yaml:"name"`
 
+	// Path is the directory which backups are written to for local buckets,
+	// for example a NAS mount or USB drive. Only used for local buckets.
+	Path string `yaml:"path,omitempty"`
+
 	// Region is the region where the S3 bucket is located.
 	// example:
 	// "auto"
@@ -49,6 +251,40 @@ type Bucket struct {
 
 	// SecretKey is the secret key to authenticate to the S3 endpoint.
 	SecretKey string `yaml:"secretKey"`
+
+	// Compression is the compression applied to backup streams before they are
+	// written to this bucket.
+	Compression Compression `yaml:"compression,omitempty"`
+
+	// Encryption is the client-side encryption applied to backup streams
+	// before they are written to this bucket.
+	Encryption Encryption `yaml:"encryption,omitempty"`
+}
+
+// Compression describes how backup streams are compressed before being
+// written to a bucket.
+type Compression struct {
+	// Algorithm is the compression algorithm. One of "none", "gzip", "zstd" or
+	// "lz4".
+	// Default "none".
+	Algorithm string `yaml:"algorithm"`
+
+	// Level is the compression level of the algorithm. 0 uses the default level
+	// of the algorithm.
+	// Default 0.
+	Level int `yaml:"level,omitempty"`
+}
+
+// Encryption describes how backup streams are encrypted before being written
+// to a bucket. Backups are encrypted with age to X25519 recipients.
+type Encryption struct {
+	// Recipients are the age X25519 public keys ("age1...") which backups are
+	// encrypted to. If empty, backups are not encrypted.
+	Recipients []string `yaml:"recipients,omitempty"`
+
+	// IdentityFile is the path to an age identity file containing a private key
+	// of one of the recipients. Required to restore or verify encrypted backups.
+	IdentityFile string `yaml:"identityFile,omitempty"`
 }
 
 // Cadence describes the cadence of backups, and how older backups are deleted
@@ -56,6 +292,18 @@ type Bucket struct {
 // rate at each window to decrease the number of backups over time.
 // When a window contains more backups than the maximum target for that window,
 // the middle most backup will be deleted.
+// Full backups are retained by either the fixed 45, 182 and 365 day windows,
+// the configurable Windows, or the GFS rules. For example:
+//
+//	cadence:
+//	  incrementalPerLastFull: 7
+//	  windows:
+//	  - maxAge: 7d
+//	    keep: 7
+//	  - maxAge: 90d
+//	    keep: 12
+//	  - keep: 4
+//	    perYear: true
 type Cadence struct {
 	// IncrementalPerLastFull is the number of incremental backups to store
 	// between each full backup. All incremental backups are deleted once a full
@@ -89,6 +337,50 @@ type Cadence struct {
 	// (365 days).
 	// Default 4 (91.25 day/backup).
 	FullPer365Over365Days *uint `yaml:"fullPer365Over365Days"`
+
+	// Windows is the ordered list of retention windows of full backups, each
+	// keeping a number of backups up to a maximum age. Each window starts at
+	// the maxAge of the previous window, and the last window may omit maxAge to
+	// be unbounded. Backups older than every window are deleted, apart from the
+	// latest. Ages may be given in days, for example "45d". Cannot be set with
+	// the fixed windows above.
+	Windows []backup.Window `yaml:"windows,omitempty"`
+
+	// GFS are grandfather-father-son rules for retaining full backups. The
+	// latest full backup of each of the last number of hours, days, weeks,
+	// months or years which have a backup is kept. Cannot be set with the
+	// fixed windows above, or Windows.
+	GFS *backup.GFS `yaml:"gfs,omitempty"`
+}
+
+// hasRetention returns true if the cadence retains full backups using Windows
+// or GFS, rather than the fixed windows.
+func (c Cadence) hasRetention() bool {
+	return len(c.Windows) > 0 || c.GFS != nil
+}
+
+// Merge returns the cadence with the fields which are set in override
+// replacing those of the cadence. If override sets Windows or GFS, they
+// replace how full backups are retained entirely.
+func (c Cadence) Merge(override *Cadence) Cadence {
+	if override == nil {
+		return c
+	}
+	if override.hasRetention() {
+		c.FullLast45Days, c.Full45To182Days, c.Full182To365Days, c.FullPer365Over365Days = nil, nil, nil, nil
+		c.Windows, c.GFS = override.Windows, override.GFS
+	}
+	merge := func(p **uint, o *uint) {
+		if o != nil {
+			*p = o
+		}
+	}
+	merge(&c.IncrementalPerLastFull, override.IncrementalPerLastFull)
+	merge(&c.FullLast45Days, override.FullLast45Days)
+	merge(&c.Full45To182Days, override.Full45To182Days)
+	merge(&c.Full182To365Days, override.Full182To365Days)
+	merge(&c.FullPer365Over365Days, override.FullPer365Over365Days)
+	return c
 }
 
 // ReadFile reads the given config path location, and returns the parsed
@@ -113,15 +405,39 @@ func ReadFile(path string) (*Config, error) {
 
 // DefaultValues sets the default values of the config, if required values are
 // not set.
+// The fixed windows are not defaulted if Windows or GFS are set.
 func (c *Config) DefaultValues() *Config {
 	defaultIfNil(&c.Cadence.IncrementalPerLastFull, 7)
-	defaultIfNil(&c.Cadence.FullLast45Days, 10)
-	defaultIfNil(&c.Cadence.Full45To182Days, 10)
-	defaultIfNil(&c.Cadence.Full182To365Days, 5)
-	defaultIfNil(&c.Cadence.FullPer365Over365Days, 4)
+	if !c.Cadence.hasRetention() {
+		defaultIfNil(&c.Cadence.FullLast45Days, 10)
+		defaultIfNil(&c.Cadence.Full45To182Days, 10)
+		defaultIfNil(&c.Cadence.Full182To365Days, 5)
+		defaultIfNil(&c.Cadence.FullPer365Over365Days, 4)
+	}
 	return c
 }
 
+// MinRedundancyOf returns the minimum redundancy of the filesystem.
+func (c *Config) MinRedundancyOf(fs Filesystem) uint {
+	switch {
+	case fs.MinRedundancy > 0:
+		return fs.MinRedundancy
+	case c.MinRedundancy > 0:
+		return c.MinRedundancy
+	default:
+		return DefaultMinRedundancy
+	}
+}
+
+// FilesystemNames returns the names of the filesystems.
+func (c *Config) FilesystemNames() []string {
+	names := make([]string, len(c.Filesystems))
+	for i, fs := range c.Filesystems {
+		names[i] = fs.Name
+	}
+	return names
+}
+
 // defaultIfNil sets the default of the given pointer, if the value is nil.
 func defaultIfNil(p **uint, def uint) {
 	if *p == nil {
@@ -146,45 +462,174 @@ func (c *Config) validate() error {
 			errs = append(errs, fmt.Sprintf("%d: bucket name must be defined", i))
 		}
 
-		if len(bucket.Endpoint) == 0 {
-			errs = append(errs, fmt.Sprintf("%d: bucket endpoint must be defined", i))
+		if err := backend.Valid(backend.Type(bucket.Type)); err != nil {
+			errs = append(errs, fmt.Sprintf("%d: bucket %s", i, err))
 		}
 
-		bucketEndpoint := path.Join(bucket.Endpoint, bucket.Name)
-		if _, ok := bucketEndpoints[bucketEndpoint]; ok {
-			errs = append(errs, fmt.Sprintf("%d: bucket endpoint can only be configured at most once: %q", i, bucketEndpoint))
+		if backend.Type(bucket.Type) == backend.TypeLocal {
+			if len(bucket.Path) == 0 {
+				errs = append(errs, fmt.Sprintf("%d: bucket path must be defined for local buckets", i))
+			}
+
+			bucketPath := path.Join(bucket.Path, bucket.Name)
+			if _, ok := bucketEndpoints[bucketPath]; ok {
+				errs = append(errs, fmt.Sprintf("%d: bucket path can only be configured at most once: %q", i, bucketPath))
+			}
+			bucketEndpoints[bucketPath] = struct{}{}
+		} else {
+			if len(bucket.Endpoint) == 0 {
+				errs = append(errs, fmt.Sprintf("%d: bucket endpoint must be defined", i))
+			}
+
+			bucketEndpoint := path.Join(bucket.Endpoint, bucket.Name)
+			if _, ok := bucketEndpoints[bucketEndpoint]; ok {
+				errs = append(errs, fmt.Sprintf("%d: bucket endpoint can only be configured at most once: %q", i, bucketEndpoint))
+			}
+			bucketEndpoints[bucketEndpoint] = struct{}{}
+
+			if len(bucket.StorageClass) == 0 {
+				errs = append(errs, fmt.Sprintf("%d: bucket storageClass must be defined", i))
+			}
+
+			if len(bucket.Region) == 0 {
+				errs = append(errs, fmt.Sprintf("%d: bucket region must be defined", i))
+			}
 		}
-		bucketEndpoints[bucketEndpoint] = struct{}{}
 
-		if len(bucket.StorageClass) == 0 {
-			errs = append(errs, fmt.Sprintf("%d: bucket storageClass must be defined", i))
+		if err := compress.Valid(compress.Algorithm(bucket.Compression.Algorithm), bucket.Compression.Level); err != nil {
+			errs = append(errs, fmt.Sprintf("%d: bucket %s", i, err))
 		}
 
-		if len(bucket.Region) == 0 {
-			errs = append(errs, fmt.Sprintf("%d: bucket region must be defined", i))
+		if _, err := encrypt.ParseRecipients(bucket.Encryption.Recipients); err != nil {
+			errs = append(errs, fmt.Sprintf("%d: bucket %s", i, err))
 		}
 	}
 
+	errs = append(errs, c.Cadence.validate()...)
+	errs = append(errs, c.Schedule.validate()...)
+
+	bucketNames := make(map[string]bool)
+	for _, bucket := range c.Buckets {
+		bucketNames[bucket.Name] = true
+	}
+
+	filesystemNames := make(map[string]bool)
+	for i, fs := range c.Filesystems {
+		if len(fs.Name) == 0 {
+			errs = append(errs, fmt.Sprintf("filesystem %d: name must be defined", i))
+		}
+		if filesystemNames[fs.Name] {
+			errs = append(errs, fmt.Sprintf("filesystem %d: can only be configured at most once: %q", i, fs.Name))
+		}
+		filesystemNames[fs.Name] = true
+
+		for _, bucket := range fs.Buckets {
+			if !bucketNames[bucket] {
+				errs = append(errs, fmt.Sprintf("filesystem %d: bucket %q is not configured", i, bucket))
+			}
+		}
+
+		if fs.Cadence != nil {
+			for _, err := range c.Cadence.Merge(fs.Cadence).validate() {
+				errs = append(errs, fmt.Sprintf("filesystem %d: %s", i, err))
+			}
+		}
+
+		if len(fs.SnapshotPrefix) > 0 {
+			if err := zfs.ValidSnapshotPrefix(fs.SnapshotPrefix); err != nil {
+				errs = append(errs, fmt.Sprintf("filesystem %d: %s", i, err))
+			}
+		}
+
+		if err := zfs.ValidSendFlags(fs.SendFlags); err != nil {
+			errs = append(errs, fmt.Sprintf("filesystem %d: %s", i, err))
+		}
+
+		if fs.Schedule != nil {
+			for _, err := range fs.Schedule.validate() {
+				errs = append(errs, fmt.Sprintf("filesystem %d: %s", i, err))
+			}
+			if len(fs.Schedule.StateFile) > 0 {
+				errs = append(errs, fmt.Sprintf("filesystem %d: schedule.stateFile cannot be set for a filesystem", i))
+			}
+		}
+
+		if fs.MinRedundancy > 0 || c.MinRedundancy > 0 {
+			buckets := len(c.Buckets)
+			if len(fs.Buckets) > 0 {
+				buckets = len(fs.Buckets)
+			}
+			if min := c.MinRedundancyOf(fs); int(min) > buckets {
+				errs = append(errs, fmt.Sprintf("filesystem %d: minRedundancy %d is greater than the %d buckets it is backed up to", i, min, buckets))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config: [%s]", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// validate returns the reasons the cadence is not valid.
+func (c Cadence) validate() []string {
+	var errs []string
+
 	mustNotNil := func(name string, p *uint) {
 		if p == nil {
 			errs = append(errs, fmt.Sprintf("%s must be set", name))
 		}
 	}
-	mustNotNil("cadence.incrementalPerLastFull", c.Cadence.IncrementalPerLastFull)
-	mustNotNil("cadence.fullLast45Days", c.Cadence.FullLast45Days)
-	mustNotNil("cadence.full45To182Days", c.Cadence.Full45To182Days)
-	mustNotNil("cadence.full182To365Days", c.Cadence.Full182To365Days)
-	mustNotNil("cadence.fullPer365Over365Days", c.Cadence.FullPer365Over365Days)
+	mustNotNil("cadence.incrementalPerLastFull", c.IncrementalPerLastFull)
+
+	fixed := []struct {
+		name string
+		p    *uint
+	}{
+		{"cadence.fullLast45Days", c.FullLast45Days},
+		{"cadence.full45To182Days", c.Full45To182Days},
+		{"cadence.full182To365Days", c.Full182To365Days},
+		{"cadence.fullPer365Over365Days", c.FullPer365Over365Days},
+	}
+
+	if !c.hasRetention() {
+		for _, f := range fixed {
+			mustNotNil(f.name, f.p)
+		}
+		if c.FullLast45Days != nil && *c.FullLast45Days < 1 {
+			errs = append(errs, "cadence.fullLast45Days must be at least 1 or higher")
+		}
+		return errs
+	}
 
-	if c.Cadence.FullLast45Days != nil && *c.Cadence.FullLast45Days < 1 {
-		errs = append(errs, "cadence.fullLast45Days must be at least 1 or higher")
+	for _, f := range fixed {
+		if f.p != nil {
+			errs = append(errs, fmt.Sprintf("%s cannot be set with cadence.windows or cadence.gfs", f.name))
+		}
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("config: [%s]", strings.Join(errs, ", "))
+	if len(c.Windows) > 0 && c.GFS != nil {
+		errs = append(errs, "cadence.windows and cadence.gfs cannot both be set")
 	}
 
-	return nil
+	for i, window := range c.Windows {
+		if window.MaxAge == 0 && i < len(c.Windows)-1 {
+			errs = append(errs, fmt.Sprintf("cadence.windows[%d].maxAge must be set, only the last window may be unbounded", i))
+		}
+		if i > 0 && window.MaxAge != 0 && window.MaxAge <= c.Windows[i-1].MaxAge {
+			errs = append(errs, fmt.Sprintf("cadence.windows[%d].maxAge must be greater than that of the previous window", i))
+		}
+	}
+	if len(c.Windows) > 0 && c.Windows[0].Keep < 1 {
+		errs = append(errs, "cadence.windows[0].keep must be at least 1 or higher")
+	}
+
+	if c.GFS != nil && *c.GFS == (backup.GFS{}) {
+		errs = append(errs, "cadence.gfs must keep at least one backup")
+	}
+
+	return errs
 }
 
 // ToJSON returns the Cadence as a JSON string.
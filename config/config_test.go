@@ -3,9 +3,13 @@ package config
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/joshvanl/yazbu/internal/backup"
 )
 
 func Test_DefaultValues(t *testing.T) {
@@ -51,6 +55,20 @@ func Test_DefaultValues(t *testing.T) {
 			},
 		},
 
+		"if windows set, expect fixed windows to not be defaulted": {
+			config: Config{
+				Cadence: Cadence{
+					Windows: []backup.Window{{Keep: 3}},
+				},
+			},
+			expConfig: Config{
+				Cadence: Cadence{
+					IncrementalPerLastFull: uintToPtr(7),
+					Windows:                []backup.Window{{Keep: 3}},
+				},
+			},
+		},
+
 		"if all values set, expect no default values to be set": {
 			config: Config{
 				Cadence: Cadence{
@@ -92,7 +110,7 @@ func Test_validate(t *testing.T) {
 		"if everything is wrong, then expect error": {
 			config: Config{
 				Buckets:     []Bucket{},
-				Filesystems: []string{},
+				Filesystems: []Filesystem{},
 				Cadence:     Cadence{},
 			},
 			expErr: errors.New("config: [must specify at least one bucket, must specify at least one filesystem, cadence.incrementalPerLastFull must be set, cadence.fullLast45Days must be set, cadence.full45To182Days must be set, cadence.full182To365Days must be set, cadence.fullPer365Over365Days must be set]"),
@@ -100,7 +118,7 @@ func Test_validate(t *testing.T) {
 		"if buckets have bad config": {
 			config: Config{
 				Buckets:     []Bucket{Bucket{}, Bucket{}},
-				Filesystems: []string{"rpool/foo"},
+				Filesystems: []Filesystem{{Name: "rpool/foo"}},
 				Cadence: Cadence{
 					FullLast45Days:         &one,
 					IncrementalPerLastFull: &zero,
@@ -119,7 +137,7 @@ func Test_validate(t *testing.T) {
 					Bucket{Name: "bar", Endpoint: "foo", Region: "region", StorageClass: "standard"},
 					Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"},
 				},
-				Filesystems: []string{"rpool/foo"},
+				Filesystems: []Filesystem{{Name: "rpool/foo"}},
 				Cadence: Cadence{
 					FullLast45Days:         &one,
 					IncrementalPerLastFull: &zero,
@@ -130,10 +148,64 @@ func Test_validate(t *testing.T) {
 			},
 			expErr: errors.New("config: [2: bucket endpoint can only be configured at most once: \"foo/bar\", 3: bucket endpoint can only be configured at most once: \"foo/foo\"]"),
 		},
+		"if bucket compression is invalid, expect error": {
+			config: Config{
+				Buckets: []Bucket{
+					Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard", Compression: Compression{Algorithm: "brotli"}},
+					Bucket{Name: "bar", Endpoint: "foo", Region: "region", StorageClass: "standard", Compression: Compression{Algorithm: "gzip", Level: 10}},
+					Bucket{Name: "baz", Endpoint: "foo", Region: "region", StorageClass: "standard", Compression: Compression{Algorithm: "zstd", Level: 3}},
+				},
+				Filesystems: []Filesystem{{Name: "rpool/foo"}},
+				Cadence: Cadence{
+					FullLast45Days:         &one,
+					IncrementalPerLastFull: &zero,
+					Full45To182Days:        &zero,
+					Full182To365Days:       &zero,
+					FullPer365Over365Days:  &zero,
+				},
+			},
+			expErr: errors.New("config: [0: bucket unsupported compression algorithm \"brotli\", must be one of [none gzip zstd lz4], 1: bucket compression level for \"gzip\" must be between 0 and 9]"),
+		},
+		"if bucket encryption recipient is invalid, expect error": {
+			config: Config{
+				Buckets: []Bucket{
+					Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard", Encryption: Encryption{Recipients: []string{"age1foo"}}},
+					Bucket{Name: "bar", Endpoint: "foo", Region: "region", StorageClass: "standard", Encryption: Encryption{Recipients: []string{"age1092at0jaw35r9m2q8t2h7zkdcpgq38lhhl40ygy05scwkhn8msnsg5qhxu"}}},
+				},
+				Filesystems: []Filesystem{{Name: "rpool/foo"}},
+				Cadence: Cadence{
+					FullLast45Days:         &one,
+					IncrementalPerLastFull: &zero,
+					Full45To182Days:        &zero,
+					Full182To365Days:       &zero,
+					FullPer365Over365Days:  &zero,
+				},
+			},
+			expErr: errors.New("config: [0: bucket invalid encryption recipient 0: malformed recipient \"age1foo\": separator '1' at invalid position: pos=3, len=7]"),
+		},
+		"if bucket type is invalid or local bucket has no path, expect error": {
+			config: Config{
+				Buckets: []Bucket{
+					Bucket{Type: "ftp", Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"},
+					Bucket{Type: "local", Name: "bar"},
+					Bucket{Type: "local", Name: "baz", Path: "/mnt/nas"},
+					Bucket{Type: "local", Name: "baz", Path: "/mnt/nas"},
+				},
+				Filesystems: []Filesystem{{Name: "rpool/foo"}},
+				Cadence: Cadence{
+					FullLast45Days:         &one,
+					IncrementalPerLastFull: &zero,
+					Full45To182Days:        &zero,
+					Full182To365Days:       &zero,
+					FullPer365Over365Days:  &zero,
+				},
+			},
+			expErr: errors.New("config: [0: bucket unsupported type \"ftp\", must be one of [s3 local], 1: bucket path must be defined for local buckets, 3: bucket path can only be configured at most once: \"/mnt/nas/baz\"]"),
+		},
 		"if last 45 day cadence is 0, expect error": {
 			config: Config{
 				Buckets:     []Bucket{Bucket{Name: "foo"}},
-				Filesystems: []string{"rpool/foo"},
+				Filesystems: []Filesystem{{Name: "rpool/foo"}},
 				Cadence: Cadence{
 					FullLast45Days:         &zero,
 					IncrementalPerLastFull: &zero,
@@ -144,10 +216,114 @@ func Test_validate(t *testing.T) {
 			},
 			expErr: errors.New("config: [0: bucket endpoint must be defined, 0: bucket storageClass must be defined, 0: bucket region must be defined, cadence.fullLast45Days must be at least 1 or higher]"),
 		},
+		"if filesystems have bad config, expect error": {
+			config: Config{
+				Buckets: []Bucket{Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"}},
+				Filesystems: []Filesystem{
+					{Name: "rpool/foo", Buckets: []string{"foo", "bar"}},
+					{Name: "rpool/foo", SnapshotPrefix: "bad prefix"},
+					{Cadence: &Cadence{FullLast45Days: &zero}, SendFlags: []string{"--raw"}},
+				},
+				Cadence: Cadence{
+					FullLast45Days:         &one,
+					IncrementalPerLastFull: &zero,
+					Full45To182Days:        &zero,
+					Full182To365Days:       &zero,
+					FullPer365Over365Days:  &zero,
+				},
+			},
+			expErr: errors.New("config: [filesystem 0: bucket \"bar\" is not configured, filesystem 1: can only be configured at most once: \"rpool/foo\", filesystem 1: invalid snapshot prefix \"bad prefix\", must only contain alphanumeric characters, or any of '_.:-', filesystem 2: name must be defined, filesystem 2: cadence.fullLast45Days must be at least 1 or higher, filesystem 2: unsupported send flags [\"--raw\"]]"),
+		},
+		"if retention windows have bad config, expect error": {
+			config: Config{
+				Buckets:     []Bucket{Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"}},
+				Filesystems: []Filesystem{{Name: "rpool/foo"}},
+				Cadence: Cadence{
+					IncrementalPerLastFull: &zero,
+					FullLast45Days:         &one,
+					Windows: []backup.Window{
+						{Keep: 0},
+						{MaxAge: backup.Duration(time.Hour * 24 * 30), Keep: 1},
+						{MaxAge: backup.Duration(time.Hour * 24 * 7), Keep: 1},
+					},
+					GFS: &backup.GFS{},
+				},
+			},
+			expErr: errors.New("config: [cadence.fullLast45Days cannot be set with cadence.windows or cadence.gfs, cadence.windows and cadence.gfs cannot both be set, cadence.windows[0].maxAge must be set, only the last window may be unbounded, cadence.windows[2].maxAge must be greater than that of the previous window, cadence.windows[0].keep must be at least 1 or higher, cadence.gfs must keep at least one backup]"),
+		},
+		"if filesystem overrides fixed windows with gfs, expect no error": {
+			config: Config{
+				Buckets: []Bucket{Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"}},
+				Filesystems: []Filesystem{
+					{Name: "rpool/foo", Cadence: &Cadence{GFS: &backup.GFS{Daily: 7}}},
+				},
+				Cadence: Cadence{
+					FullLast45Days:         &one,
+					IncrementalPerLastFull: &zero,
+					Full45To182Days:        &zero,
+					Full182To365Days:       &zero,
+					FullPer365Over365Days:  &zero,
+				},
+			},
+			expErr: nil,
+		},
+		"if filesystem sets fixed windows with global windows, expect error": {
+			config: Config{
+				Buckets: []Bucket{Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"}},
+				Filesystems: []Filesystem{
+					{Name: "rpool/foo", Cadence: &Cadence{FullLast45Days: &one}},
+				},
+				Cadence: Cadence{
+					IncrementalPerLastFull: &zero,
+					Windows:                []backup.Window{{Keep: 1}},
+				},
+			},
+			expErr: errors.New("config: [filesystem 0: cadence.fullLast45Days cannot be set with cadence.windows or cadence.gfs]"),
+		},
+		"if schedule has bad config, expect error": {
+			config: Config{
+				Buckets: []Bucket{Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"}},
+				Filesystems: []Filesystem{
+					{Name: "rpool/foo", Schedule: &Schedule{Prune: "0h", StateFile: "/tmp/state.json"}},
+					{Name: "rpool/bar", Schedule: &Schedule{Incremental: "*/15 * * * *"}},
+				},
+				Cadence: Cadence{
+					FullLast45Days:         &one,
+					IncrementalPerLastFull: &zero,
+					Full45To182Days:        &zero,
+					Full182To365Days:       &zero,
+					FullPer365Over365Days:  &zero,
+				},
+				Schedule: Schedule{Full: "0 3 * * 0", Incremental: "sometimes", Verify: "7d"},
+			},
+			expErr: errors.New("config: [schedule.incremental: invalid schedule \"sometimes\", must be an interval or cron expression: expected exactly 5 fields, found 1: [sometimes], filesystem 0: schedule.prune: invalid schedule \"0h\", interval must be greater than 0, filesystem 0: schedule.stateFile cannot be set for a filesystem]"),
+		},
+		"if minRedundancy is greater than the buckets, expect error": {
+			config: Config{
+				Buckets: []Bucket{
+					Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"},
+					Bucket{Name: "bar", Endpoint: "bar", Region: "region", StorageClass: "standard"},
+				},
+				Filesystems: []Filesystem{
+					{Name: "rpool/foo"},
+					{Name: "rpool/bar", Buckets: []string{"foo"}},
+					{Name: "rpool/baz", Buckets: []string{"foo"}, MinRedundancy: 1},
+				},
+				Cadence: Cadence{
+					FullLast45Days:         &one,
+					IncrementalPerLastFull: &zero,
+					Full45To182Days:        &zero,
+					Full182To365Days:       &zero,
+					FullPer365Over365Days:  &zero,
+				},
+				MinRedundancy: 2,
+			},
+			expErr: errors.New("config: [filesystem 1: minRedundancy 2 is greater than the 1 buckets it is backed up to]"),
+		},
 		"if validation is ok, expect no error": {
 			config: Config{
 				Buckets:     []Bucket{Bucket{Name: "foo", Endpoint: "foo", Region: "region", StorageClass: "standard"}},
-				Filesystems: []string{"rpool/foo"},
+				Filesystems: []Filesystem{{Name: "rpool/foo"}},
 				Cadence: Cadence{
 					FullLast45Days:         &one,
 					IncrementalPerLastFull: &zero,
@@ -170,3 +346,111 @@ func Test_validate(t *testing.T) {
 		})
 	}
 }
+
+func Test_Filesystem_YAML(t *testing.T) {
+	var incremental uint = 24
+
+	var config Config
+	require.NoError(t, yaml.Unmarshal([]byte(`
+filesystems:
+- tank/media
+- name: tank/db
+  cadence:
+    incrementalPerLastFull: 24
+  buckets: [offsite]
+  snapshotPrefix: db_
+  sendFlags: [--compressed]
+`), &config))
+
+	expFilesystems := []Filesystem{
+		{Name: "tank/media"},
+		{
+			Name:           "tank/db",
+			Cadence:        &Cadence{IncrementalPerLastFull: &incremental},
+			Buckets:        []string{"offsite"},
+			SnapshotPrefix: "db_",
+			SendFlags:      []string{"--compressed"},
+		},
+	}
+	assert.Equal(t, expFilesystems, config.Filesystems)
+	assert.Equal(t, []string{"tank/media", "tank/db"}, config.FilesystemNames())
+
+	b, err := yaml.Marshal(config.Filesystems)
+	require.NoError(t, err)
+	var filesystems []Filesystem
+	require.NoError(t, yaml.Unmarshal(b, &filesystems))
+	assert.Equal(t, expFilesystems, filesystems)
+	assert.Contains(t, string(b), "- tank/media\n", "filesystem with only a name should be a string")
+
+	assert.True(t, filesystems[0].HasBucket("offsite"))
+	assert.True(t, filesystems[1].HasBucket("offsite"))
+	assert.False(t, filesystems[1].HasBucket("local"))
+}
+
+func Test_Cadence_Merge(t *testing.T) {
+	uintToPtr := func(u uint) *uint {
+		return &u
+	}
+
+	global := (&Config{}).DefaultValues().Cadence
+	assert.Equal(t, global, global.Merge(nil))
+
+	merged := global.Merge(&Cadence{
+		IncrementalPerLastFull: uintToPtr(24),
+		FullPer365Over365Days:  uintToPtr(0),
+	})
+	assert.Equal(t, Cadence{
+		IncrementalPerLastFull: uintToPtr(24),
+		FullLast45Days:         uintToPtr(10),
+		Full45To182Days:        uintToPtr(10),
+		Full182To365Days:       uintToPtr(5),
+		FullPer365Over365Days:  uintToPtr(0),
+	}, merged)
+	assert.Equal(t, uint(7), *global.IncrementalPerLastFull, "global cadence should not be modified")
+
+	windows := []backup.Window{{MaxAge: backup.Duration(time.Hour * 24 * 30), Keep: 30}, {Keep: 12}}
+	assert.Equal(t, Cadence{
+		IncrementalPerLastFull: uintToPtr(7),
+		Windows:                windows,
+	}, global.Merge(&Cadence{Windows: windows}), "windows should replace the fixed windows")
+}
+
+func Test_Schedule_Merge(t *testing.T) {
+	global := Schedule{Full: "0 3 * * 0", Incremental: "1h", StateFile: "/tmp/state.json"}
+	assert.Equal(t, global, global.Merge(nil))
+	assert.Equal(t, Schedule{
+		Full:        "0 3 * * 0",
+		Incremental: "15m",
+		Verify:      "7d",
+		StateFile:   "/tmp/state.json",
+	}, global.Merge(&Schedule{Incremental: "15m", Verify: "7d"}))
+}
+
+func Test_Cadence_YAML(t *testing.T) {
+	var cadence Cadence
+	require.NoError(t, yaml.Unmarshal([]byte(`
+incrementalPerLastFull: 7
+windows:
+- maxAge: 7d
+  keep: 7
+- maxAge: 36h
+  keep: 1
+- keep: 4
+  perYear: true
+gfs:
+  weekly: 4
+`), &cadence))
+
+	assert.Equal(t, []backup.Window{
+		{MaxAge: backup.Duration(time.Hour * 24 * 7), Keep: 7},
+		{MaxAge: backup.Duration(time.Hour * 36), Keep: 1},
+		{Keep: 4, PerYear: true},
+	}, cadence.Windows)
+	assert.Equal(t, &backup.GFS{Weekly: 4}, cadence.GFS)
+
+	b, err := yaml.Marshal(cadence)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "maxAge: 7d")
+
+	assert.Error(t, yaml.Unmarshal([]byte("windows: [{maxAge: 7 days, keep: 1}]"), &cadence))
+}
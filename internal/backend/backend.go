@@ -0,0 +1,113 @@
+// Package backend provides the storage backends which backup objects and
+// databases are written to.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Type is the type of a storage backend.
+type Type string
+
+const (
+	// TypeS3 is an S3 compatible object store.
+	TypeS3 Type = "s3"
+
+	// TypeLocal is a directory on the local filesystem, such as a NAS mount or
+	// USB drive.
+	TypeLocal Type = "local"
+)
+
+// Types are the supported storage backend types.
+var Types = []Type{TypeS3, TypeLocal}
+
+var (
+	// ErrNotFound is returned when an object does not exist.
+	ErrNotFound = errors.New("object not found")
+
+	// ErrPreconditionFailed is returned when a conditional write fails because
+	// the object has been modified, or already exists.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// Backend is a storage backend which stores objects by key.
+type Backend interface {
+	// Put writes the stream to the object with the given key. The write is
+	// conditional if the options specify IfMatch or IfNoneMatch, returning
+	// ErrPreconditionFailed if the condition fails. Returns the ETag of the
+	// written object.
+	Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (string, error)
+
+	// Get returns a reader of the object with the given key, and its info.
+	// Returns ErrNotFound if the object does not exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+
+	// Head returns the info of the object with the given key. Returns
+	// ErrNotFound if the object does not exist.
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+
+	// Delete deletes the object with the given key. Deleting an object which
+	// does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the info of all objects whose key has the given prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	// Endpoint returns the location of the backend, for display.
+	Endpoint() string
+}
+
+// PutOptions are the options for writing an object.
+type PutOptions struct {
+	// IfMatch only writes the object if it currently has this ETag.
+	IfMatch string
+
+	// IfNoneMatch only writes the object if it does not already exist.
+	IfNoneMatch bool
+
+	// ContentType is the content type of the object.
+	ContentType string
+
+	// StorageClass is the storage class of the object, if supported by the
+	// backend.
+	StorageClass string
+}
+
+// conditional returns true if the options describe a conditional write.
+func (o PutOptions) conditional() bool {
+	return len(o.IfMatch) > 0 || o.IfNoneMatch
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	// Key is the key of the object.
+	Key string
+
+	// ETag is the version of the object. Changes whenever the object is
+	// written.
+	ETag string
+
+	// Size is the size of the object in bytes.
+	Size int64
+
+	// LastModified is the time the object was last written.
+	LastModified time.Time
+}
+
+// Valid returns an error if the given backend type is not supported. An
+// empty type is treated as TypeS3.
+func Valid(typ Type) error {
+	if len(typ) == 0 {
+		return nil
+	}
+	for _, t := range Types {
+		if t == typ {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported type %q, must be one of %v", typ, Types)
+}
@@ -0,0 +1,469 @@
+// Package fakes3 provides an in-process fake S3 server for tests. It
+// implements the subset of the S3 API used by yazbu, including conditional
+// writes and multipart uploads, and supports injecting failures.
+package fakes3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joshvanl/yazbu/internal/backend"
+)
+
+// Op is an S3 API operation.
+type Op string
+
+// Operations of the S3 API served by the fake server.
+const (
+	OpGetObject               Op = "GetObject"
+	OpHeadObject              Op = "HeadObject"
+	OpPutObject               Op = "PutObject"
+	OpDeleteObject            Op = "DeleteObject"
+	OpListObjectsV2           Op = "ListObjectsV2"
+	OpCreateMultipartUpload   Op = "CreateMultipartUpload"
+	OpUploadPart              Op = "UploadPart"
+	OpCompleteMultipartUpload Op = "CompleteMultipartUpload"
+	OpAbortMultipartUpload    Op = "AbortMultipartUpload"
+)
+
+// Failure is a failure injected into the server. Requests matching the
+// failure are responded to with the error, rather than being served.
+type Failure struct {
+	// Op is the operation to fail. If empty, all operations are failed.
+	Op Op
+
+	// Key is the object key to fail requests of. If empty, requests of all
+	// keys are failed.
+	Key string
+
+	// Times is the number of matching requests to fail, after which the
+	// failure is removed. If 0, matching requests are always failed.
+	Times int
+
+	// StatusCode is the HTTP status code of the failed response.
+	// Default 500.
+	StatusCode int
+
+	// Code is the S3 error code of the failed response.
+	// Default "InternalError".
+	Code string
+}
+
+// Object is an object stored in the fake server.
+type Object struct {
+	// Data is the content of the object.
+	Data []byte
+
+	// ETag is the ETag of the object.
+	ETag string
+
+	// ContentType is the content type of the object.
+	ContentType string
+
+	// StorageClass is the storage class of the object.
+	StorageClass string
+
+	// LastModified is the time the object was written.
+	LastModified time.Time
+}
+
+// upload is an in progress multipart upload.
+type upload struct {
+	bucket, key  string
+	contentType  string
+	storageClass string
+	parts        map[int][]byte
+}
+
+// Server is a fake S3 server.
+type Server struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	objects  map[string]map[string]*Object
+	uploads  map[string]*upload
+	failures []*Failure
+	requests map[Op]int
+	uploadID int
+}
+
+// New starts a new fake S3 server. The server should be closed once the
+// test is complete.
+func New() *Server {
+	s := &Server{
+		objects:  make(map[string]map[string]*Object),
+		uploads:  make(map[string]*upload),
+		requests: make(map[Op]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Backend returns an S3 backend of the given bucket on the server.
+func (s *Server) Backend(bucket string) (*backend.S3, error) {
+	return backend.NewS3(backend.S3Options{
+		Bucket:         bucket,
+		Region:         "us-east-1",
+		Endpoint:       s.URL,
+		AccessKey:      "access",
+		SecretKey:      "secret",
+		ForcePathStyle: true,
+	})
+}
+
+// InjectFailure adds a failure to the server.
+func (s *Server) InjectFailure(f Failure) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if f.StatusCode == 0 {
+		f.StatusCode = http.StatusInternalServerError
+	}
+	if len(f.Code) == 0 {
+		f.Code = "InternalError"
+	}
+	s.failures = append(s.failures, &f)
+}
+
+// ClearFailures removes all injected failures.
+func (s *Server) ClearFailures() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = nil
+}
+
+// Object returns a copy of the object in the bucket with the given key.
+// Returns false if the object does not exist.
+func (s *Server) Object(bucket, key string) (Object, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	obj, ok := s.objects[bucket][key]
+	if !ok {
+		return Object{}, false
+	}
+	return *obj, true
+}
+
+// PutObject writes the object directly to the bucket, bypassing the API.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.putObject(bucket, key, &Object{Data: data, ETag: etag(data)})
+}
+
+// Keys returns the sorted keys of all objects in the bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var keys []string
+	for key := range s.objects[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Requests returns the number of requests served of the given operation,
+// including failed requests.
+func (s *Server) Requests(op Op) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[op]
+}
+
+// serveHTTP serves S3 API requests. Buckets are addressed in the path, and
+// are created on first use.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	op := operation(r, key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests[op]++
+
+	if f := s.failure(op, key); f != nil {
+		writeError(w, f.StatusCode, f.Code)
+		return
+	}
+
+	switch op {
+	case OpGetObject, OpHeadObject:
+		obj, ok := s.objects[bucket][key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		writeObjectHeaders(w, obj)
+		if op == OpGetObject {
+			w.Write(obj.Data)
+		}
+
+	case OpPutObject:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if !s.conditionsMet(r, bucket, key) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		obj := &Object{
+			Data:         data,
+			ETag:         etag(data),
+			ContentType:  r.Header.Get("Content-Type"),
+			StorageClass: r.Header.Get("X-Amz-Storage-Class"),
+		}
+		s.putObject(bucket, key, obj)
+		w.Header().Set("ETag", obj.ETag)
+
+	case OpDeleteObject:
+		delete(s.objects[bucket], key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case OpListObjectsV2:
+		s.listObjects(w, bucket, query.Get("prefix"))
+
+	case OpCreateMultipartUpload:
+		s.uploadID++
+		id := strconv.Itoa(s.uploadID)
+		s.uploads[id] = &upload{
+			bucket:       bucket,
+			key:          key,
+			contentType:  r.Header.Get("Content-Type"),
+			storageClass: r.Header.Get("X-Amz-Storage-Class"),
+			parts:        make(map[int][]byte),
+		}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			UploadID string   `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: id})
+
+	case OpUploadPart:
+		u, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		part, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		u.parts[part] = data
+		w.Header().Set("ETag", etag(data))
+
+	case OpCompleteMultipartUpload:
+		u, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var req struct {
+			Parts []struct {
+				PartNumber int `xml:"PartNumber"`
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data bytes.Buffer
+		for _, p := range req.Parts {
+			part, ok := u.parts[p.PartNumber]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data.Write(part)
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		obj := &Object{
+			Data:         data.Bytes(),
+			ETag:         fmt.Sprintf("%q", fmt.Sprintf("%s-%d", strings.Trim(etag(data.Bytes()), `"`), len(req.Parts))),
+			ContentType:  u.contentType,
+			StorageClass: u.storageClass,
+		}
+		s.putObject(u.bucket, u.key, obj)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string   `xml:"Bucket"`
+			Key     string   `xml:"Key"`
+			ETag    string   `xml:"ETag"`
+		}{Bucket: u.bucket, Key: u.key, ETag: obj.ETag})
+
+	case OpAbortMultipartUpload:
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// operation returns the S3 operation of the request.
+func operation(r *http.Request, key string) Op {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		if len(key) == 0 {
+			return OpListObjectsV2
+		}
+		return OpGetObject
+	case http.MethodHead:
+		return OpHeadObject
+	case http.MethodPut:
+		if query.Has("uploadId") {
+			return OpUploadPart
+		}
+		return OpPutObject
+	case http.MethodPost:
+		if query.Has("uploads") {
+			return OpCreateMultipartUpload
+		}
+		return OpCompleteMultipartUpload
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			return OpAbortMultipartUpload
+		}
+		return OpDeleteObject
+	default:
+		return ""
+	}
+}
+
+// failure returns the injected failure matching the operation and key, or
+// nil if there is none.
+func (s *Server) failure(op Op, key string) *Failure {
+	for i, f := range s.failures {
+		if (len(f.Op) > 0 && f.Op != op) || (len(f.Key) > 0 && f.Key != key) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// conditionsMet returns true if the conditional write headers of the request
+// are satisfied.
+func (s *Server) conditionsMet(r *http.Request, bucket, key string) bool {
+	obj, exists := s.objects[bucket][key]
+	if match := r.Header.Get("If-Match"); len(match) > 0 && (!exists || obj.ETag != match) {
+		return false
+	}
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		return false
+	}
+	return true
+}
+
+// listObjects writes the ListObjectsV2 response of all objects in the bucket
+// with the prefix. Results are never truncated.
+func (s *Server) listObjects(w http.ResponseWriter, bucket, prefix string) {
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int    `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+
+	var contents []content
+	for key, obj := range s.objects[bucket] {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		contents = append(contents, content{
+			Key:          key,
+			LastModified: obj.LastModified.Format(time.RFC3339),
+			ETag:         obj.ETag,
+			Size:         len(obj.Data),
+			StorageClass: "STANDARD",
+		})
+	}
+	sort.Slice(contents, func(i, j int) bool {
+		return contents[i].Key < contents[j].Key
+	})
+
+	writeXML(w, struct {
+		XMLName     xml.Name  `xml:"ListBucketResult"`
+		Name        string    `xml:"Name"`
+		Prefix      string    `xml:"Prefix"`
+		KeyCount    int       `xml:"KeyCount"`
+		MaxKeys     int       `xml:"MaxKeys"`
+		IsTruncated bool      `xml:"IsTruncated"`
+		Contents    []content `xml:"Contents"`
+	}{Name: bucket, Prefix: prefix, KeyCount: len(contents), MaxKeys: 1000, Contents: contents})
+}
+
+// putObject stores the object in the bucket.
+func (s *Server) putObject(bucket, key string, obj *Object) {
+	if _, ok := s.objects[bucket]; !ok {
+		s.objects[bucket] = make(map[string]*Object)
+	}
+	obj.LastModified = time.Now().UTC().Truncate(time.Second)
+	s.objects[bucket][key] = obj
+}
+
+// writeObjectHeaders writes the response headers of the object.
+func writeObjectHeaders(w http.ResponseWriter, obj *Object) {
+	w.Header().Set("ETag", obj.ETag)
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+	w.Header().Set("Last-Modified", obj.LastModified.Format(http.TimeFormat))
+	if len(obj.ContentType) > 0 {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	if len(obj.StorageClass) > 0 && obj.StorageClass != "STANDARD" {
+		w.Header().Set("X-Amz-Storage-Class", obj.StorageClass)
+	}
+}
+
+// etag returns the quoted MD5 ETag of the data.
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+}
+
+// writeError writes an S3 error response.
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: code})
+}
+
+// writeXML writes an XML response.
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,101 @@
+package fakes3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/joshvanl/yazbu/internal/backend"
+)
+
+func Test_S3Backend(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	defer srv.Close()
+
+	be, err := srv.Backend("bucket")
+	require.NoError(t, err)
+
+	_, err = be.Head(ctx, "tank/foo/backup.db")
+	assert.ErrorIs(t, err, backend.ErrNotFound)
+	_, _, err = be.Get(ctx, "tank/foo/backup.db")
+	assert.ErrorIs(t, err, backend.ErrNotFound)
+
+	etag, err := be.Put(ctx, "tank/foo/backup.db", strings.NewReader("v1"), backend.PutOptions{IfNoneMatch: true})
+	require.NoError(t, err)
+
+	_, err = be.Put(ctx, "tank/foo/backup.db", strings.NewReader("v2"), backend.PutOptions{IfNoneMatch: true})
+	assert.ErrorIs(t, err, backend.ErrPreconditionFailed)
+	_, err = be.Put(ctx, "tank/foo/backup.db", strings.NewReader("v2"), backend.PutOptions{IfMatch: `"foo"`})
+	assert.ErrorIs(t, err, backend.ErrPreconditionFailed)
+
+	_, err = be.Put(ctx, "tank/foo/backup.db", strings.NewReader("v2"), backend.PutOptions{IfMatch: etag})
+	require.NoError(t, err)
+
+	rc, _, err := be.Get(ctx, "tank/foo/backup.db")
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(b))
+
+	// Larger than the default part size so is uploaded in multiple parts.
+	data := make([]byte, 12<<20)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	_, err = be.Put(ctx, "tank/foo/snap.full", bytes.NewReader(data), backend.PutOptions{StorageClass: "COLD"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, srv.Requests(OpCreateMultipartUpload))
+
+	obj, ok := srv.Object("bucket", "tank/foo/snap.full")
+	require.True(t, ok)
+	assert.Equal(t, data, obj.Data)
+	assert.Equal(t, "COLD", obj.StorageClass)
+	info, err := be.Head(ctx, "tank/foo/snap.full")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	infos, err := be.List(ctx, "tank/")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, "tank/foo/backup.db", infos[0].Key)
+	assert.Equal(t, "tank/foo/snap.full", infos[1].Key)
+
+	require.NoError(t, be.Delete(ctx, "tank/foo/snap.full"))
+	assert.Equal(t, []string{"tank/foo/backup.db"}, srv.Keys("bucket"))
+}
+
+func Test_InjectFailure(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	defer srv.Close()
+
+	be, err := srv.Backend("bucket")
+	require.NoError(t, err)
+
+	srv.InjectFailure(Failure{Op: OpPutObject, Key: "foo", Times: 1, StatusCode: http.StatusForbidden, Code: "AccessDenied"})
+
+	_, err = be.Put(ctx, "bar", strings.NewReader("bar"), backend.PutOptions{IfNoneMatch: true})
+	assert.NoError(t, err, "failure should only match the key")
+
+	_, err = be.Put(ctx, "foo", strings.NewReader("foo"), backend.PutOptions{IfNoneMatch: true})
+	assert.ErrorContains(t, err, "AccessDenied")
+
+	_, err = be.Put(ctx, "foo", strings.NewReader("foo"), backend.PutOptions{IfNoneMatch: true})
+	assert.NoError(t, err, "failure should be removed after being matched once")
+
+	srv.InjectFailure(Failure{Op: OpHeadObject})
+	_, err = be.Head(ctx, "foo")
+	assert.Error(t, err)
+	_, err = be.Head(ctx, "foo")
+	assert.Error(t, err, "failure should persist")
+	srv.ClearFailures()
+	_, err = be.Head(ctx, "foo")
+	assert.NoError(t, err)
+}
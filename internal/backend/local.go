@@ -0,0 +1,359 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// localMetadataSuffix is the suffix of the sidecar file which holds the
+	// ETag and content type of an object.
+	localMetadataSuffix = ".yazbu-metadata"
+
+	// localTempPrefix is the prefix of temporary files, which objects are
+	// written to before being moved into place.
+	localTempPrefix = ".yazbu-tmp-"
+)
+
+// Local is a Backend which stores objects as files in a directory on the
+// local filesystem, such as a NAS mount or USB drive. Object keys are paths
+// relative to the directory.
+type Local struct {
+	// root is the directory objects are stored in.
+	root string
+
+	// lock serialises conditional writes. Conditional writes from other
+	// processes are not atomic, so rely on the filesystem lease to prevent
+	// concurrent writers.
+	lock sync.Mutex
+}
+
+// localSidecar is the content of an object's metadata sidecar file.
+type localSidecar struct {
+	// ETag is the version of the object, which changes on every write.
+	ETag string `json:"etag"`
+
+	// ContentType is the content type of the object.
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// NewLocal returns a new Local backend, storing objects in the given
+// directory. The directory must already exist.
+func NewLocal(root string) (*Local, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat local backend directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("local backend path %q is not a directory", root)
+	}
+
+	return &Local{root: root}, nil
+}
+
+// Put implements Backend. The object is written to a temporary file which is
+// moved into place once complete, so readers never see a partial object.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (string, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create directory for %q: %w", key, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), localTempPrefix+"*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create %q: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, contextReader{ctx: ctx, r: r}); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write %q: %w", key, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to sync %q: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to close %q: %w", key, err)
+	}
+
+	etag, err := newLocalETag()
+	if err != nil {
+		return "", err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	switch {
+	case opts.IfNoneMatch:
+		if _, err := os.Stat(path); err == nil {
+			return "", fmt.Errorf("%w: %q already exists", ErrPreconditionFailed, key)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+
+	case len(opts.IfMatch) > 0:
+		current, err := l.Head(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return "", fmt.Errorf("%w: %q does not exist", ErrPreconditionFailed, key)
+		}
+		if err != nil {
+			return "", err
+		}
+		if current.ETag != opts.IfMatch {
+			return "", fmt.Errorf("%w: %q has been modified", ErrPreconditionFailed, key)
+		}
+	}
+
+	// The sidecar is written before the object is moved into place, so the
+	// new object is never seen with the ETag of the one it replaces. Should
+	// the move fail, the previous object is left with a new ETag, which only
+	// fails conditional writes made against it.
+	if err := l.writeSidecar(path, localSidecar{
+		ETag:        etag,
+		ContentType: opts.ContentType,
+	}); err != nil {
+		return "", err
+	}
+
+	if !opts.IfNoneMatch {
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return "", fmt.Errorf("failed to write %q: %w", key, err)
+		}
+		return etag, nil
+	}
+
+	// Linking atomically fails if the object has since been created by
+	// another process.
+	err = os.Link(tmp.Name(), path)
+	if errors.Is(err, fs.ErrExist) {
+		return "", fmt.Errorf("%w: %q already exists", ErrPreconditionFailed, key)
+	}
+	if err != nil {
+		// Not all filesystems support hard links, e.g. FAT, so fall back to
+		// moving into place, having checked the object does not exist.
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return "", fmt.Errorf("failed to write %q: %w", key, err)
+		}
+	}
+
+	return etag, nil
+}
+
+// Get implements Backend.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ObjectInfo{}, fmt.Errorf("%w: %q", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	info, err := l.info(key, path)
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	return f, info, nil
+}
+
+// Head implements Backend.
+func (l *Local) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return l.info(key, path)
+}
+
+// Delete implements Backend.
+func (l *Local) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{path, path + localMetadataSuffix} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete %q: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// List implements Backend.
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	err := filepath.WalkDir(l.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() ||
+			strings.HasSuffix(d.Name(), localMetadataSuffix) ||
+			strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := l.info(key, path)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %w", prefix, err)
+	}
+
+	return infos, nil
+}
+
+// Endpoint implements Backend.
+func (l *Local) Endpoint() string {
+	return "file://" + l.root
+}
+
+// path returns the file path of the object key. Returns an error if the key
+// resolves outside of the root directory.
+func (l *Local) path(key string) (string, error) {
+	path := filepath.Join(l.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, l.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return path, nil
+}
+
+// info returns the info of the object at the given path.
+func (l *Local) info(key, path string) (ObjectInfo, error) {
+	stat, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, fmt.Errorf("%w: %q", ErrNotFound, key)
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	sidecar, err := l.readSidecar(key, path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		ETag:         sidecar.ETag,
+		Size:         stat.Size(),
+		LastModified: stat.ModTime(),
+	}, nil
+}
+
+// readSidecar reads the sidecar of the object at the given path. Objects
+// without a sidecar, i.e. those not written by yazbu, are given an ETag
+// derived from their modification time and size.
+func (l *Local) readSidecar(key, path string) (localSidecar, error) {
+	b, err := os.ReadFile(path + localMetadataSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		stat, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return localSidecar{}, fmt.Errorf("%w: %q", ErrNotFound, key)
+		}
+		if err != nil {
+			return localSidecar{}, err
+		}
+		return localSidecar{ETag: fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size())}, nil
+	}
+	if err != nil {
+		return localSidecar{}, fmt.Errorf("failed to read metadata of %q: %w", key, err)
+	}
+
+	var sidecar localSidecar
+	if err := json.Unmarshal(b, &sidecar); err != nil {
+		return localSidecar{}, fmt.Errorf("failed to decode metadata of %q: %w", key, err)
+	}
+
+	return sidecar, nil
+}
+
+// writeSidecar atomically writes the sidecar of the object at the given path.
+func (l *Local) writeSidecar(path string, sidecar localSidecar) error {
+	b, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), localTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path+localMetadataSuffix)
+}
+
+// newLocalETag returns a new random ETag.
+func newLocalETag() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// contextReader is an io.Reader which stops reading once the context is
+// cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements the io.Reader interface.
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Local(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	l, err := NewLocal(root)
+	require.NoError(t, err)
+	assert.Equal(t, "file://"+root, l.Endpoint())
+
+	_, err = l.Head(ctx, "bucket/tank/foo/backup.db")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, _, err = l.Get(ctx, "bucket/tank/foo/backup.db")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	etag, err := l.Put(ctx, "bucket/tank/foo/backup.db", strings.NewReader("v1"), PutOptions{IfNoneMatch: true})
+	require.NoError(t, err)
+	assert.NotEmpty(t, etag)
+
+	_, err = l.Put(ctx, "bucket/tank/foo/backup.db", strings.NewReader("v2"), PutOptions{IfNoneMatch: true})
+	assert.ErrorIs(t, err, ErrPreconditionFailed, "expected create to fail if object exists")
+
+	_, err = l.Put(ctx, "bucket/tank/foo/backup.db", strings.NewReader("v2"), PutOptions{IfMatch: "foo"})
+	assert.ErrorIs(t, err, ErrPreconditionFailed, "expected write to fail on etag mismatch")
+	head, err := l.Head(ctx, "bucket/tank/foo/backup.db")
+	require.NoError(t, err)
+	assert.Equal(t, etag, head.ETag, "expected failed writes to keep the etag")
+
+	etag2, err := l.Put(ctx, "bucket/tank/foo/backup.db", strings.NewReader("v2"), PutOptions{IfMatch: etag})
+	require.NoError(t, err)
+	assert.NotEqual(t, etag, etag2)
+
+	rc, info, err := l.Get(ctx, "bucket/tank/foo/backup.db")
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, rc.Close())
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(b))
+	assert.Equal(t, etag2, info.ETag)
+	assert.Equal(t, int64(2), info.Size)
+
+	_, err = l.Put(ctx, "bucket/tank/foo/snap.full", strings.NewReader("data"), PutOptions{})
+	require.NoError(t, err)
+	info, err = l.Head(ctx, "bucket/tank/foo/snap.full")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size)
+
+	infos, err := l.List(ctx, "bucket/tank/foo/")
+	require.NoError(t, err)
+	var keys []string
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	assert.ElementsMatch(t, []string{"bucket/tank/foo/backup.db", "bucket/tank/foo/snap.full"}, keys)
+
+	require.NoError(t, l.Delete(ctx, "bucket/tank/foo/snap.full"))
+	require.NoError(t, l.Delete(ctx, "bucket/tank/foo/snap.full"), "deleting a missing object should not error")
+	_, err = os.Stat(filepath.Join(root, "bucket/tank/foo/snap.full"+localMetadataSuffix))
+	assert.True(t, os.IsNotExist(err), "expected metadata to be deleted")
+
+	_, err = l.Head(ctx, "../escape")
+	assert.Error(t, err)
+}
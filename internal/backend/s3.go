@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Options are the options for creating an S3 backend.
+type S3Options struct {
+	// Bucket is the name of the S3 bucket.
+	Bucket string
+
+	// Region is the region where the S3 bucket is located.
+	Region string
+
+	// Endpoint is S3 compatible URL of the server.
+	Endpoint string
+
+	// AccessKey is the access key to authenticate to the S3 endpoint.
+	AccessKey string
+
+	// SecretKey is the secret key to authenticate to the S3 endpoint.
+	SecretKey string
+
+	// ForcePathStyle addresses the bucket in the request path, rather than as
+	// a virtual hosted subdomain of the endpoint.
+	ForcePathStyle bool
+}
+
+// S3 is a Backend which stores objects in an S3 compatible bucket.
+type S3 struct {
+	// s3 is the s3 generic client.
+	s3 *s3.S3
+
+	// uploader is the s3 client to upload streams.
+	uploader *s3manager.Uploader
+
+	// bucket is the name of the S3 bucket.
+	bucket string
+}
+
+// NewS3 returns a new S3 backend.
+func NewS3(opts S3Options) (*S3, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(opts.Region),
+		Endpoint:         aws.String(opts.Endpoint),
+		Credentials:      credentials.NewStaticCredentials(opts.AccessKey, opts.SecretKey, ""),
+		S3ForcePathStyle: aws.Bool(opts.ForcePathStyle),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client session for %q: %w", opts.Bucket, err)
+	}
+
+	return &S3{
+		s3:       s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+		bucket:   opts.Bucket,
+	}, nil
+}
+
+// Put implements Backend. Conditional writes are buffered in memory and
+// written with a single PutObject, so should only be used for small objects.
+// Unconditional writes are streamed with a multipart upload.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (string, error) {
+	var contentType, storageClass *string
+	if len(opts.ContentType) > 0 {
+		contentType = aws.String(opts.ContentType)
+	}
+	if len(opts.StorageClass) > 0 {
+		storageClass = aws.String(opts.StorageClass)
+	}
+
+	if !opts.conditional() {
+		out, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket:       aws.String(s.bucket),
+			Key:          aws.String(key),
+			Body:         r,
+			ContentType:  contentType,
+			StorageClass: storageClass,
+		})
+		if err != nil {
+			return "", s.wrapErr(key, err)
+		}
+		return aws.StringValue(out.ETag), nil
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	headers := map[string]string{"If-None-Match": "*"}
+	if len(opts.IfMatch) > 0 {
+		headers = map[string]string{"If-Match": opts.IfMatch}
+	}
+
+	out, err := s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(b),
+		ContentType:  contentType,
+		StorageClass: storageClass,
+	}, request.WithSetRequestHeaders(headers))
+	if err != nil {
+		return "", s.wrapErr(key, err)
+	}
+
+	return aws.StringValue(out.ETag), nil
+}
+
+// Get implements Backend.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	out, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, s.wrapErr(key, err)
+	}
+
+	return out.Body, ObjectInfo{
+		Key:          key,
+		ETag:         aws.StringValue(out.ETag),
+		Size:         aws.Int64Value(out.ContentLength),
+		LastModified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+// Head implements Backend.
+func (s *S3) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, s.wrapErr(key, err)
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		ETag:         aws.StringValue(out.ETag),
+		Size:         aws.Int64Value(out.ContentLength),
+		LastModified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+// Delete implements Backend.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if _, err := s.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return s.wrapErr(key, err)
+	}
+	return nil
+}
+
+// List implements Backend.
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	if err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(out *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range out.Contents {
+			infos = append(infos, ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				ETag:         aws.StringValue(obj.ETag),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	}); err != nil {
+		return nil, s.wrapErr(prefix, err)
+	}
+
+	return infos, nil
+}
+
+// Endpoint implements Backend.
+func (s *S3) Endpoint() string {
+	return s.s3.Endpoint
+}
+
+// wrapErr wraps S3 errors of missing objects and failed conditional writes
+// with ErrNotFound and ErrPreconditionFailed respectively.
+func (s *S3) wrapErr(key string, err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+
+	switch aerr.Code() {
+	// s3.ErrCodeNoSuchKey is not returned for HeadObject requests, so we
+	// hardwire a string.
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return fmt.Errorf("%w: %q: %s", ErrNotFound, key, err)
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return fmt.Errorf("%w: %q: %s", ErrPreconditionFailed, key, err)
+	default:
+		return err
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"path"
 	"sort"
+	"strings"
 	"time"
+
+	"github.com/joshvanl/yazbu/internal/compress"
 )
 
 // Type is the type of a backup entry.
@@ -40,41 +44,10 @@ type DB struct {
 
 	// Entries is the set of backup entry instances that belong to this dataset.
 	Entries []Entry `json:"entries"`
-}
 
-// Cadence describes the cadence of backups, and how older backups are deleted
-// as they decay over time. It is recommended that the user setup the decay
-// rate at each window to decrease the number of backups over time.
-// When a window contains more backups than the maximum target for that window,
-// the middle most backup will be deleted.
-type Cadence struct {
-	// IncrementalPerLastFull is the number of incremental backups to store
-	// between each full backup. All incremental backups are deleted once a full
-	// backup is taken.
-	IncrementalPerLastFull uint `yaml:"incrementalPerLastFull"`
-
-	// FullLast45Days describes the number of full backups to store for the last
-	// 45 days from the current time.
-	// (45 days).
-	FullLast45Days uint `yaml:"fullLast45Days"`
-
-	// FullLast45To182Days describes the number of full backups to store for the
-	// 45->182 days from the current time in the past.
-	// (137 days).
-	Full45To182Days uint `yaml:"full45To182Days"`
-
-	// Full182To365Days describes the number of full backups to store between
-	// 182->365 days from the current time in the past.
-	// (183 days).
-	Full182To365Days uint `yaml:"full182To365Days"`
-
-	// FullPer365Over365Days describes the number of full backups to store after
-	// 365 days from the current time in the past. Every 365 day window is
-	// treated as a separate bucket of backups. The last 365 days from the
-	// current time in the past are not included (i.e. all previous windows
-	// defined above).
-	// (365 days).
-	FullPer365Over365Days uint `yaml:"fullPer365Over365Days"`
+	// ETag is the version of the database file as it was read from the bucket.
+	// Used to detect concurrent modifications, and is not persisted.
+	ETag string `json:"-"`
 }
 
 // Entry is a reference to a backup file for a particular ZFS file system
@@ -99,8 +72,49 @@ type Entry struct {
 	// S3Key is the remote S3 path key where this entry was written to.
 	S3Key string `json:"s3Key"`
 
+	// Snapshot is the name of the ZFS snapshot this entry was sent from, i.e.
+	// `<filesystem>@<name>`. Incremental backups are sent from the Snapshot of
+	// their Parent.
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// GUID is the zfs GUID of the Snapshot. Used to validate that the local
+	// snapshot or bookmark an incremental backup is sent from is the same as
+	// this entry. Zero for entries written before the GUID was recorded.
+	GUID uint64 `json:"guid,omitempty"`
+
 	// Size is the number of bytes this Entry.
 	Size uint64 `json:"size"`
+
+	// StreamSize is the number of bytes of the snapshot stream as produced by
+	// zfs send, before compression and encryption. Size is an estimate made
+	// before sending, so may differ.
+	StreamSize uint64 `json:"streamSize,omitempty"`
+
+	// SHA256 is the hex encoded SHA-256 checksum of the snapshot stream as
+	// produced by zfs send, before compression and encryption.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Compression is the compression algorithm the backup object was
+	// compressed with. Empty if not compressed.
+	Compression string `json:"compression,omitempty"`
+
+	// CompressedSize is the number of bytes of the backup object after
+	// compression. Zero if not compressed.
+	CompressedSize uint64 `json:"compressedSize,omitempty"`
+
+	// ObjectSize is the number of bytes of the backup object as stored in the
+	// bucket, after compression and encryption. Zero for entries written
+	// before the object size was recorded.
+	ObjectSize uint64 `json:"objectSize,omitempty"`
+
+	// Encryption is the encryption scheme the backup object was encrypted with.
+	// Empty if not encrypted.
+	Encryption string `json:"encryption,omitempty"`
+
+	// Deleted is the tombstone timestamp at which this Entry was marked for
+	// deletion. Tombstoned entries are treated as no longer existing, and are
+	// removed from the database once their backup object has been deleted.
+	Deleted *time.Time `json:"deleted,omitempty"`
 }
 
 // Parse parses a full Database file using the given reader. Returns the
@@ -118,12 +132,235 @@ func Parse(r io.Reader) (DB, error) {
 	return db, nil
 }
 
-// ToJSON returns the Cadence as a JSON string.
-func (c Cadence) ToJSON() string {
-	out, err := json.Marshal(c)
-	if err != nil {
-		panic(err)
+// Latest returns the Entry with the highest ID. Returns false if the database
+// has no entries.
+func (db DB) Latest() (Entry, bool) {
+	var (
+		latest Entry
+		found  bool
+	)
+	for _, entry := range db.Entries {
+		if entry.Deleted != nil {
+			continue
+		}
+		if !found || entry.ID > latest.ID {
+			latest, found = entry, true
+		}
+	}
+	return latest, found
+}
+
+// LastFull returns the full backup Entry with the highest ID. Returns false if
+// the database has no full backup entries.
+func (db DB) LastFull() (Entry, bool) {
+	var (
+		last  Entry
+		found bool
+	)
+	for _, entry := range db.Entries {
+		if entry.Deleted == nil && entry.Type == TypeFull && (!found || entry.ID > last.ID) {
+			last, found = entry, true
+		}
+	}
+	return last, found
+}
+
+// IncrementalsSinceLastFull returns the incremental entries which were written
+// after the last full backup, in ascending ID order.
+func (db DB) IncrementalsSinceLastFull() []Entry {
+	last, ok := db.LastFull()
+	if !ok {
+		return nil
+	}
+
+	var incs []Entry
+	for _, entry := range db.Entries {
+		if entry.Deleted == nil && entry.Type == TypeIncremental && entry.ID > last.ID {
+			incs = append(incs, entry)
+		}
+	}
+
+	sort.SliceStable(incs, func(i, j int) bool {
+		return incs[i].ID < incs[j].ID
+	})
+
+	return incs
+}
+
+// Next returns a new Entry of the given type, with the ID and Parent populated
+// so that it follows the existing entries in the database. Full backups are
+// parented to the previous full backup, whilst incremental backups are
+// parented to the latest entry which they are sent from. IDs of tombstoned
+// entries are never reused.
+func (db DB) Next(typ Type) Entry {
+	var entry Entry
+	for _, e := range db.Entries {
+		if e.ID > entry.ID {
+			entry.ID = e.ID
+		}
+	}
+	entry.ID++
+
+	switch typ {
+	case TypeIncremental:
+		if latest, ok := db.Latest(); ok {
+			entry.Parent = latest.ID
+		}
+	case TypeFull:
+		if last, ok := db.LastFull(); ok {
+			entry.Parent = last.ID
+		}
+	}
+
+	entry.Type = typ
+	return entry
+}
+
+// Chain returns the chain of entries required to restore the entry with the
+// given ID, starting with the full backup followed by each incremental backup
+// in order. If id is 0, the latest entry is restored. Returns an error if the
+// chain is broken, i.e. a Parent is missing or the IDs are not consecutive.
+func (db DB) Chain(id int) ([]Entry, error) {
+	byID := make(map[int]Entry, len(db.Entries))
+	for _, entry := range db.Entries {
+		if entry.Deleted == nil {
+			byID[entry.ID] = entry
+		}
+	}
+
+	if id == 0 {
+		latest, ok := db.Latest()
+		if !ok {
+			return nil, fmt.Errorf("database for %q has no entries", db.Filesystem)
+		}
+		id = latest.ID
 	}
 
-	return string(out)
+	entry, ok := byID[id]
+	if !ok {
+		return nil, fmt.Errorf("entry %d does not exist in database for %q", id, db.Filesystem)
+	}
+
+	chain := []Entry{entry}
+	for entry.Type == TypeIncremental {
+		parent, ok := byID[entry.Parent]
+		if !ok {
+			return nil, fmt.Errorf("incremental entry %d has missing parent %d", entry.ID, entry.Parent)
+		}
+		if parent.ID != entry.ID-1 {
+			return nil, fmt.Errorf("incremental entry %d has non-consecutive parent %d", entry.ID, parent.ID)
+		}
+		chain = append([]Entry{parent}, chain...)
+		entry = parent
+	}
+
+	if entry.Type != TypeFull {
+		return nil, fmt.Errorf("entry %d has unknown backup type %q", entry.ID, entry.Type)
+	}
+
+	return chain, nil
+}
+
+// Without returns a copy of the database with the entries of the given IDs
+// removed.
+func (db DB) Without(ids ...int) DB {
+	remove := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	entries := make([]Entry, 0, len(db.Entries))
+	for _, entry := range db.Entries {
+		if !remove[entry.ID] {
+			entries = append(entries, entry)
+		}
+	}
+	db.Entries = entries
+	return db
+}
+
+// Live returns a copy of the database with all tombstoned entries removed.
+func (db DB) Live() DB {
+	entries := make([]Entry, 0, len(db.Entries))
+	for _, entry := range db.Entries {
+		if entry.Deleted == nil {
+			entries = append(entries, entry)
+		}
+	}
+	db.Entries = entries
+	return db
+}
+
+// Tombstoned returns the entries which have been marked for deletion.
+func (db DB) Tombstoned() []Entry {
+	var entries []Entry
+	for _, entry := range db.Entries {
+		if entry.Deleted != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Tombstone marks the entries with the given IDs as deleted at the given time.
+// Entries which are already tombstoned keep their original timestamp.
+func (db DB) Tombstone(now time.Time, ids ...int) DB {
+	marked := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		marked[id] = true
+	}
+
+	entries := make([]Entry, len(db.Entries))
+	for i, entry := range db.Entries {
+		if marked[entry.ID] && entry.Deleted == nil {
+			deleted := now
+			entry.Deleted = &deleted
+		}
+		entries[i] = entry
+	}
+	db.Entries = entries
+	return db
+}
+
+// SnapshotName returns the name of the ZFS snapshot this entry was sent from.
+// Entries written before the snapshot name was recorded have it derived from
+// their S3Key, with the compression and backup type suffixes removed.
+// Encrypted objects have no suffix of their own.
+func (e Entry) SnapshotName(filesystem string) string {
+	if len(e.Snapshot) > 0 {
+		return e.Snapshot
+	}
+
+	name := path.Base(e.S3Key)
+	for _, alg := range compress.Algorithms {
+		if ext := alg.Ext(); len(ext) > 0 && strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	for _, typ := range []Type{TypeFull, TypeIncremental} {
+		if ext := "." + string(typ); strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+
+	return filesystem + "@" + name
+}
+
+// StoredSize returns the size in bytes of the backup object as stored in the
+// bucket. Entries written before the object size was recorded fall back to
+// the compressed size, then the size of the snapshot stream as written, then
+// the estimated size.
+func (e Entry) StoredSize() uint64 {
+	switch {
+	case e.ObjectSize > 0:
+		return e.ObjectSize
+	case e.CompressedSize > 0:
+		return e.CompressedSize
+	case e.StreamSize > 0:
+		return e.StreamSize
+	default:
+		return e.Size
+	}
 }
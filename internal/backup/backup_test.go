@@ -0,0 +1,177 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Next(t *testing.T) {
+	tests := map[string]struct {
+		db  DB
+		typ Type
+		exp Entry
+	}{
+		"if no entries, full backup should have ID 1 and no parent": {
+			db:  DB{},
+			typ: TypeFull,
+			exp: Entry{ID: 1, Parent: 0, Type: TypeFull},
+		},
+		"if full backup after incrementals, should be parented to last full": {
+			db: DB{Entries: []Entry{
+				{ID: 1, Parent: 0, Type: TypeFull},
+				{ID: 2, Parent: 1, Type: TypeIncremental},
+				{ID: 3, Parent: 2, Type: TypeIncremental},
+			}},
+			typ: TypeFull,
+			exp: Entry{ID: 4, Parent: 1, Type: TypeFull},
+		},
+		"if incremental after full, should be parented to the full": {
+			db: DB{Entries: []Entry{
+				{ID: 1, Parent: 0, Type: TypeFull},
+				{ID: 2, Parent: 1, Type: TypeFull},
+			}},
+			typ: TypeIncremental,
+			exp: Entry{ID: 3, Parent: 2, Type: TypeIncremental},
+		},
+		"if incremental after incremental, should be parented to the latest entry": {
+			db: DB{Entries: []Entry{
+				{ID: 1, Parent: 0, Type: TypeFull},
+				{ID: 2, Parent: 1, Type: TypeIncremental},
+			}},
+			typ: TypeIncremental,
+			exp: Entry{ID: 3, Parent: 2, Type: TypeIncremental},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.exp, test.db.Next(test.typ))
+		})
+	}
+}
+
+func Test_IncrementalsSinceLastFull(t *testing.T) {
+	db := DB{Entries: []Entry{
+		{ID: 1, Parent: 0, Type: TypeFull},
+		{ID: 2, Parent: 1, Type: TypeIncremental},
+		{ID: 3, Parent: 1, Type: TypeFull},
+		{ID: 5, Parent: 4, Type: TypeIncremental},
+		{ID: 4, Parent: 3, Type: TypeIncremental},
+	}}
+
+	assert.Equal(t, []Entry{
+		{ID: 4, Parent: 3, Type: TypeIncremental},
+		{ID: 5, Parent: 4, Type: TypeIncremental},
+	}, db.IncrementalsSinceLastFull())
+	assert.Nil(t, DB{}.IncrementalsSinceLastFull())
+}
+
+func Test_SnapshotName(t *testing.T) {
+	assert.Equal(t, "tank/foo@yazbu_2022-01-01_00-00-00",
+		Entry{S3Key: "tank/foo/yazbu_2022-01-01_00-00-00.full"}.SnapshotName("tank/foo"))
+	assert.Equal(t, "tank/foo@bar",
+		Entry{S3Key: "tank/foo/yazbu_2022-01-01_00-00-00.inc", Snapshot: "tank/foo@bar"}.SnapshotName("tank/foo"))
+	assert.Equal(t, "tank/foo@yazbu_2022-01-01_00-00-00",
+		Entry{S3Key: "tank/foo/yazbu_2022-01-01_00-00-00.full.zst"}.SnapshotName("tank/foo"))
+	assert.Equal(t, "tank/foo@yazbu_2022-01-01_00-00-00",
+		Entry{S3Key: "tank/foo/yazbu_2022-01-01_00-00-00.inc.gz"}.SnapshotName("tank/foo"))
+	assert.Equal(t, "tank/foo@yazbu_2022-01-01_00-00-00",
+		Entry{S3Key: "tank/foo/yazbu_2022-01-01_00-00-00.inc.lz4"}.SnapshotName("tank/foo"))
+	assert.Equal(t, "tank/foo@my.snap",
+		Entry{S3Key: "tank/foo/my.snap.full"}.SnapshotName("tank/foo"))
+}
+
+func Test_StoredSize(t *testing.T) {
+	assert.Equal(t, uint64(100), Entry{Size: 100}.StoredSize())
+	assert.Equal(t, uint64(90), Entry{Size: 100, StreamSize: 90}.StoredSize())
+	assert.Equal(t, uint64(50), Entry{Size: 100, StreamSize: 90, CompressedSize: 50}.StoredSize())
+	assert.Equal(t, uint64(60), Entry{Size: 100, StreamSize: 90, CompressedSize: 50, ObjectSize: 60}.StoredSize())
+}
+
+func Test_Chain(t *testing.T) {
+	db := DB{Entries: []Entry{
+		{ID: 1, Parent: 0, Type: TypeFull},
+		{ID: 2, Parent: 1, Type: TypeIncremental},
+		{ID: 3, Parent: 2, Type: TypeIncremental},
+		{ID: 4, Parent: 1, Type: TypeFull},
+		{ID: 5, Parent: 4, Type: TypeIncremental},
+		{ID: 7, Parent: 5, Type: TypeIncremental},
+		{ID: 8, Parent: 6, Type: TypeIncremental},
+	}}
+
+	tests := map[string]struct {
+		id     int
+		exp    []int
+		expErr bool
+	}{
+		"if full backup, expect only that entry": {
+			id:  4,
+			exp: []int{4},
+		},
+		"if incremental, expect full followed by incrementals": {
+			id:  3,
+			exp: []int{1, 2, 3},
+		},
+		"if entry does not exist, expect error": {
+			id:     6,
+			expErr: true,
+		},
+		"if parent is not consecutive, expect error": {
+			id:     7,
+			expErr: true,
+		},
+		"if parent is missing, expect error": {
+			id:     8,
+			expErr: true,
+		},
+		"if id is 0, expect latest entry to be resolved, which has a missing parent": {
+			id:     0,
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			chain, err := db.Chain(test.id)
+			assert.Equal(t, test.expErr, err != nil, "%v", err)
+			var ids []int
+			for _, entry := range chain {
+				ids = append(ids, entry.ID)
+			}
+			assert.Equal(t, test.exp, ids)
+		})
+	}
+}
+
+func Test_Tombstone(t *testing.T) {
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	before := now.Add(-time.Hour)
+
+	db := DB{Entries: []Entry{
+		{ID: 1, Parent: 0, Type: TypeFull, Deleted: &before},
+		{ID: 2, Parent: 1, Type: TypeFull},
+		{ID: 3, Parent: 2, Type: TypeFull},
+	}}
+
+	tombstoned := db.Tombstone(now, 1, 2)
+	assert.Nil(t, db.Entries[1].Deleted, "original database should not be modified")
+	assert.Equal(t, []Entry{
+		{ID: 1, Parent: 0, Type: TypeFull, Deleted: &before},
+		{ID: 2, Parent: 1, Type: TypeFull, Deleted: &now},
+	}, tombstoned.Tombstoned())
+	assert.Equal(t, []Entry{{ID: 3, Parent: 2, Type: TypeFull}}, tombstoned.Live().Entries)
+	assert.Equal(t, []Entry{
+		{ID: 1, Parent: 0, Type: TypeFull, Deleted: &before},
+		{ID: 3, Parent: 2, Type: TypeFull},
+	}, tombstoned.Without(2).Entries)
+
+	latest, ok := tombstoned.Latest()
+	assert.True(t, ok)
+	assert.Equal(t, 3, latest.ID)
+
+	assert.Equal(t, Entry{ID: 4, Parent: 0, Type: TypeFull},
+		DB{Entries: []Entry{{ID: 3, Type: TypeFull, Deleted: &now}}}.Next(TypeFull),
+		"IDs of tombstoned entries should not be reused")
+}
@@ -0,0 +1,198 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CadenceVersion is the current schema version of the Cadence stored in
+// database files. Databases written before the schema was versioned have a
+// LegacyCadence, which is translated when read.
+const CadenceVersion = 2
+
+// day is the duration of a day, as used by retention windows.
+const day = time.Hour * 24
+
+// Cadence describes the cadence of backups, and how older backups are deleted
+// as they decay over time. Full backups are retained according to either the
+// retention Windows, or the GFS rules.
+type Cadence struct {
+	// Version is the schema version of the Cadence. Always CadenceVersion once
+	// read.
+	Version uint `json:"version"`
+
+	// IncrementalPerLastFull is the number of incremental backups to store
+	// between each full backup. All incremental backups are deleted once a full
+	// backup is taken.
+	IncrementalPerLastFull uint `json:"incrementalPerLastFull"`
+
+	// Windows is the ordered list of retention windows of full backups. Each
+	// window starts at the MaxAge of the previous window. When a window
+	// contains more backups than it keeps, the middle most backup will be
+	// deleted. Full backups older than every window are deleted, apart from
+	// the latest.
+	Windows []Window `json:"windows,omitempty"`
+
+	// GFS are grandfather-father-son rules for retaining full backups. If set,
+	// Windows is not used.
+	GFS *GFS `json:"gfs,omitempty"`
+}
+
+// Window is a retention window of full backups.
+type Window struct {
+	// MaxAge is the maximum age of backups in this window. Zero means the
+	// window is unbounded, which may only be the last window.
+	MaxAge Duration `json:"maxAge,omitempty" yaml:"maxAge,omitempty"`
+
+	// Keep is the number of full backups to keep in this window.
+	Keep uint `json:"keep" yaml:"keep"`
+
+	// PerYear treats every calendar year of the window as a separate window,
+	// each keeping Keep full backups.
+	PerYear bool `json:"perYear,omitempty" yaml:"perYear,omitempty"`
+}
+
+// GFS are grandfather-father-son rules for retaining full backups. Each rule
+// keeps the latest full backup of each of the given number of most recent
+// hours, days, weeks, months or years which have a backup. A full backup is
+// kept if it is kept by any rule.
+type GFS struct {
+	// Hourly is the number of hourly full backups to keep.
+	Hourly uint `json:"hourly,omitempty" yaml:"hourly,omitempty"`
+
+	// Daily is the number of daily full backups to keep.
+	Daily uint `json:"daily,omitempty" yaml:"daily,omitempty"`
+
+	// Weekly is the number of weekly full backups to keep. Weeks are ISO 8601
+	// weeks.
+	Weekly uint `json:"weekly,omitempty" yaml:"weekly,omitempty"`
+
+	// Monthly is the number of monthly full backups to keep.
+	Monthly uint `json:"monthly,omitempty" yaml:"monthly,omitempty"`
+
+	// Yearly is the number of yearly full backups to keep.
+	Yearly uint `json:"yearly,omitempty" yaml:"yearly,omitempty"`
+}
+
+// LegacyCadence is the unversioned Cadence of databases written before
+// retention windows were configurable. Full backups were retained in fixed
+// windows of the last 45 days, 45 to 182 days, 182 to 365 days, and each
+// calendar year after 365 days.
+type LegacyCadence struct {
+	IncrementalPerLastFull uint
+	FullLast45Days         uint
+	Full45To182Days        uint
+	Full182To365Days       uint
+	FullPer365Over365Days  uint
+}
+
+// Cadence returns the legacy cadence translated to the current schema.
+func (c LegacyCadence) Cadence() Cadence {
+	return Cadence{
+		Version:                CadenceVersion,
+		IncrementalPerLastFull: c.IncrementalPerLastFull,
+		Windows: []Window{
+			{MaxAge: Duration(45 * day), Keep: c.FullLast45Days},
+			{MaxAge: Duration(182 * day), Keep: c.Full45To182Days},
+			{MaxAge: Duration(365 * day), Keep: c.Full182To365Days},
+			{Keep: c.FullPer365Over365Days, PerYear: true},
+		},
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler, translating a LegacyCadence to
+// the current schema.
+func (c *Cadence) UnmarshalJSON(b []byte) error {
+	var version struct {
+		Version uint `json:"version"`
+	}
+	if err := json.Unmarshal(b, &version); err != nil {
+		return err
+	}
+
+	switch version.Version {
+	case 0:
+		var legacy LegacyCadence
+		if err := json.Unmarshal(b, &legacy); err != nil {
+			return err
+		}
+		*c = legacy.Cadence()
+		return nil
+
+	case CadenceVersion:
+		type cadence Cadence
+		return json.Unmarshal(b, (*cadence)(c))
+
+	default:
+		return fmt.Errorf("unsupported cadence version %d, yazbu may need to be upgraded", version.Version)
+	}
+}
+
+// Equal returns true if the cadences are the same.
+func (c Cadence) Equal(o Cadence) bool {
+	return c.ToJSON() == o.ToJSON()
+}
+
+// ToJSON returns the Cadence as a JSON string.
+func (c Cadence) ToJSON() string {
+	out, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(out)
+}
+
+// Duration is a time.Duration which is encoded as a string. Whole numbers of
+// days are encoded with a "d" suffix.
+type Duration time.Duration
+
+// ParseDuration parses a duration string. As well as the units accepted by
+// time.ParseDuration, a whole number of days, weeks or years may be given with
+// the suffix "d", "w" or "y", for example "45d". A year is 365 days.
+func ParseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": day, "w": 7 * day, "y": 365 * day} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			i, err := strconv.ParseUint(n, 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(i) * unit, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid duration %q, must not be negative", s)
+	}
+	return d, nil
+}
+
+// String returns the duration as a string, in days if a whole number of days.
+func (d Duration) String() string {
+	if d != 0 && time.Duration(d)%day == 0 {
+		return fmt.Sprintf("%dd", time.Duration(d)/day)
+	}
+	return time.Duration(d).String()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(b []byte) error {
+	parsed, err := ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Cadence_UnmarshalJSON(t *testing.T) {
+	tests := map[string]struct {
+		json   string
+		exp    Cadence
+		expErr bool
+	}{
+		"if legacy cadence, expect translated to windows": {
+			json: `{"IncrementalPerLastFull":7,"FullLast45Days":10,"Full45To182Days":10,"Full182To365Days":5,"FullPer365Over365Days":4}`,
+			exp: Cadence{
+				Version:                CadenceVersion,
+				IncrementalPerLastFull: 7,
+				Windows: []Window{
+					{MaxAge: Duration(time.Hour * 24 * 45), Keep: 10},
+					{MaxAge: Duration(time.Hour * 24 * 182), Keep: 10},
+					{MaxAge: Duration(time.Hour * 24 * 365), Keep: 5},
+					{Keep: 4, PerYear: true},
+				},
+			},
+		},
+		"if versioned cadence with gfs, expect decoded": {
+			json: `{"version":2,"incrementalPerLastFull":3,"gfs":{"daily":7,"weekly":4}}`,
+			exp: Cadence{
+				Version:                CadenceVersion,
+				IncrementalPerLastFull: 3,
+				GFS:                    &GFS{Daily: 7, Weekly: 4},
+			},
+		},
+		"if unsupported version, expect error": {
+			json:   `{"version":3}`,
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var c Cadence
+			err := json.Unmarshal([]byte(test.json), &c)
+			require.Equal(t, test.expErr, err != nil, "%v", err)
+			if !test.expErr {
+				assert.Equal(t, test.exp, c)
+			}
+		})
+	}
+}
+
+func Test_Cadence_JSONRoundTrip(t *testing.T) {
+	legacy := LegacyCadence{IncrementalPerLastFull: 7, FullLast45Days: 10}.Cadence()
+	out := legacy.ToJSON()
+	assert.True(t, strings.HasPrefix(out, `{"version":2,`), out)
+	assert.Contains(t, out, `"maxAge":"45d"`)
+
+	var c Cadence
+	require.NoError(t, json.Unmarshal([]byte(out), &c))
+	assert.True(t, legacy.Equal(c))
+	assert.False(t, legacy.Equal(LegacyCadence{IncrementalPerLastFull: 7, FullLast45Days: 9}.Cadence()))
+}
+
+func Test_ParseDuration(t *testing.T) {
+	tests := map[string]struct {
+		exp    time.Duration
+		expErr bool
+	}{
+		"45d":   {exp: time.Hour * 24 * 45},
+		"2w":    {exp: time.Hour * 24 * 14},
+		"1y":    {exp: time.Hour * 24 * 365},
+		"36h":   {exp: time.Hour * 36},
+		"1.5d":  {expErr: true},
+		"-1h":   {expErr: true},
+		"weeks": {expErr: true},
+	}
+
+	for input, test := range tests {
+		t.Run(input, func(t *testing.T) {
+			d, err := ParseDuration(input)
+			require.Equal(t, test.expErr, err != nil, "%v", err)
+			assert.Equal(t, test.exp, d)
+		})
+	}
+
+	assert.Equal(t, "45d", Duration(time.Hour*24*45).String())
+	assert.Equal(t, "36h0m0s", Duration(time.Hour*36).String())
+}
@@ -6,73 +6,121 @@ import (
 	"sort"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-
 	"github.com/joshvanl/yazbu/internal/backup"
 )
 
 // executeCadence will delete all backup entries which need to be deleted,
-// according to the cadence.
-func (f *fsclient) executeCadence(ctx context.Context, db backup.DB) error {
+// according to the cadence. Deletion is performed in two phases so that it
+// can be recovered if interrupted. First, entries are tombstoned in the
+// database, which is written. Secondly, the backup objects of all tombstoned
+// entries are deleted, before the database is written again without them.
+// Tombstoned entries left over from an interrupted run are always deleted.
+// Returns the deleted entries.
+func (f *fsclient) executeCadence(ctx context.Context) ([]backup.Entry, error) {
 	f.log.Info("checking database to delete stale backups based on configured cadence...")
 
-	markedForDeletion, err := f.markedForDeletion(db)
+	db, err := f.updateDB(ctx, f.tombstone)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	tombstoned := db.Tombstoned()
+	if len(tombstoned) == 0 {
+		f.metrics.Entries(db)
+		return nil, nil
 	}
 
-	for _, entry := range markedForDeletion {
+	ids := make([]int, len(tombstoned))
+	for i, entry := range tombstoned {
 		log := f.log.WithValues("name", entry.ID, "timestamp", entry.Timestamp, "type", entry.Type)
 		log.Info("deleting backup")
-		if _, err := f.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
-			Bucket: aws.String(f.bucket),
-			Key:    aws.String(entry.S3Key),
-		}); err != nil {
-			return err
+		if err := f.backend.Delete(ctx, entry.S3Key); err != nil {
+			f.metrics.Pruned(db, i)
+			return tombstoned[:i], fmt.Errorf("failed to delete backup %q, will be retried on next run: %w", entry.S3Key, err)
 		}
 		log.Info("backup deleted")
+		ids[i] = entry.ID
+	}
+
+	f.metrics.Pruned(db, len(tombstoned))
+
+	f.log.Info("removing deleted backups from database", "db_file", f.dbKey)
+	db, err = f.updateDB(ctx, func(db backup.DB) (backup.DB, error) {
+		return db.Without(ids...), nil
+	})
+	if err != nil {
+		return tombstoned, err
+	}
+
+	f.metrics.Entries(db)
+
+	return tombstoned, nil
+}
+
+// tombstone returns the database with all backup entries which need to be
+// deleted according to the cadence tombstoned. The local cadence is used, and
+// overwrites the database's, since getDB has already refused a mismatched
+// cadence unless forced.
+func (f *fsclient) tombstone(db backup.DB) (backup.DB, error) {
+	db.Cadence = f.cadence
+
+	markedForDeletion, err := f.markedForDeletion(db)
+	if err != nil {
+		return db, err
+	}
+
+	ids := make([]int, len(markedForDeletion))
+	for i, entry := range markedForDeletion {
+		ids[i] = entry.ID
+	}
+
+	if len(ids) > 0 {
+		f.log.Info("tombstoning backups marked for deletion in database", "ids", ids)
+	}
+
+	return db.Tombstone(f.clock.Now(), ids...), nil
+}
+
+// nextBackup returns the type of the next backup that should be written to
+// the database according to the cadence, and the entry an incremental backup
+// should be sent from.
+func (f *fsclient) nextBackup(db backup.DB) (backup.Type, backup.Entry) {
+	if _, ok := db.LastFull(); !ok {
+		return backup.TypeFull, backup.Entry{}
 	}
 
-	return nil
+	if uint(len(db.IncrementalsSinceLastFull())) >= f.cadence.IncrementalPerLastFull {
+		return backup.TypeFull, backup.Entry{}
+	}
+
+	latest, _ := db.Latest()
+	return backup.TypeIncremental, latest
 }
 
 // markedForDeletion will return a list of all backups which need to be deleted
 // according to the cadence.
 func (f *fsclient) markedForDeletion(db backup.DB) ([]backup.Entry, error) {
-	now := f.clock.Now()
-
 	var (
 		incrementals []backup.Entry
+		fulls        []backup.Entry
 		lastFull     backup.Entry
-		fullLast45   []backup.Entry
-		full45to182  []backup.Entry
-		full182to365 []backup.Entry
-		full365Plus  = make(map[int][]backup.Entry)
 	)
 
 	for _, entry := range db.Entries {
 		switch {
+		case entry.Deleted != nil:
+			// Already tombstoned, and will be deleted.
+			continue
+
 		case entry.Type == backup.TypeIncremental:
 			incrementals = append(incrementals, entry)
 			// Always continue to next, regardless of time. We will clean up orphaned
 			// incremental backups later.
 			continue
-
-		case entry.Timestamp.After(now.Add(-time.Hour * 24 * 45)):
-			fullLast45 = append(fullLast45, entry)
-
-		case entry.Timestamp.After(now.Add(-time.Hour * 24 * 182)):
-			full45to182 = append(full45to182, entry)
-
-		case entry.Timestamp.After(now.Add(-time.Hour * 24 * 365)):
-			full182to365 = append(full182to365, entry)
-
-		default:
-			// Get the year by mod this backup belongs to.
-			full365Plus[entry.Timestamp.Year()] = append(full365Plus[entry.Timestamp.Year()], entry)
 		}
 
+		fulls = append(fulls, entry)
+
 		// Get the latest full backup.
 		if lastFull.Timestamp.IsZero() || entry.Timestamp.After(lastFull.Timestamp) {
 			lastFull = entry
@@ -108,46 +156,133 @@ func (f *fsclient) markedForDeletion(db backup.DB) ([]backup.Entry, error) {
 		i++
 	}
 
-	for _, set := range []struct {
-		name    string
-		entries []backup.Entry
-		max     int
-	}{
-		{"fullLast45", fullLast45, int(db.Cadence.FullLast45Days)},
-		{"full45to182", full45to182, int(db.Cadence.Full45To182Days)},
-		{"full182to365", full182to365, int(db.Cadence.Full182To365Days)},
-	} {
-		for len(set.entries) > set.max {
-			n := len(set.entries) / 2
-			f.log.Info("deleting full backup from "+set.name,
-				"id", set.entries[n].ID,
-				"timestamp", set.entries[n].Timestamp,
-				"backups", len(set.entries),
-				"max", set.max,
-			)
-			markedForDeletion = append(markedForDeletion, set.entries[n])
-			set.entries = append(set.entries[:n], set.entries[n+1:]...)
+	if db.Cadence.GFS != nil {
+		markedForDeletion = append(markedForDeletion, f.markedByGFS(*db.Cadence.GFS, fulls)...)
+	} else {
+		markedForDeletion = append(markedForDeletion, f.markedByWindows(db.Cadence.Windows, fulls, lastFull)...)
+	}
+
+	sort.SliceStable(markedForDeletion, func(i, j int) bool {
+		return markedForDeletion[i].ID < markedForDeletion[j].ID
+	})
+	return markedForDeletion, nil
+}
+
+// markedByWindows returns the full backups which need to be deleted according
+// to the retention windows. When a window contains more backups than it keeps,
+// the middle most backup is deleted until it doesn't. Backups older than
+// every window are deleted, apart from the latest full backup.
+func (f *fsclient) markedByWindows(windows []backup.Window, fulls []backup.Entry, lastFull backup.Entry) []backup.Entry {
+	now := f.clock.Now()
+
+	type windowKey struct {
+		window int
+		year   int
+	}
+
+	var (
+		marked []backup.Entry
+		keys   []windowKey
+		groups = make(map[windowKey][]backup.Entry)
+	)
+
+	for _, entry := range fulls {
+		window := -1
+		for i, w := range windows {
+			if w.MaxAge == 0 || entry.Timestamp.After(now.Add(-time.Duration(w.MaxAge))) {
+				window = i
+				break
+			}
 		}
+
+		if window < 0 {
+			if entry.ID == lastFull.ID {
+				f.log.Info("keeping latest full backup which is older than all retention windows",
+					"id", entry.ID, "timestamp", entry.Timestamp)
+				continue
+			}
+			f.log.Info("deleting full backup older than all retention windows",
+				"id", entry.ID, "timestamp", entry.Timestamp)
+			marked = append(marked, entry)
+			continue
+		}
+
+		key := windowKey{window: window}
+		if windows[window].PerYear {
+			key.year = entry.Timestamp.Year()
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], entry)
 	}
 
-	for year, entries := range full365Plus {
-		fmt.Printf("%d %v\n", year, entries)
-		for len(entries) > int(db.Cadence.FullPer365Over365Days) {
+	for _, key := range keys {
+		window, entries := windows[key.window], groups[key]
+		for len(entries) > int(window.Keep) {
 			n := len(entries) / 2
-			f.log.Info("deleting full backup from full365Plus",
-				"id", full365Plus[year][n].ID,
-				"timestamp", full365Plus[year][n].Timestamp,
-				"backups", len(full365Plus[year]),
-				"max", int(db.Cadence.FullPer365Over365Days),
-				"year", now.Year()-year,
+			log := f.log.WithValues(
+				"id", entries[n].ID,
+				"timestamp", entries[n].Timestamp,
+				"backups", len(entries),
+				"max", window.Keep,
+				"window", key.window,
+				"maxAge", window.MaxAge,
 			)
-			markedForDeletion = append(markedForDeletion, entries[n])
+			if window.PerYear {
+				log = log.WithValues("year", key.year)
+			}
+			log.Info("deleting full backup from retention window")
+			marked = append(marked, entries[n])
 			entries = append(entries[:n], entries[n+1:]...)
 		}
 	}
 
-	sort.SliceStable(markedForDeletion, func(i, j int) bool {
-		return markedForDeletion[i].ID < markedForDeletion[j].ID
-	})
-	return markedForDeletion, nil
+	return marked
+}
+
+// markedByGFS returns the full backups which need to be deleted according to
+// the grandfather-father-son rules, being those not kept by any rule.
+func (f *fsclient) markedByGFS(gfs backup.GFS, fulls []backup.Entry) []backup.Entry {
+	keep := make(map[int]bool)
+	for _, rule := range []struct {
+		name   string
+		count  uint
+		period func(time.Time) string
+	}{
+		{"hourly", gfs.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{"daily", gfs.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", gfs.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", gfs.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", gfs.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	} {
+		// Walk from the latest backup, keeping the latest of each period.
+		var (
+			last string
+			kept uint
+		)
+		for i := len(fulls) - 1; i >= 0 && kept < rule.count; i-- {
+			period := rule.period(fulls[i].Timestamp)
+			if period == last {
+				continue
+			}
+			last = period
+			kept++
+			keep[fulls[i].ID] = true
+		}
+	}
+
+	var marked []backup.Entry
+	for _, entry := range fulls {
+		if !keep[entry.ID] {
+			f.log.Info("deleting full backup not kept by any gfs rule",
+				"id", entry.ID, "timestamp", entry.Timestamp)
+			marked = append(marked, entry)
+		}
+	}
+
+	return marked
 }
@@ -24,9 +24,9 @@ func Test_markedForDeletion(t *testing.T) {
 	}{
 		"no entries should return no marked entries": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{},
 			},
 			exp:    nil,
@@ -34,10 +34,10 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if incremental backups with a full backup after all incremental timestamps, should return all incremental backups": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 2,
 					FullLast45Days:         2,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-4)},
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeIncremental, Timestamp: epoch.Add(-3)},
@@ -53,9 +53,9 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if more incremental backups than incrementalPerLastFull do nothing": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeIncremental},
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeIncremental},
@@ -67,9 +67,9 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if incremental backups have the wrong parent, should return error": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeIncremental},
 					backup.Entry{ID: 2, Parent: 0, Type: backup.TypeIncremental},
@@ -81,9 +81,9 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if incremental backups have the ID increment, expect error": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeIncremental},
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeIncremental},
@@ -95,10 +95,10 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has less than the max full last 45 days, return nothing": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: epoch.Add(-2)},
 					backup.Entry{ID: 5, Parent: 4, Type: backup.TypeIncremental, Timestamp: epoch.Add(-1)},
@@ -109,10 +109,10 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if same than the max full last 45 days, return nothing": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: epoch.Add(-3)},
 					backup.Entry{ID: 5, Parent: 4, Type: backup.TypeFull, Timestamp: epoch.Add(-2)},
@@ -124,10 +124,10 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if more than the max full last 45 days, return middle entry": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: epoch.Add(-3)},
 					backup.Entry{ID: 5, Parent: 4, Type: backup.TypeFull, Timestamp: epoch.Add(-2)},
@@ -140,10 +140,10 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if many more than the max full last 45 days, return middle entries": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: epoch.Add(-3)},
 					backup.Entry{ID: 5, Parent: 4, Type: backup.TypeFull, Timestamp: epoch.Add(-2)},
@@ -158,13 +158,29 @@ func Test_markedForDeletion(t *testing.T) {
 			},
 			expErr: false,
 		},
+		"if tombstoned entries, should not be counted or returned": {
+			db: backup.DB{
+				Cadence: backup.LegacyCadence{
+					IncrementalPerLastFull: 1,
+					FullLast45Days:         2,
+				}.Cadence(),
+				Entries: []backup.Entry{
+					backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: epoch.Add(-3)},
+					backup.Entry{ID: 5, Parent: 4, Type: backup.TypeFull, Timestamp: epoch.Add(-2), Deleted: &epoch},
+					backup.Entry{ID: 6, Parent: 5, Type: backup.TypeFull, Timestamp: epoch.Add(-1)},
+					backup.Entry{ID: 7, Parent: 6, Type: backup.TypeIncremental, Timestamp: epoch.Add(-1)},
+				},
+			},
+			exp:    nil,
+			expErr: false,
+		},
 		"if has less than the max full 45 to 182 days, return nothing": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 3, Parent: 2, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 46)},
 					backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 45)},
@@ -177,11 +193,11 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has same as the max full 45 to 182 days, return nothing": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 47)},
 					backup.Entry{ID: 3, Parent: 2, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 46)},
@@ -195,11 +211,11 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has more than the max full 45 to 182 days, return middle entry": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 48)},
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 47)},
@@ -214,11 +230,11 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has many more than the max full 45 to 182 days, return middle entries": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 50)},
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 49)},
@@ -239,12 +255,12 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has less than the max full 182 to 365 days, return nothing": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
 					Full182To365Days:       4,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 184)},
 					backup.Entry{ID: 3, Parent: 2, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 183)},
@@ -261,12 +277,12 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has same as the max full 182 to 365 days, return nothing": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
 					Full182To365Days:       4,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 185)},
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 184)},
@@ -284,12 +300,12 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has more than the max full 182 to 365 days, return middle": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
 					Full182To365Days:       4,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 186)},
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 185)},
@@ -308,12 +324,12 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has many more than the max full 182 to 365 days, return middle entries": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
 					Full182To365Days:       4,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 188)},
 					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 187)},
@@ -338,13 +354,13 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has less than the max full per year, return nil": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
 					Full182To365Days:       4,
 					FullPer365Over365Days:  3,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 366 * 2)},
 					backup.Entry{ID: 2, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 365 * 2)},
@@ -360,13 +376,13 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has same as the max full per year, return nothing": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
 					Full182To365Days:       4,
 					FullPer365Over365Days:  3,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 368 * 3)},
 					backup.Entry{ID: 2, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 367 * 3)},
@@ -387,13 +403,13 @@ func Test_markedForDeletion(t *testing.T) {
 		},
 		"if has more than the max full per year, return the middle entries": {
 			db: backup.DB{
-				Cadence: backup.Cadence{
+				Cadence: backup.LegacyCadence{
 					IncrementalPerLastFull: 1,
 					FullLast45Days:         2,
 					Full45To182Days:        3,
 					Full182To365Days:       4,
 					FullPer365Over365Days:  3,
-				},
+				}.Cadence(),
 				Entries: []backup.Entry{
 					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 369 * 3)},
 					backup.Entry{ID: 2, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 368 * 3)},
@@ -423,6 +439,72 @@ func Test_markedForDeletion(t *testing.T) {
 			},
 			expErr: false,
 		},
+		"if windows, delete the middle entries of each window and those older than every window": {
+			db: backup.DB{
+				Cadence: backup.Cadence{
+					Version:                backup.CadenceVersion,
+					IncrementalPerLastFull: 1,
+					Windows: []backup.Window{
+						{MaxAge: backup.Duration(time.Hour * 24 * 7), Keep: 2},
+						{MaxAge: backup.Duration(time.Hour * 24 * 30), Keep: 1},
+					},
+				},
+				Entries: []backup.Entry{
+					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 60)},
+					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 20)},
+					backup.Entry{ID: 3, Parent: 2, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 10)},
+					backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 3)},
+					backup.Entry{ID: 5, Parent: 4, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 2)},
+					backup.Entry{ID: 6, Parent: 5, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 1)},
+				},
+			},
+			exp: []backup.Entry{
+				backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 60)},
+				backup.Entry{ID: 3, Parent: 2, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 10)},
+				backup.Entry{ID: 5, Parent: 4, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 2)},
+			},
+			expErr: false,
+		},
+		"if the latest full is older than every window, it should not be deleted": {
+			db: backup.DB{
+				Cadence: backup.Cadence{
+					Version:                backup.CadenceVersion,
+					IncrementalPerLastFull: 1,
+					Windows: []backup.Window{
+						{MaxAge: backup.Duration(time.Hour * 24 * 7), Keep: 1},
+					},
+				},
+				Entries: []backup.Entry{
+					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 20)},
+					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 10)},
+				},
+			},
+			exp: []backup.Entry{
+				backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: epoch.Add(-time.Hour * 24 * 20)},
+			},
+			expErr: false,
+		},
+		"if gfs, delete entries which are not the latest of a kept period": {
+			db: backup.DB{
+				Cadence: backup.Cadence{
+					Version:                backup.CadenceVersion,
+					IncrementalPerLastFull: 1,
+					GFS:                    &backup.GFS{Daily: 2, Monthly: 2},
+				},
+				Entries: []backup.Entry{
+					backup.Entry{ID: 1, Parent: 0, Type: backup.TypeFull, Timestamp: time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC)},
+					backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: time.Date(2020, 4, 10, 0, 0, 0, 0, time.UTC)},
+					backup.Entry{ID: 3, Parent: 2, Type: backup.TypeFull, Timestamp: time.Date(2020, 4, 29, 10, 0, 0, 0, time.UTC)},
+					backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: time.Date(2020, 4, 30, 1, 0, 0, 0, time.UTC)},
+					backup.Entry{ID: 5, Parent: 4, Type: backup.TypeFull, Timestamp: time.Date(2020, 4, 30, 12, 0, 0, 0, time.UTC)},
+				},
+			},
+			exp: []backup.Entry{
+				backup.Entry{ID: 2, Parent: 1, Type: backup.TypeFull, Timestamp: time.Date(2020, 4, 10, 0, 0, 0, 0, time.UTC)},
+				backup.Entry{ID: 4, Parent: 3, Type: backup.TypeFull, Timestamp: time.Date(2020, 4, 30, 1, 0, 0, 0, time.UTC)},
+			},
+			expErr: false,
+		},
 	}
 
 	for name, test := range tests {
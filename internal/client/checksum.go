@@ -0,0 +1,84 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+)
+
+// checksumReader is an io.Reader which computes the SHA-256 checksum, and
+// counts the number of bytes, of the stream read.
+type checksumReader struct {
+	// r is the underlying reader.
+	r io.Reader
+
+	// h is the running SHA-256 of the stream.
+	h hash.Hash
+
+	// n is the number of bytes read so far.
+	n uint64
+}
+
+// newChecksumReader returns a checksumReader reading from r.
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{r: r, h: sha256.New()}
+}
+
+// Read implements the io.Reader interface.
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	c.n += uint64(n)
+	return n, err
+}
+
+// Sum returns the hex encoded SHA-256 checksum of the stream read so far.
+func (c *checksumReader) Sum() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+// check returns ErrChecksumMismatch if the stream read does not match the
+// stream size and checksum recorded in the entry. Entries without a recorded
+// stream size or checksum are not checked against them.
+func (c *checksumReader) check(entry backup.Entry) error {
+	if entry.StreamSize > 0 && c.n != entry.StreamSize {
+		return fmt.Errorf("%w: backup object %q has stream size %d, expected %d",
+			ErrChecksumMismatch, entry.S3Key, c.n, entry.StreamSize)
+	}
+
+	if len(entry.SHA256) > 0 && c.Sum() != entry.SHA256 {
+		return fmt.Errorf("%w: backup object %q has sha256 %s, expected %s",
+			ErrChecksumMismatch, entry.S3Key, c.Sum(), entry.SHA256)
+	}
+
+	return nil
+}
+
+// VerifyReader returns a reader of the backup stream r, which once read to the
+// end returns ErrChecksumMismatch, rather than io.EOF, if the stream does not
+// match the checksum and stream size recorded in the entry.
+func VerifyReader(r io.Reader, entry backup.Entry) io.Reader {
+	return &verifyReader{sum: newChecksumReader(r), entry: entry}
+}
+
+// verifyReader is an io.Reader which checks the stream against an entry once
+// the end is reached.
+type verifyReader struct {
+	sum   *checksumReader
+	entry backup.Entry
+}
+
+// Read implements the io.Reader interface.
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.sum.Read(p)
+	if err == io.EOF {
+		if cerr := v.sum.check(v.entry); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checksumReader(t *testing.T) {
+	tests := map[string]struct {
+		data   []byte
+		expSum string
+	}{
+		"empty stream should return the checksum of no data": {
+			data:   nil,
+			expSum: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		"stream should return the checksum and size of the data": {
+			data:   []byte("hello world"),
+			expSum: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newChecksumReader(bytes.NewReader(test.data))
+			got, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, len(test.data), len(got))
+			assert.Equal(t, uint64(len(test.data)), r.n)
+			assert.Equal(t, test.expSum, r.Sum())
+		})
+	}
+}
@@ -3,20 +3,23 @@ package client
 import (
 	"context"
 	"fmt"
+	"io"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"filippo.io/age"
 	"github.com/go-logr/logr"
 	"k8s.io/utils/clock"
 
-	"github.com/joshvanl/yazbu/internal/backup"
 	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/backend"
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/client/progress"
+	"github.com/joshvanl/yazbu/internal/compress"
+	"github.com/joshvanl/yazbu/internal/encrypt"
+	"github.com/joshvanl/yazbu/internal/metrics"
 	"github.com/joshvanl/yazbu/internal/util"
 	"github.com/joshvanl/yazbu/internal/zfs"
 )
@@ -25,20 +28,56 @@ const (
 	// fileBackup is the filename or object name which contains the database
 	// data.
 	keyFileBackup = "backup.db"
+
+	// keyFileLock is the filename or object name which contains the lease lock
+	// of the filesystem.
+	keyFileLock = "lock"
 )
 
-// fsrunner is a filesystem operation runner.
-type fsrunner func(context.Context) error
+// Backup describes a zfs snapshot stream which is to be written to a bucket
+// for a filesystem.
+type Backup struct {
+	// Filesystem is the ZFS filesystem the snapshot was taken from.
+	Filesystem string
+
+	// Type is the type of backup being written.
+	Type backup.Type
+
+	// Key is the S3 key the backup will be written to.
+	Key string
+
+	// Snapshot is the name of the snapshot being sent.
+	Snapshot string
+
+	// GUID is the zfs GUID of the snapshot being sent.
+	GUID uint64
+
+	// From is the snapshot the incremental backup is sent from. Must match the
+	// snapshot of the latest entry in the database. Empty for full backups.
+	From string
+
+	// FromGUID is the zfs GUID of the snapshot or bookmark the incremental
+	// backup is sent from. Must match the GUID of the latest entry in the
+	// database, if recorded.
+	FromGUID uint64
+
+	// Size is the estimated size of the snapshot stream.
+	Size uint64
+
+	// Reader is the snapshot stream.
+	Reader zfs.ZFSReader
+}
 
 // Options defines the options for creating Clients.
 type Options struct {
 	// Log is the logger for the Client.
 	Log logr.Logger
 
-	// Filesystems are the ZFS filesystems to backup.
-	Filesystems []string
+	// Filesystems are the ZFS filesystems to backup to the bucket.
+	Filesystems []config.Filesystem
 
-	// Cadence is the cadence of backups to be kept over time.
+	// Cadence is the cadence of backups to be kept over time. Filesystems may
+	// override the cadence.
 	Cadence config.Cadence
 
 	// Bucket contains the configuration for the S3 bucket.
@@ -47,25 +86,51 @@ type Options struct {
 	// IO references files to write to the terminal.
 	IO util.IO
 
+	// Backend is the storage backend of the bucket. If nil, the backend is
+	// created from the Bucket configuration.
+	Backend backend.Backend
+
 	// Force instructs the client to overwrite the existing cadence if it differs
 	// from the local config. Dangerous, and should only be done when the user
 	// knows what they are doing.
 	Force bool
+
+	// Metrics records the outcome of writing, pruning and verifying backups.
+	// May be nil.
+	Metrics *metrics.Metrics
+}
+
+// readCloser is an io.ReadCloser which reads and closes from different
+// sources.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closers is a set of io.Closers which are closed in order.
+type closers []io.Closer
+
+// Close implements the io.Closer interface.
+func (c closers) Close() error {
+	var errs []string
+	for _, closer := range c {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("[%s]", strings.Join(errs, ", "))
+	}
+	return nil
 }
 
-// Client is the zfs backup client for a single S3 bucket.
+// Client is the zfs backup client for a single bucket.
 type Client struct {
 	// log is the client logger.
 	log logr.Logger
 
-	// cadence is the cadence of the backup.
-	cadence config.Cadence
-
-	// s3 is the s3 generic client.
-	s3 *s3.S3
-
-	// uploader is the s3 client to upload files.
-	uploader *s3manager.Uploader
+	// backend is the storage backend of the bucket.
+	backend backend.Backend
 
 	// bucket is the name of the S3 bucket for this client.
 	bucket string
@@ -74,9 +139,26 @@ type Client struct {
 	// file will remain as "STANDARD".
 	storageClass string
 
+	// compression is the compression algorithm applied to backup streams.
+	compression compress.Algorithm
+
+	// compressionLevel is the compression level of the algorithm.
+	compressionLevel int
+
+	// recipients are the age recipients backup streams are encrypted to. If
+	// empty, backups are not encrypted.
+	recipients []age.Recipient
+
+	// identityFile is the path to the age identity file used to decrypt
+	// backups.
+	identityFile string
+
 	// fsclients the set of filesystem clients for this bucket, indexed by the
 	// filesystem.
 	fsclients map[string]*fsclient
+
+	// metrics records the outcome of operations. May be nil.
+	metrics *metrics.Metrics
 }
 
 // New creates a new client for this bucket. Constructs filesystem clients for
@@ -84,32 +166,46 @@ type Client struct {
 func New(opts Options) (*Client, error) {
 	log := opts.Log.WithName(opts.Bucket.Endpoint).WithName(opts.Bucket.Name).WithName("client")
 
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(opts.Bucket.Region),
-		Endpoint:    aws.String(opts.Bucket.Endpoint),
-		Credentials: credentials.NewStaticCredentials(opts.Bucket.AccessKey, opts.Bucket.SecretKey, ""),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create s3 client session for %q: %w", opts.Bucket.Name, err)
+	be := opts.Backend
+	if be == nil {
+		var err error
+		be, err = newBackend(opts.Bucket)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	c := &Client{
 		log:          log.WithName(opts.Bucket.Endpoint).WithName(opts.Bucket.Name),
-		cadence:      opts.Cadence,
-		s3:           s3.New(sess),
-		uploader:     s3manager.NewUploader(sess),
+		backend:      be,
 		bucket:       opts.Bucket.Name,
 		storageClass: opts.Bucket.StorageClass,
 		fsclients:    make(map[string]*fsclient),
+		metrics:      opts.Metrics,
+
+		compression:      compress.Algorithm(opts.Bucket.Compression.Algorithm),
+		compressionLevel: opts.Bucket.Compression.Level,
+	}
+	if len(c.compression) == 0 {
+		c.compression = compress.None
 	}
 
+	var err error
+	c.recipients, err = encrypt.ParseRecipients(opts.Bucket.Encryption.Recipients)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption recipients for %q: %w", opts.Bucket.Name, err)
+	}
+	c.identityFile = opts.Bucket.Encryption.IdentityFile
+
 	for _, fs := range opts.Filesystems {
-		c.fsclients[fs] = &fsclient{
-			log:        log.WithName(fs),
+		c.fsclients[fs.Name] = &fsclient{
+			log:        log.WithName(fs.Name),
 			io:         opts.IO,
 			Client:     c,
-			filesystem: fs,
-			dbKey:      filepath.Join(opts.Bucket.Name, fs, keyFileBackup),
+			filesystem: fs.Name,
+			cadence:    cadenceFromConfig(opts.Cadence.Merge(fs.Cadence)),
+			dbKey:      filepath.Join(opts.Bucket.Name, fs.Name, keyFileBackup),
+			lockKey:    filepath.Join(opts.Bucket.Name, fs.Name, keyFileLock),
 			force:      opts.Force,
 			clock:      clock.RealClock{},
 		}
@@ -139,7 +235,7 @@ func (c *Client) ListDBs(ctx context.Context) ([]backup.DB, error) {
 				errs = append(errs, fmt.Sprintf("%s: %s", fs.filesystem, err.Error()))
 				return
 			}
-			dbs = append(dbs, db)
+			dbs = append(dbs, db.Live())
 		}(fs)
 	}
 	wg.Wait()
@@ -151,54 +247,318 @@ func (c *Client) ListDBs(ctx context.Context) ([]backup.DB, error) {
 	return dbs, nil
 }
 
-// BackupWriteFull writes a full backup to the bucket for every filesystem.
-func (c *Client) BackupWriteFull(ctx context.Context, key string, size uint64, rc zfs.ZFSReader) error {
-	var runners []fsrunner
-	for _, fs := range c.fsclients {
+// DB returns the database of the filesystem in the bucket, without tombstoned
+// entries. The database is read as it is: it is never written, and its
+// cadence is not checked against the local cadence. Returns an empty database
+// with no cadence if the database file does not exist.
+func (c *Client) DB(ctx context.Context, filesystem string) (backup.DB, error) {
+	fs, err := c.fsclient(filesystem)
+	if err != nil {
+		return backup.DB{}, err
+	}
+
+	db, err := fs.readDB(ctx)
+	if err != nil {
+		return backup.DB{}, err
+	}
+
+	return db.Live(), nil
+}
+
+// NextBackup returns the type of the next backup that should be written for
+// the filesystem when performing incremental backups, according to the
+// cadence. If the returned type is incremental, the returned entry is the
+// latest entry in the database which the incremental should be sent from.
+func (c *Client) NextBackup(ctx context.Context, filesystem string) (backup.Type, backup.Entry, error) {
+	fs, err := c.fsclient(filesystem)
+	if err != nil {
+		return "", backup.Entry{}, err
+	}
+
+	db, err := fs.peekDB(ctx)
+	if err != nil {
+		return "", backup.Entry{}, err
+	}
+
+	typ, base := fs.nextBackup(db)
+	return typ, base, nil
+}
+
+// BackupWrite writes the given backup to the bucket for its filesystem, and
+// executes the cadence to delete stale backups. The filesystem lease is held
+// for the duration.
+func (c *Client) BackupWrite(ctx context.Context, b Backup) error {
+	fs, err := c.fsclient(b.Filesystem)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.withLease(ctx, func(ctx context.Context) error {
 		db, err := fs.getDB(ctx)
 		if err != nil {
 			return err
 		}
 
-		runner, err := fs.writeFull(ctx, db, key, size, rc)
-		if err != nil {
+		if _, err := fs.write(ctx, db, b); err != nil {
 			return err
 		}
 
-		runners = append(runners, func(ctx context.Context) error {
-			if err := runner(ctx); err != nil {
-				return err
-			}
-			return fs.executeCadence(ctx, db)
-		})
+		_, err = fs.executeCadence(ctx)
+		return err
+	}); err != nil {
+		c.metrics.Failure(c.backend.Endpoint(), c.bucket, b.Filesystem, metrics.OperationBackup)
+		return fmt.Errorf("BackupWrite %q: %w", c.bucket, err)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	return nil
+}
 
-	var (
-		errs []string
-		wg   sync.WaitGroup
-		lock sync.Mutex
-	)
+// BackupDryRun returns the entries which would be deleted from the database
+// of the backup's filesystem, according to the cadence, if the given backup
+// were written. Nothing is written or deleted. The backup's Reader is not
+// used.
+func (c *Client) BackupDryRun(ctx context.Context, b Backup) ([]backup.Entry, error) {
+	fs, err := c.fsclient(b.Filesystem)
+	if err != nil {
+		return nil, err
+	}
 
-	wg.Add(len(runners))
-	for _, runner := range runners {
-		go func(runner fsrunner) {
-			defer wg.Done()
-			if err := runner(ctx); err != nil {
-				lock.Lock()
-				defer lock.Unlock()
-				errs = append(errs, err.Error())
-				cancel()
-			}
-		}(runner)
+	db, err := fs.peekDB(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("BackupDryRun %q: %w", c.bucket, err)
+	}
+
+	if b.Type == backup.TypeIncremental {
+		if err := fs.checkIncrementalBase(db, b); err != nil {
+			return nil, fmt.Errorf("BackupDryRun %q: %w", c.bucket, err)
+		}
+	}
+
+	entry := db.Next(b.Type)
+	entry.Timestamp = fs.clock.Now()
+	entry.S3Key = b.Key + fs.compression.Ext()
+	entry.Snapshot = b.Snapshot
+	entry.Size = b.Size
+	db.Entries = append(db.Entries, entry)
+
+	db, err = fs.tombstone(db)
+	if err != nil {
+		return nil, fmt.Errorf("BackupDryRun %q: %w", c.bucket, err)
+	}
+
+	return db.Tombstoned(), nil
+}
+
+// Prune deletes the backups of the filesystem which need to be deleted
+// according to the cadence, and any left over from an interrupted prune.
+// Returns the deleted entries. If dryRun is true, the entries which would be
+// deleted are returned without deleting them. The filesystem lease is held
+// for the duration.
+func (c *Client) Prune(ctx context.Context, filesystem string, dryRun bool) ([]backup.Entry, error) {
+	fs, err := c.fsclient(filesystem)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		db, err := fs.peekDB(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Prune %q: %w", c.bucket, err)
+		}
+		db, err = fs.tombstone(db)
+		if err != nil {
+			return nil, fmt.Errorf("Prune %q: %w", c.bucket, err)
+		}
+		return db.Tombstoned(), nil
+	}
+
+	var deleted []backup.Entry
+	if err := fs.withLease(ctx, func(ctx context.Context) error {
+		deleted, err = fs.executeCadence(ctx)
+		return err
+	}); err != nil {
+		c.metrics.Failure(c.backend.Endpoint(), c.bucket, filesystem, metrics.OperationPrune)
+		return deleted, fmt.Errorf("Prune %q: %w", c.bucket, err)
+	}
+
+	return deleted, nil
+}
+
+// Unlock breaks the lease held on each filesystem in the bucket. Leases which
+// have not expired are only broken if force is true. Returns the broken
+// leases, indexed by filesystem.
+func (c *Client) Unlock(ctx context.Context, force bool) (map[string]Lease, error) {
+	var errs []string
+	leases := make(map[string]Lease)
+	for name, fs := range c.fsclients {
+		lease, err := fs.breakLease(ctx, force)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if lease != nil {
+			leases[name] = *lease
+		}
 	}
-	wg.Wait()
 
 	if len(errs) > 0 {
-		return fmt.Errorf("BackupWriteFull %q: [%s]", c.bucket, strings.Join(errs, ", "))
+		return leases, fmt.Errorf("Unlock %q: [%s]", c.bucket, strings.Join(errs, ", "))
 	}
 
-	return nil
+	return leases, nil
+}
+
+// Chain returns the chain of entries required to restore the entry with the
+// given ID for the filesystem. If id is 0, the latest entry is used. Each
+// object in the chain is checked to exist in the bucket. The database is never
+// written, and its cadence is not checked against the local cadence.
+func (c *Client) Chain(ctx context.Context, filesystem string, id int) ([]backup.Entry, error) {
+	fs, err := c.fsclient(filesystem)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := fs.readDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := db.Chain(id)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", c.bucket, err)
+	}
+
+	for _, entry := range chain {
+		if _, err := c.backend.Head(ctx, entry.S3Key); err != nil {
+			return nil, fmt.Errorf("%q: backup object %q for entry %d: %w", c.bucket, entry.S3Key, entry.ID, err)
+		}
+	}
+
+	return chain, nil
+}
+
+// Read returns a reader of the backup object for the given entry. The object
+// is decrypted and decompressed according to the entry.
+func (c *Client) Read(ctx context.Context, filesystem string, entry backup.Entry) (io.ReadCloser, error) {
+	return c.read(ctx, filesystem, entry, true)
+}
+
+// read returns a reader of the backup object for the given entry, optionally
+// writing the download progress.
+func (c *Client) read(ctx context.Context, filesystem string, entry backup.Entry, showProgress bool) (io.ReadCloser, error) {
+	obj, _, err := c.backend.Get(ctx, entry.S3Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup object %q from %q: %w", entry.S3Key, c.bucket, err)
+	}
+
+	var identities []age.Identity
+	if len(entry.Encryption) > 0 && len(c.identityFile) > 0 {
+		identities, err = encrypt.ReadIdentityFile(c.identityFile)
+		if err != nil {
+			obj.Close()
+			return nil, err
+		}
+	}
+
+	var body io.Reader = obj
+	if showProgress {
+		body = progress.New(path.Join(c.bucket, filesystem, entry.S3Key), entry.StoredSize(), body)
+	}
+
+	decrypted, err := encrypt.NewDecryptReader(body, encrypt.Scheme(entry.Encryption), identities)
+	if err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("backup object %q: %w", entry.S3Key, err)
+	}
+
+	r, err := compress.NewDecompressReader(decrypted, compress.Algorithm(entry.Compression))
+	if err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("failed to decompress backup object %q: %w", entry.S3Key, err)
+	}
+
+	return &readCloser{
+		Reader: r,
+		Closer: closers{r, obj},
+	}, nil
+}
+
+// HasFilesystem returns true if the filesystem is backed up to the bucket.
+func (c *Client) HasFilesystem(filesystem string) bool {
+	_, ok := c.fsclients[filesystem]
+	return ok
+}
+
+// Bucket returns the name of the bucket for this client.
+func (c *Client) Bucket() string {
+	return c.bucket
+}
+
+// Endpoint returns the endpoint of the backend for this client.
+func (c *Client) Endpoint() string {
+	return c.backend.Endpoint()
+}
+
+// fsclient returns the filesystem client for the given filesystem.
+func (c *Client) fsclient(filesystem string) (*fsclient, error) {
+	fs, ok := c.fsclients[filesystem]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %q is not configured for bucket %q", filesystem, c.bucket)
+	}
+	return fs, nil
+}
+
+// newBackend returns the storage backend of the given bucket configuration.
+func newBackend(bucket config.Bucket) (backend.Backend, error) {
+	switch backend.Type(bucket.Type) {
+	case backend.TypeLocal:
+		return backend.NewLocal(bucket.Path)
+	case backend.TypeS3, "":
+		return backend.NewS3(backend.S3Options{
+			Bucket:    bucket.Name,
+			Region:    bucket.Region,
+			Endpoint:  bucket.Endpoint,
+			AccessKey: bucket.AccessKey,
+			SecretKey: bucket.SecretKey,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported backend type %q for %q", bucket.Type, bucket.Name)
+	}
+}
+
+// cadenceFromConfig returns the database Cadence of the given config Cadence.
+// The fixed windows are translated to retention windows. Assumes the config
+// has been defaulted and validated.
+func cadenceFromConfig(c config.Cadence) backup.Cadence {
+	deref := func(p *uint) uint {
+		if p == nil {
+			return 0
+		}
+		return *p
+	}
+
+	switch {
+	case len(c.Windows) > 0:
+		return backup.Cadence{
+			Version:                backup.CadenceVersion,
+			IncrementalPerLastFull: deref(c.IncrementalPerLastFull),
+			Windows:                c.Windows,
+		}
+
+	case c.GFS != nil:
+		return backup.Cadence{
+			Version:                backup.CadenceVersion,
+			IncrementalPerLastFull: deref(c.IncrementalPerLastFull),
+			GFS:                    c.GFS,
+		}
+
+	default:
+		return backup.LegacyCadence{
+			IncrementalPerLastFull: deref(c.IncrementalPerLastFull),
+			FullLast45Days:         deref(c.FullLast45Days),
+			Full45To182Days:        deref(c.Full45To182Days),
+			Full182To365Days:       deref(c.Full182To365Days),
+			FullPer365Over365Days:  deref(c.FullPer365Over365Days),
+		}.Cadence()
+	}
 }
@@ -0,0 +1,383 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/backend/fakes3"
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/metrics"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// newTestClient returns a Client of the bucket on the fake S3 server, for the
+// filesystem "tank/foo".
+func newTestClient(t *testing.T, srv *fakes3.Server, bucket config.Bucket, clock *clocktesting.FakeClock) *Client {
+	t.Helper()
+
+	be, err := srv.Backend(bucket.Name)
+	require.NoError(t, err)
+
+	var cfg config.Config
+	c, err := New(Options{
+		Log:         logr.Discard(),
+		Filesystems: []config.Filesystem{{Name: "tank/foo"}},
+		Cadence:     cfg.DefaultValues().Cadence,
+		Bucket:      bucket,
+		IO:          util.IO{Out: io.Discard, Err: io.Discard},
+		Backend:     be,
+	})
+	require.NoError(t, err)
+
+	for _, fs := range c.fsclients {
+		fs.clock = clock
+	}
+
+	return c
+}
+
+// testBackup returns a Backup of the filesystem "tank/foo" with the given
+// data.
+func testBackup(typ backup.Type, snapshot, from string, data []byte) Backup {
+	return Backup{
+		Filesystem: "tank/foo",
+		Type:       typ,
+		Key:        "tank/foo/" + snapshot + "." + string(typ),
+		Snapshot:   "tank/foo@" + snapshot,
+		From:       from,
+		Size:       uint64(len(data)),
+		Reader: func(context.Context, logr.Logger) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+func Test_BackupWrite(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	identityFile := filepath.Join(t.TempDir(), "key.txt")
+	require.NoError(t, os.WriteFile(identityFile, []byte(identity.String()), 0600))
+
+	c := newTestClient(t, srv, config.Bucket{
+		Name:        "bucket",
+		Compression: config.Compression{Algorithm: "zstd"},
+		Encryption: config.Encryption{
+			Recipients:   []string{identity.Recipient().String()},
+			IdentityFile: identityFile,
+		},
+	}, clock)
+
+	full := bytes.Repeat([]byte("full"), 1024)
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeFull, "a", "", full)))
+
+	typ, base, err := c.NextBackup(ctx, "tank/foo")
+	require.NoError(t, err)
+	assert.Equal(t, backup.TypeIncremental, typ)
+	assert.Equal(t, "tank/foo@a", base.Snapshot)
+
+	clock.Step(time.Hour)
+	inc := []byte("incremental")
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeIncremental, "b", "tank/foo@a", inc)))
+
+	assert.Equal(t, []string{
+		"bucket/tank/foo/backup.db",
+		"tank/foo/a.full.zst",
+		"tank/foo/b.inc.zst",
+	}, srv.Keys("bucket"), "lock file should be released")
+
+	obj, ok := srv.Object("bucket", "tank/foo/b.inc.zst")
+	require.True(t, ok)
+	assert.NotContains(t, string(obj.Data), "incremental", "object should be encrypted")
+
+	db, err := c.DB(ctx, "tank/foo")
+	require.NoError(t, err)
+	require.Len(t, db.Entries, 2)
+	assert.Equal(t, 1, db.Entries[0].ID)
+	assert.Equal(t, backup.TypeFull, db.Entries[0].Type)
+	assert.Equal(t, uint64(len(full)), db.Entries[0].StreamSize)
+	assert.Equal(t, 2, db.Entries[1].ID)
+	assert.Equal(t, 1, db.Entries[1].Parent)
+	assert.Equal(t, "zstd", db.Entries[1].Compression)
+	assert.Equal(t, "age", db.Entries[1].Encryption)
+	assert.Equal(t, uint64(len(obj.Data)), db.Entries[1].ObjectSize, "object size should be counted after encryption")
+	assert.Greater(t, db.Entries[1].ObjectSize, db.Entries[1].CompressedSize)
+	assert.Equal(t, uint64(len(inc)), db.Entries[1].StreamSize)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(inc)), db.Entries[1].SHA256)
+	assert.Equal(t, clock.Now(), db.Entries[1].Timestamp)
+
+	chain, err := c.Chain(ctx, "tank/foo", 0)
+	require.NoError(t, err)
+	var restored []byte
+	for _, entry := range chain {
+		rc, err := c.Read(ctx, "tank/foo", entry)
+		require.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		restored = append(restored, b...)
+		assert.NoError(t, c.Verify(ctx, "tank/foo", entry, nil))
+	}
+	assert.Equal(t, append(full, inc...), restored)
+
+	srv.PutObject("bucket", "tank/foo/b.inc.zst", obj.Data[:len(obj.Data)-1])
+	assert.Error(t, c.Verify(ctx, "tank/foo", db.Entries[1], nil), "expected truncated object to fail verification")
+}
+
+func Test_BackupWrite_Cadence(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	c := newTestClient(t, srv, config.Bucket{Name: "bucket"}, clock)
+	c.metrics = metrics.New(metrics.Options{Log: logr.Discard()})
+
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeFull, "a", "", []byte("a"))))
+	clock.Step(time.Hour)
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeIncremental, "b", "tank/foo@a", []byte("b"))))
+	clock.Step(time.Hour)
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeFull, "c", "", []byte("c"))))
+
+	labels := fmt.Sprintf(`bucket="bucket",endpoint=%q,filesystem="tank/foo"`, c.Endpoint())
+	exp := fmt.Sprintf(`
+# HELP yazbu_backup_entries Number of backups in the database, by backup type.
+# TYPE yazbu_backup_entries gauge
+yazbu_backup_entries{%[1]s,type="full"} 2
+yazbu_backup_entries{%[1]s,type="inc"} 0
+# HELP yazbu_backup_uploaded_bytes_total Bytes of backup objects uploaded, after compression and encryption.
+# TYPE yazbu_backup_uploaded_bytes_total counter
+yazbu_backup_uploaded_bytes_total{%[1]s} 3
+# HELP yazbu_prune_deleted_backups_total Number of backups deleted according to the cadence.
+# TYPE yazbu_prune_deleted_backups_total counter
+yazbu_prune_deleted_backups_total{%[1]s} 1
+`, labels)
+	assert.NoError(t, testutil.GatherAndCompare(c.metrics.Gatherer(), strings.NewReader(exp),
+		"yazbu_backup_entries", "yazbu_backup_uploaded_bytes_total", "yazbu_prune_deleted_backups_total"))
+
+	assert.Equal(t, []string{
+		"bucket/tank/foo/backup.db",
+		"tank/foo/a.full",
+		"tank/foo/c.full",
+	}, srv.Keys("bucket"), "incremental should be deleted once a full backup is taken")
+
+	db, err := c.DB(ctx, "tank/foo")
+	require.NoError(t, err)
+	require.Len(t, db.Entries, 2)
+	assert.Equal(t, 1, db.Entries[0].ID)
+	assert.Equal(t, 3, db.Entries[1].ID)
+}
+
+func Test_BackupDryRun(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+
+	c := newTestClient(t, srv, config.Bucket{Name: "bucket"}, clock)
+	removed, err := c.BackupDryRun(ctx, testBackup(backup.TypeFull, "a", "", []byte("a")))
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.Empty(t, srv.Keys("bucket"), "database should not be created")
+
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeFull, "a", "", []byte("a"))))
+	clock.Step(time.Hour)
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeIncremental, "b", "tank/foo@a", []byte("b"))))
+	clock.Step(time.Hour)
+
+	_, err = c.BackupDryRun(ctx, testBackup(backup.TypeIncremental, "c", "tank/foo@a", []byte("c")))
+	assert.Error(t, err, "incremental should be sent from the latest backup")
+
+	keys := srv.Keys("bucket")
+	removed, err = c.BackupDryRun(ctx, testBackup(backup.TypeFull, "c", "", []byte("c")))
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, 2, removed[0].ID, "incremental should be deleted once a full backup is taken")
+	assert.Equal(t, keys, srv.Keys("bucket"), "nothing should be written or deleted")
+
+	db, err := c.DB(ctx, "tank/foo")
+	require.NoError(t, err)
+	assert.Len(t, db.Entries, 2)
+	assert.Empty(t, db.Tombstoned())
+}
+
+func Test_Prune(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+
+	be, err := srv.Backend("bucket")
+	require.NoError(t, err)
+	var zero uint = 0
+	c, err := New(Options{
+		Log:         logr.Discard(),
+		Filesystems: []config.Filesystem{{Name: "tank/foo"}},
+		Cadence: config.Cadence{
+			IncrementalPerLastFull: &zero,
+			Windows:                []backup.Window{{MaxAge: backup.Duration(time.Hour * 24), Keep: 10}},
+		},
+		Bucket:  config.Bucket{Name: "bucket"},
+		IO:      util.IO{Out: io.Discard, Err: io.Discard},
+		Backend: be,
+	})
+	require.NoError(t, err)
+	for _, fs := range c.fsclients {
+		fs.clock = clock
+	}
+
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeFull, "a", "", []byte("a"))))
+	clock.Step(time.Hour)
+	require.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeFull, "b", "", []byte("b"))))
+
+	pruned, err := c.Prune(ctx, "tank/foo", false)
+	require.NoError(t, err)
+	assert.Empty(t, pruned, "backups should be within the window")
+
+	clock.Step(time.Hour * 48)
+	pruned, err = c.Prune(ctx, "tank/foo", true)
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, 1, pruned[0].ID, "latest full backup should be kept")
+	assert.Equal(t, []string{
+		"bucket/tank/foo/backup.db",
+		"tank/foo/a.full",
+		"tank/foo/b.full",
+	}, srv.Keys("bucket"), "dry run should not delete")
+
+	pruned, err = c.Prune(ctx, "tank/foo", false)
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, 1, pruned[0].ID)
+	assert.Equal(t, []string{
+		"bucket/tank/foo/backup.db",
+		"tank/foo/b.full",
+	}, srv.Keys("bucket"))
+}
+
+func Test_NextBackup_FilesystemCadence(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+
+	be, err := srv.Backend("bucket")
+	require.NoError(t, err)
+
+	var one uint = 1
+	var cfg config.Config
+	newClient := func(dbCadence *config.Cadence) *Client {
+		c, err := New(Options{
+			Log: logr.Discard(),
+			Filesystems: []config.Filesystem{
+				{Name: "tank/foo"},
+				{Name: "tank/db", Cadence: dbCadence},
+			},
+			Cadence: cfg.DefaultValues().Cadence,
+			Bucket:  config.Bucket{Name: "bucket"},
+			IO:      util.IO{Out: io.Discard, Err: io.Discard},
+			Backend: be,
+		})
+		require.NoError(t, err)
+		return c
+	}
+	c := newClient(&config.Cadence{IncrementalPerLastFull: &one})
+
+	for _, fs := range []string{"tank/foo", "tank/db"} {
+		b := testBackup(backup.TypeFull, "a", "", []byte("a"))
+		b.Filesystem, b.Key, b.Snapshot = fs, fs+"/a.full", fs+"@a"
+		require.NoError(t, c.BackupWrite(ctx, b))
+
+		b = testBackup(backup.TypeIncremental, "b", fs+"@a", []byte("b"))
+		b.Filesystem, b.Key, b.Snapshot = fs, fs+"/b.inc", fs+"@b"
+		require.NoError(t, c.BackupWrite(ctx, b))
+	}
+
+	typ, _, err := c.NextBackup(ctx, "tank/foo")
+	require.NoError(t, err)
+	assert.Equal(t, backup.TypeIncremental, typ, "should use the global cadence")
+	typ, _, err = c.NextBackup(ctx, "tank/db")
+	require.NoError(t, err)
+	assert.Equal(t, backup.TypeFull, typ, "should use the filesystem cadence")
+
+	// Removing the override mismatches the cadence in the tank/db database
+	// only.
+	c = newClient(nil)
+	_, _, err = c.NextBackup(ctx, "tank/foo")
+	assert.NoError(t, err)
+	_, _, err = c.NextBackup(ctx, "tank/db")
+	assert.Error(t, err, "filesystem cadence should mismatch the remote")
+}
+
+func Test_BackupWrite_Failures(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+
+	t.Run("if database write fails, orphaned backup object should be deleted", func(t *testing.T) {
+		srv := fakes3.New()
+		defer srv.Close()
+		c := newTestClient(t, srv, config.Bucket{Name: "bucket"}, clock)
+
+		// Pruning writes the empty database file.
+		_, err := c.Prune(ctx, "tank/foo", false)
+		require.NoError(t, err)
+
+		srv.InjectFailure(fakes3.Failure{
+			Op:         fakes3.OpPutObject,
+			Key:        "bucket/tank/foo/backup.db",
+			StatusCode: http.StatusForbidden,
+			Code:       "AccessDenied",
+		})
+
+		err = c.BackupWrite(ctx, testBackup(backup.TypeFull, "a", "", []byte("a")))
+		assert.ErrorContains(t, err, "AccessDenied")
+		assert.Equal(t, []string{"bucket/tank/foo/backup.db"}, srv.Keys("bucket"))
+	})
+
+	t.Run("if incremental is not from the latest entry, expect error", func(t *testing.T) {
+		srv := fakes3.New()
+		defer srv.Close()
+		c := newTestClient(t, srv, config.Bucket{Name: "bucket"}, clock)
+
+		err := c.BackupWrite(ctx, testBackup(backup.TypeIncremental, "b", "tank/foo@a", []byte("b")))
+		assert.Error(t, err)
+		assert.Equal(t, []string{"bucket/tank/foo/backup.db"}, srv.Keys("bucket"))
+	})
+
+	t.Run("if filesystem is locked by another run, expect ErrLocked", func(t *testing.T) {
+		srv := fakes3.New()
+		defer srv.Close()
+		c := newTestClient(t, srv, config.Bucket{Name: "bucket"}, clock)
+
+		lease, err := json.Marshal(Lease{ID: "foo", Host: "other", Expires: clock.Now().Add(time.Minute)})
+		require.NoError(t, err)
+		srv.PutObject("bucket", "bucket/tank/foo/lock", lease)
+
+		err = c.BackupWrite(ctx, testBackup(backup.TypeFull, "a", "", []byte("a")))
+		assert.ErrorIs(t, err, ErrLocked)
+
+		clock.Step(time.Minute)
+		assert.NoError(t, c.BackupWrite(ctx, testBackup(backup.TypeFull, "a", "", []byte("a"))),
+			"expired lease should be taken over")
+	})
+}
@@ -0,0 +1,217 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/joshvanl/yazbu/internal/backend"
+	"github.com/joshvanl/yazbu/internal/backup"
+)
+
+const (
+	// maxDBUpdateAttempts is the maximum number of times a database update is
+	// attempted when the database is being concurrently modified.
+	maxDBUpdateAttempts = 5
+)
+
+var (
+	// ErrConcurrentModification is returned when the database file was modified
+	// by another writer since it was read, and the update could not be merged.
+	ErrConcurrentModification = errors.New("database was concurrently modified")
+
+	// dbUpdateBackoff is the time to wait between each database update attempt.
+	// Multiplied by the attempt number.
+	dbUpdateBackoff = time.Millisecond * 200
+)
+
+// updateDB applies the given update to the latest database in the bucket,
+// and writes it only if the database has not been modified since it was read.
+// If a concurrent modification is detected, the database is re-read and the
+// update re-applied. If the update makes no changes, the database is not
+// written. Returns the updated database.
+func (f *fsclient) updateDB(ctx context.Context, update func(backup.DB) (backup.DB, error)) (backup.DB, error) {
+	for attempt := 1; ; attempt++ {
+		db, err := f.getDB(ctx)
+		if err != nil {
+			return db, err
+		}
+
+		updated, err := update(db)
+		if err != nil {
+			return db, err
+		}
+
+		if reflect.DeepEqual(db, updated) {
+			return db, nil
+		}
+
+		etag, err := f.putDB(ctx, updated)
+		if err == nil {
+			updated.ETag = etag
+			return updated, nil
+		}
+
+		if !errors.Is(err, ErrConcurrentModification) {
+			return db, err
+		}
+
+		if attempt >= maxDBUpdateAttempts {
+			return db, fmt.Errorf("failed to update db file %q after %d attempts: %w", f.dbKey, attempt, err)
+		}
+
+		f.log.Info("database was concurrently modified, retrying", "db_file", f.dbKey, "attempt", attempt)
+
+		select {
+		case <-ctx.Done():
+			return db, ctx.Err()
+		case <-time.After(dbUpdateBackoff * time.Duration(attempt)):
+		}
+	}
+}
+
+// putDB writes the given database to the database file in the bucket. The
+// write is conditional on the database file still having the ETag of when the
+// database was read, or not existing if the database has no ETag. Returns
+// ErrConcurrentModification if the condition fails, else the new ETag.
+func (f *fsclient) putDB(ctx context.Context, db backup.DB) (string, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(&db); err != nil {
+		return "", err
+	}
+
+	if len(db.ETag) > 0 {
+		// Not all S3 compatible servers respect conditional writes, so also
+		// verify the ETag before writing to narrow the window of a lost update.
+		info, err := f.backend.Head(ctx, f.dbKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to verify db file %q: %w", f.dbKey, err)
+		}
+		if info.ETag != db.ETag {
+			return "", ErrConcurrentModification
+		}
+	}
+
+	etag, err := f.backend.Put(ctx, f.dbKey, &buf, backend.PutOptions{
+		IfMatch:      db.ETag,
+		IfNoneMatch:  len(db.ETag) == 0,
+		ContentType:  "application/json",
+		StorageClass: "STANDARD",
+	})
+	if errors.Is(err, backend.ErrPreconditionFailed) {
+		return "", ErrConcurrentModification
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write db file %q: %w", f.dbKey, err)
+	}
+
+	return etag, nil
+}
+
+// getDB returns the database file from the bucket, writing an empty database
+// file if it does not exist. Errors if the remote cadence differs from the
+// local cadence, unless forced.
+func (f *fsclient) getDB(ctx context.Context) (backup.DB, error) {
+	if err := f.ensureDBFile(ctx); err != nil {
+		return backup.DB{}, err
+	}
+
+	db, err := f.readDB(ctx)
+	if err != nil {
+		return backup.DB{}, err
+	}
+
+	if len(db.Entries) > 0 && !db.Cadence.Equal(f.cadence) {
+		if !f.force {
+			return backup.DB{}, fmt.Errorf(
+				`local cadence mismatches with remote, use --force to ignore and overwrite.
+WARNING: doing so is incredibly dangerous since you may end up deleting old backups you want. Make sure you know what you are doing before you do this.
+local:
+%s
+
+remote:
+%s
+`,
+				f.cadence.ToJSON(), db.Cadence.ToJSON())
+		} else {
+			fmt.Fprintf(f.io.Err, "WARNING: remote cadence does not match that locally. Will be overwritten\nlocal:\n%s\nremote:\n%s\n", f.cadence.ToJSON(), db.Cadence.ToJSON())
+		}
+	}
+
+	return db, nil
+}
+
+// readDB returns the database file from the bucket as it is, or an empty
+// database with no cadence if it does not exist. The database file is never
+// written, and its cadence is not checked against the local cadence.
+func (f *fsclient) readDB(ctx context.Context) (backup.DB, error) {
+	db := backup.DB{
+		Endpoint:   f.backend.Endpoint(),
+		Bucket:     f.bucket,
+		Filesystem: f.filesystem,
+	}
+
+	rc, info, err := f.backend.Get(ctx, f.dbKey)
+	if errors.Is(err, backend.ErrNotFound) {
+		return db, nil
+	}
+	if err != nil {
+		return backup.DB{}, fmt.Errorf("failed to get bucket database file %q: %w", f.bucket, err)
+	}
+	defer rc.Close()
+
+	remote, err := backup.Parse(rc)
+	if err != nil {
+		return backup.DB{}, err
+	}
+
+	sort.SliceStable(remote.Entries, func(i, j int) bool {
+		return remote.Entries[i].ID < remote.Entries[j].ID
+	})
+
+	db.Cadence = remote.Cadence
+	db.Entries = remote.Entries
+	db.ETag = info.ETag
+	return db, nil
+}
+
+// peekDB returns the database file from the bucket, or an empty database if
+// it does not exist. Unlike getDB, the database file is never written.
+func (f *fsclient) peekDB(ctx context.Context) (backup.DB, error) {
+	_, err := f.backend.Head(ctx, f.dbKey)
+	if errors.Is(err, backend.ErrNotFound) {
+		return backup.DB{
+			Endpoint:   f.backend.Endpoint(),
+			Bucket:     f.bucket,
+			Filesystem: f.filesystem,
+			Cadence:    f.cadence,
+		}, nil
+	}
+	if err != nil {
+		return backup.DB{}, err
+	}
+
+	return f.getDB(ctx)
+}
+
+// ensureDBFiles ensures that the database file exists in the bucket
+// filesystem.
+func (f *fsclient) ensureDBFile(ctx context.Context) error {
+	_, err := f.backend.Head(ctx, f.dbKey)
+	if errors.Is(err, backend.ErrNotFound) {
+		f.log.Info("db file does not exist, writing", "db_file", f.dbKey)
+		_, err := f.putDB(ctx, backup.DB{})
+		if errors.Is(err, ErrConcurrentModification) {
+			// Another writer created the database file first.
+			return nil
+		}
+		return err
+	}
+
+	return err
+}
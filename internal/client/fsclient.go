@@ -1,26 +1,21 @@
 package client
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"path"
-	"reflect"
-	"sort"
 	"sync"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/go-logr/logr"
 	"k8s.io/utils/clock"
 
+	"github.com/joshvanl/yazbu/internal/backend"
 	"github.com/joshvanl/yazbu/internal/backup"
 	"github.com/joshvanl/yazbu/internal/client/progress"
+	"github.com/joshvanl/yazbu/internal/compress"
+	"github.com/joshvanl/yazbu/internal/encrypt"
 	"github.com/joshvanl/yazbu/internal/util"
-	"github.com/joshvanl/yazbu/internal/zfs"
 )
 
 // fsclient is a filesystem client, responsible for running database and backup
@@ -38,9 +33,15 @@ type fsclient struct {
 	// filesystem is the filesystem to backup to S3 buckets.
 	filesystem string
 
+	// cadence is the cadence of the filesystem's backups.
+	cadence backup.Cadence
+
 	// dbKey is the filepath or "key" to the database file object.
 	dbKey string
 
+	// lockKey is the filepath or "key" to the lease lock file object.
+	lockKey string
+
 	// force will overwrite the cadence if their is a difference.
 	force bool
 
@@ -51,147 +52,134 @@ type fsclient struct {
 	clock clock.Clock
 }
 
-// writeFull writes the full backup of the filesystem to the S3 bucket. Updates
-// the database file with
-func (f *fsclient) writeFull(ctx context.Context, db backup.DB, key string, size uint64, rc zfs.ZFSReader) (fsrunner, error) {
-	log := f.log.WithName(key)
+// write writes the backup of the filesystem to the S3 bucket, and updates the
+// database file with the new entry. Returns the updated database.
+func (f *fsclient) write(ctx context.Context, db backup.DB, b Backup) (backup.DB, error) {
+	log := f.log.WithName(b.Key)
+	start := f.clock.Now()
 
 	f.lock.Lock()
 	defer f.lock.Unlock()
 
-	return func(ctx context.Context) error {
-		log.Info("writing full backup")
-
-		reader, err := rc(ctx, log)
-		if err != nil {
-			return err
+	if b.Type == backup.TypeIncremental {
+		if err := f.checkIncrementalBase(db, b); err != nil {
+			return db, err
 		}
+	}
 
-		progress := progress.New(path.Join(f.bucket, f.filesystem, key), size, reader)
-
-		if _, err := f.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-			Bucket:       aws.String(f.bucket),
-			Key:          aws.String(key),
-			Body:         progress,
-			StorageClass: aws.String(f.storageClass),
-		}); err != nil {
-			return fmt.Errorf("failed to create full backup %q: %w", key, err)
-		}
+	log.Info("writing backup", "type", b.Type)
 
-		var parent int
-		for _, entry := range db.Entries {
-			if entry.Type == backup.TypeFull && entry.ID > parent {
-				parent = entry.ID
-			}
-		}
+	reader, err := b.Reader(ctx, log)
+	if err != nil {
+		return db, err
+	}
 
-		db.Entries = append(db.Entries, backup.Entry{
-			ID:        parent + 1,
-			Parent:    parent,
-			Timestamp: f.clock.Now(),
-			Type:      backup.TypeFull,
-			S3Key:     key,
-			Size:      size,
-		})
+	// The checksum is computed over the snapshot stream as produced by zfs
+	// send, before compression and encryption.
+	sum := newChecksumReader(reader)
+	progress := progress.New(path.Join(f.bucket, f.filesystem, b.Key), b.Size, sum)
 
-		log.Info("updating database file", "db_file", f.dbKey)
+	compressed, err := compress.NewReader(progress, f.compression, f.compressionLevel)
+	if err != nil {
+		return db, err
+	}
+	defer compressed.Close()
 
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(&db); err != nil {
-			return err
-		}
+	key := b.Key + f.compression.Ext()
+	counted := &countReader{r: compressed}
 
-		if _, err := f.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-			Bucket:       aws.String(f.bucket),
-			Key:          aws.String(f.dbKey),
-			Body:         &buf,
-			StorageClass: aws.String("STANDARD"),
-		}); err != nil {
-			return fmt.Errorf("failed to create db file %q: %w", f.dbKey, err)
-		}
-		return nil
-	}, nil
-}
+	// Encryption is performed last, as encrypted streams are not compressible.
+	encrypted := encrypt.NewReader(counted, f.recipients)
+	defer encrypted.Close()
+	stored := &countReader{r: encrypted}
 
-// getDB returns the database file from the bucket.
-func (f *fsclient) getDB(ctx context.Context) (backup.DB, error) {
-	if err := f.ensureDBFile(ctx); err != nil {
-		return backup.DB{}, err
+	if _, err := f.backend.Put(ctx, key, stored, backend.PutOptions{
+		StorageClass: f.storageClass,
+	}); err != nil {
+		return db, fmt.Errorf("failed to create %s backup %q: %w", b.Type, key, err)
 	}
 
-	out, err := f.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(f.bucket),
-		Key:    aws.String(f.dbKey),
-	})
-	if err != nil {
-		return backup.DB{}, fmt.Errorf("failed to get bucket database file %q: %w", f.bucket, err)
+	if sum.n != b.Size {
+		log.Info("snapshot stream size differs from estimate", "estimated", b.Size, "actual", sum.n)
 	}
 
-	db, err := backup.Parse(out.Body)
-	if err != nil {
-		return backup.DB{}, err
-	}
+	log.Info("updating database file", "db_file", f.dbKey, "sha256", sum.Sum())
 
-	if !reflect.DeepEqual(db, backup.DB{}) && !reflect.DeepEqual(db.Cadence, f.cadence) {
-		if !f.force {
-			return backup.DB{}, fmt.Errorf(
-				`local cadence mismatches with remote, use --force to ignore and overwrite.
-WARNING: doing so is incredibly dangerous since you may end up deleting old backups you want. Make sure you know what you are doing before you do this.
-local:
-%s
-
-remote:
-%s
-`,
-				f.cadence.ToJSON(), db.Cadence.ToJSON())
-		} else {
-			fmt.Fprintf(f.io.Err, "WARNING: remote cadence does not match that locally. Will be overwritten\nlocal:\n%s\nremote:\n%s\n", f.cadence.ToJSON(), db.Cadence.ToJSON())
+	// The database may have been modified whilst uploading, so the entry is
+	// added to the latest database.
+	db, err = f.updateDB(ctx, func(db backup.DB) (backup.DB, error) {
+		if b.Type == backup.TypeIncremental {
+			if err := f.checkIncrementalBase(db, b); err != nil {
+				return db, fmt.Errorf("%w: %s", ErrConcurrentModification, err)
+			}
 		}
-	}
 
-	sort.SliceStable(db.Entries, func(i, j int) bool {
-		return db.Entries[i].ID < db.Entries[j].ID
+		entry := db.Next(b.Type)
+		entry.Timestamp = f.clock.Now()
+		entry.S3Key = key
+		entry.Snapshot = b.Snapshot
+		entry.GUID = b.GUID
+		entry.Size = b.Size
+		entry.StreamSize = sum.n
+		entry.SHA256 = sum.Sum()
+		entry.ObjectSize = stored.n
+		if f.compression != compress.None {
+			entry.Compression = string(f.compression)
+			entry.CompressedSize = counted.n
+		}
+		if len(f.recipients) > 0 {
+			entry.Encryption = string(encrypt.SchemeAge)
+		}
+		db.Entries = append(db.Entries, entry)
+		db.Cadence = f.cadence
+		return db, nil
 	})
+	if err != nil {
+		log.Info("failed to add backup to database")
+		f.deleteOrphan(ctx, log, key)
+		return db, err
+	}
 
-	return backup.DB{
-		Endpoint:   f.s3.Endpoint,
-		Bucket:     f.bucket,
-		Filesystem: f.filesystem,
-		Cadence:    db.Cadence,
-		Entries:    db.Entries,
-	}, nil
-}
+	f.metrics.BackupWritten(db, db.Entries[len(db.Entries)-1], stored.n, f.clock.Since(start))
 
-// ensureDBFiles ensures that the database file exists in the bucket
-// filesystem.
-func (f *fsclient) ensureDBFile(ctx context.Context) error {
-	_, err := f.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(f.bucket),
-		Key:    aws.String(f.dbKey),
-	})
+	return db, nil
+}
 
-	// s3.ErrCodeNoSuchKey does not work, aws is missing this error code so we
-	// hardwire a string.
-	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
-		f.log.Info("db file does not exist, writing", "db_file", f.dbKey)
+// deleteOrphan deletes a backup object which failed to be added to the
+// database.
+func (f *fsclient) deleteOrphan(ctx context.Context, log logr.Logger, key string) {
+	log.Info("deleting orphaned backup object")
+	if err := f.backend.Delete(ctx, key); err != nil {
+		log.Error(err, "failed to delete orphaned backup object")
+	}
+}
 
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(backup.DB{}); err != nil {
-			return err
-		}
+// checkIncrementalBase returns an error if the incremental backup is not sent
+// from the latest entry in the database, or from a different snapshot of the
+// same name.
+func (f *fsclient) checkIncrementalBase(db backup.DB, b Backup) error {
+	latest, ok := db.Latest()
+	if !ok || latest.SnapshotName(f.filesystem) != b.From {
+		return fmt.Errorf("incremental backup %q is not sent from the latest entry in the database %q", b.Key, f.dbKey)
+	}
+	if latest.GUID != 0 && b.FromGUID != 0 && latest.GUID != b.FromGUID {
+		return fmt.Errorf("incremental backup %q is sent from GUID %d, but the latest entry in the database %q has GUID %d", b.Key, b.FromGUID, f.dbKey, latest.GUID)
+	}
+	return nil
+}
 
-		if _, err := f.uploader.Upload(&s3manager.UploadInput{
-			Bucket:       aws.String(f.bucket),
-			Key:          aws.String(f.dbKey),
-			Body:         &buf,
-			ContentType:  aws.String("application/json"),
-			StorageClass: aws.String("STANDARD"),
-		}); err != nil {
-			return fmt.Errorf("failed to create db file %q: %w", f.dbKey, err)
-		}
+// countReader is an io.Reader which counts the number of bytes read.
+type countReader struct {
+	// r is the underlying reader.
+	r io.Reader
 
-		return nil
-	}
+	// n is the number of bytes read so far.
+	n uint64
+}
 
-	return err
+// Read implements the io.Reader interface.
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
 }
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joshvanl/yazbu/internal/backend"
+)
+
+const (
+	// leaseDuration is the duration a lease is held for before it expires,
+	// unless renewed.
+	leaseDuration = time.Minute * 5
+
+	// leaseRenewInterval is the interval at which a held lease is renewed.
+	leaseRenewInterval = leaseDuration / 3
+
+	// leaseReleaseTimeout is the timeout for releasing a lease. Releasing is
+	// performed on a separate context so that leases are released when the
+	// operation's context has been cancelled, i.e. on signal.
+	leaseReleaseTimeout = time.Second * 30
+)
+
+// ErrLocked is returned when a lease is held on a filesystem in a bucket by
+// another yazbu run.
+var ErrLocked = errors.New("filesystem is locked by another yazbu run")
+
+// Lease is the content of a lease lock object, held by a yazbu run whilst
+// performing a backup or prune on a filesystem in a bucket.
+type Lease struct {
+	// ID is the unique ID of this lease.
+	ID string `json:"id"`
+
+	// Host is the hostname of the machine holding the lease.
+	Host string `json:"host"`
+
+	// PID is the process ID of the yazbu run holding the lease.
+	PID int `json:"pid"`
+
+	// Started is the time at which the lease was acquired.
+	Started time.Time `json:"started"`
+
+	// Expires is the time at which the lease expires, unless renewed.
+	Expires time.Time `json:"expires"`
+}
+
+// String returns a human readable description of the lease holder.
+func (l Lease) String() string {
+	return fmt.Sprintf("%s (pid %d) since %s, expires %s",
+		l.Host, l.PID, l.Started.UTC().Format(time.RFC3339), l.Expires.UTC().Format(time.RFC3339))
+}
+
+// withLease runs the given function whilst holding the lease on the
+// filesystem in the bucket. The lease is renewed whilst the function runs, and
+// released once it returns. If the lease cannot be renewed, the context given
+// to the function is cancelled.
+func (f *fsclient) withLease(ctx context.Context, fn func(context.Context) error) error {
+	lease, etag, err := f.acquireLease(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		renewErr error
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			timer := f.clock.NewTimer(leaseRenewInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+
+			lease.Expires = f.clock.Now().Add(leaseDuration)
+			newEtag, err := f.putLease(ctx, lease, etag)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				f.log.Error(err, "failed to renew lease, aborting")
+				renewErr = fmt.Errorf("lease lost on %q: %w", f.lockKey, err)
+				cancel()
+				return
+			}
+			etag = newEtag
+		}
+	}()
+
+	err = fn(ctx)
+	cancel()
+	wg.Wait()
+
+	releaseCtx, releaseCancel := context.WithTimeout(context.Background(), leaseReleaseTimeout)
+	defer releaseCancel()
+	if rerr := f.releaseLease(releaseCtx, lease); rerr != nil {
+		f.log.Error(rerr, "failed to release lease", "lock_file", f.lockKey)
+	}
+
+	if renewErr != nil {
+		return renewErr
+	}
+
+	return err
+}
+
+// acquireLease acquires the lease on the filesystem in the bucket. Returns
+// ErrLocked if the lease is held by another run and has not expired. Returns
+// the acquired lease, and the ETag of the lock file.
+func (f *fsclient) acquireLease(ctx context.Context) (Lease, string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return Lease{}, "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Lease{}, "", err
+	}
+
+	now := f.clock.Now()
+	lease := Lease{
+		ID:      hex.EncodeToString(id),
+		Host:    hostname,
+		PID:     os.Getpid(),
+		Started: now,
+		Expires: now.Add(leaseDuration),
+	}
+
+	current, etag, err := f.getLease(ctx)
+	if err != nil {
+		return Lease{}, "", err
+	}
+
+	if current != nil {
+		if now.Before(current.Expires) {
+			return Lease{}, "", fmt.Errorf("%w: %q held by %s", ErrLocked, f.lockKey, current)
+		}
+		f.log.Info("taking over expired lease", "lock_file", f.lockKey, "holder", current.String())
+	}
+
+	etag, err = f.putLease(ctx, lease, etag)
+	if errors.Is(err, ErrConcurrentModification) {
+		return Lease{}, "", fmt.Errorf("%w: %q was acquired concurrently", ErrLocked, f.lockKey)
+	}
+	if err != nil {
+		return Lease{}, "", err
+	}
+
+	// Not all S3 compatible servers respect conditional writes, so verify that
+	// the lease was not overwritten by another run.
+	current, etag, err = f.getLease(ctx)
+	if err != nil {
+		return Lease{}, "", err
+	}
+	if current == nil || current.ID != lease.ID {
+		return Lease{}, "", fmt.Errorf("%w: %q was acquired concurrently", ErrLocked, f.lockKey)
+	}
+
+	f.log.Info("acquired lease", "lock_file", f.lockKey)
+
+	return lease, etag, nil
+}
+
+// releaseLease deletes the lock file, if the lease is still held by this run.
+func (f *fsclient) releaseLease(ctx context.Context, lease Lease) error {
+	current, _, err := f.getLease(ctx)
+	if err != nil {
+		return err
+	}
+
+	if current == nil || current.ID != lease.ID {
+		f.log.Info("lease no longer held, not releasing", "lock_file", f.lockKey)
+		return nil
+	}
+
+	if err := f.backend.Delete(ctx, f.lockKey); err != nil {
+		return fmt.Errorf("failed to delete lock file %q: %w", f.lockKey, err)
+	}
+
+	f.log.Info("released lease", "lock_file", f.lockKey)
+
+	return nil
+}
+
+// breakLease deletes the lock file of the filesystem if the lease has expired,
+// or regardless of expiry if force is true. Returns the lease which was
+// broken, or nil if there was no lease to break.
+func (f *fsclient) breakLease(ctx context.Context, force bool) (*Lease, error) {
+	current, _, err := f.getLease(ctx)
+	if err != nil || current == nil {
+		return nil, err
+	}
+
+	if !force && f.clock.Now().Before(current.Expires) {
+		return nil, fmt.Errorf("%w: %q held by %s, use --break-unexpired to break", ErrLocked, f.lockKey, current)
+	}
+
+	if err := f.backend.Delete(ctx, f.lockKey); err != nil {
+		return nil, fmt.Errorf("failed to delete lock file %q: %w", f.lockKey, err)
+	}
+
+	return current, nil
+}
+
+// getLease returns the current lease held on the filesystem, and the ETag of
+// the lock file. Returns nil if no lease is held.
+func (f *fsclient) getLease(ctx context.Context) (*Lease, string, error) {
+	rc, info, err := f.backend.Get(ctx, f.lockKey)
+	if errors.Is(err, backend.ErrNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get lock file %q: %w", f.lockKey, err)
+	}
+	defer rc.Close()
+
+	var lease Lease
+	if err := json.NewDecoder(rc).Decode(&lease); err != nil {
+		return nil, "", fmt.Errorf("failed to decode lock file %q: %w", f.lockKey, err)
+	}
+
+	return &lease, info.ETag, nil
+}
+
+// putLease writes the lease to the lock file. The write is conditional on the
+// lock file having the given ETag, or not existing if the ETag is empty.
+// Returns ErrConcurrentModification if the condition fails, else the new ETag.
+func (f *fsclient) putLease(ctx context.Context, lease Lease, etag string) (string, error) {
+	b, err := json.Marshal(lease)
+	if err != nil {
+		return "", err
+	}
+
+	newEtag, err := f.backend.Put(ctx, f.lockKey, bytes.NewReader(b), backend.PutOptions{
+		IfMatch:      etag,
+		IfNoneMatch:  len(etag) == 0,
+		ContentType:  "application/json",
+		StorageClass: "STANDARD",
+	})
+	if errors.Is(err, backend.ErrPreconditionFailed) {
+		return "", ErrConcurrentModification
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write lock file %q: %w", f.lockKey, err)
+	}
+
+	return newEtag, nil
+}
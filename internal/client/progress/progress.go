@@ -35,12 +35,10 @@ func New(prefix string, size uint64, r io.Reader) *Progress {
 // Read implements io.Reader interface.
 func (p *Progress) Read(b []byte) (int, error) {
 	n, err := p.r.Read(b)
-	if err != nil {
-		return -1, err
+	if n > 0 {
+		read := atomic.AddUint64(&p.read, uint64(n))
+		fmt.Fprintf(out, "%s\t%d/%d (%.2f%%)\n", p.prefix, read, p.size, float64(read*100)/float64(p.size))
 	}
 
-	atomic.AddUint64(&p.read, uint64(n))
-	fmt.Fprintf(out, "%s\t%d/%d (%.2f%%)\n", p.prefix, p.read, p.size, float64(p.read*100)/float64(p.size))
-
-	return n, nil
+	return n, err
 }
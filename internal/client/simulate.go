@@ -0,0 +1,139 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/utils/clock"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/backup"
+)
+
+// SimulateOptions are the options for simulating the cadence of a
+// filesystem's backups.
+type SimulateOptions struct {
+	// Log is the logger of the cadence decisions.
+	Log logr.Logger
+
+	// Cadence is the cadence to simulate. Assumes the config has been
+	// defaulted and validated.
+	Cadence config.Cadence
+
+	// Start is the time of the first simulated backup.
+	Start time.Time
+
+	// Interval is the time between each simulated backup.
+	Interval time.Duration
+
+	// Duration is the length of time to simulate.
+	Duration time.Duration
+
+	// FullSize is the size in bytes of each simulated full backup.
+	FullSize uint64
+
+	// IncrementalSize is the size in bytes of each simulated incremental
+	// backup.
+	IncrementalSize uint64
+}
+
+// Simulation is the result of simulating the cadence.
+type Simulation struct {
+	// Entries are the backups which remain at the end of the simulation, in
+	// ascending ID order.
+	Entries []backup.Entry
+
+	// Samples are the backups stored after each simulated backup.
+	Samples []SimulationSample
+}
+
+// SimulationSample are the backups stored at a point in the simulation.
+type SimulationSample struct {
+	// Time is the time of the sample.
+	Time time.Time
+
+	// Full is the number of full backups stored.
+	Full int
+
+	// Incremental is the number of incremental backups stored.
+	Incremental int
+
+	// Size is the total size in bytes of the backups stored.
+	Size uint64
+}
+
+// Simulate simulates taking backups at every interval for the duration, using
+// the same logic as writing backups to choose the backup type and delete
+// stale backups according to the cadence, against a simulated clock.
+func Simulate(opts SimulateOptions) (Simulation, error) {
+	if opts.Interval <= 0 {
+		return Simulation{}, errors.New("interval must be greater than 0")
+	}
+
+	clock := &simulatedClock{now: opts.Start}
+	f := &fsclient{
+		log:     opts.Log,
+		clock:   clock,
+		cadence: cadenceFromConfig(opts.Cadence),
+	}
+	db := backup.DB{Cadence: f.cadence}
+
+	var samples []SimulationSample
+	end := opts.Start.Add(opts.Duration)
+	for now := opts.Start; !now.After(end); now = now.Add(opts.Interval) {
+		clock.now = now
+
+		typ, _ := f.nextBackup(db)
+		entry := db.Next(typ)
+		entry.Timestamp = now
+		entry.Size = opts.FullSize
+		if typ == backup.TypeIncremental {
+			entry.Size = opts.IncrementalSize
+		}
+		db.Entries = append(db.Entries, entry)
+
+		marked, err := f.markedForDeletion(db)
+		if err != nil {
+			return Simulation{}, err
+		}
+		ids := make([]int, len(marked))
+		for i, entry := range marked {
+			ids[i] = entry.ID
+		}
+		db = db.Without(ids...)
+
+		sample := SimulationSample{Time: now}
+		for _, entry := range db.Entries {
+			if entry.Type == backup.TypeIncremental {
+				sample.Incremental++
+			} else {
+				sample.Full++
+			}
+			sample.Size += entry.Size
+		}
+		samples = append(samples, sample)
+	}
+
+	return Simulation{Entries: db.Entries, Samples: samples}, nil
+}
+
+// simulatedClock is a clock.Clock whose current time is set by the
+// simulation. Only the current time is simulated, as the cadence logic does
+// not use timers.
+type simulatedClock struct {
+	clock.RealClock
+
+	// now is the current simulated time.
+	now time.Time
+}
+
+// Now implements clock.PassiveClock.
+func (s *simulatedClock) Now() time.Time {
+	return s.now
+}
+
+// Since implements clock.PassiveClock.
+func (s *simulatedClock) Since(t time.Time) time.Duration {
+	return s.now.Sub(t)
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/backup"
+)
+
+func Test_Simulate(t *testing.T) {
+	t.Run("default cadence should decay full backups over time", func(t *testing.T) {
+		var cfg config.Config
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		sim, err := Simulate(SimulateOptions{
+			Log:             logr.Discard(),
+			Cadence:         cfg.DefaultValues().Cadence,
+			Start:           start,
+			Interval:        time.Hour * 24,
+			Duration:        time.Hour * 24 * 365 * 3,
+			FullSize:        100,
+			IncrementalSize: 1,
+		})
+		require.NoError(t, err)
+		require.Len(t, sim.Samples, 365*3+1)
+
+		end := start.Add(time.Hour * 24 * 365 * 3)
+		last := sim.Samples[len(sim.Samples)-1]
+		assert.Equal(t, end, last.Time)
+
+		var size uint64
+		var fullLast45, incrementals int
+		for _, entry := range sim.Entries {
+			size += entry.Size
+			switch {
+			case entry.Type == backup.TypeIncremental:
+				incrementals++
+			case entry.Timestamp.After(end.Add(-time.Hour * 24 * 45)):
+				fullLast45++
+			}
+		}
+		assert.Equal(t, last.Size, size)
+		assert.Equal(t, last.Incremental, incrementals)
+		assert.LessOrEqual(t, incrementals, 7)
+		assert.LessOrEqual(t, fullLast45, 10)
+		assert.LessOrEqual(t, last.Full, 10+10+5+4*3)
+		assert.Equal(t, end, sim.Entries[len(sim.Entries)-1].Timestamp, "latest backup should survive")
+	})
+
+	t.Run("gfs should keep the latest of each period", func(t *testing.T) {
+		var zero uint = 0
+		sim, err := Simulate(SimulateOptions{
+			Log: logr.Discard(),
+			Cadence: config.Cadence{
+				IncrementalPerLastFull: &zero,
+				GFS:                    &backup.GFS{Daily: 7, Weekly: 4},
+			},
+			// A Monday.
+			Start:    time.Date(2020, 1, 6, 0, 0, 0, 0, time.UTC),
+			Interval: time.Hour * 24,
+			Duration: time.Hour * 24 * 60,
+			FullSize: 1,
+		})
+		require.NoError(t, err)
+
+		var days []string
+		for _, entry := range sim.Entries {
+			days = append(days, entry.Timestamp.Format("01-02"))
+		}
+		assert.Equal(t, []string{"02-16", "02-23", "02-29", "03-01", "03-02", "03-03", "03-04", "03-05", "03-06"}, days)
+	})
+
+	t.Run("interval must be positive", func(t *testing.T) {
+		_, err := Simulate(SimulateOptions{Log: logr.Discard()})
+		assert.Error(t, err)
+	})
+}
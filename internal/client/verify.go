@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/metrics"
+)
+
+// ErrChecksumMismatch is returned when a backup object does not match the
+// checksum or stream size recorded in the database.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Verify downloads the backup object of the entry, and checks that the
+// decrypted and decompressed stream matches the checksum and stream size
+// recorded in the entry. If validate is not nil, the stream is also passed to
+// it, for example to check that it parses as a zfs send stream. Entries
+// without a recorded checksum are only downloaded and validated.
+func (c *Client) Verify(ctx context.Context, filesystem string, entry backup.Entry, validate func(io.Reader) error) error {
+	if err := c.verify(ctx, filesystem, entry, validate); err != nil {
+		c.metrics.Failure(c.backend.Endpoint(), c.bucket, filesystem, metrics.OperationVerify)
+		return err
+	}
+	return nil
+}
+
+// verify verifies the backup object of the entry.
+func (c *Client) verify(ctx context.Context, filesystem string, entry backup.Entry, validate func(io.Reader) error) error {
+	rc, err := c.read(ctx, filesystem, entry, false)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	sum := newChecksumReader(rc)
+
+	if validate == nil {
+		if _, err := io.Copy(io.Discard, sum); err != nil {
+			return fmt.Errorf("failed to read backup object %q: %w", entry.S3Key, err)
+		}
+	} else {
+		pr, pw := io.Pipe()
+		errCh := make(chan error, 1)
+		go func() {
+			verr := validate(pr)
+			// Drain the remainder of the stream so the checksum covers the
+			// whole object, even if the validator stopped reading early.
+			_, derr := io.Copy(io.Discard, pr)
+			pr.CloseWithError(derr)
+			errCh <- verr
+		}()
+
+		_, err := io.Copy(pw, sum)
+		pw.CloseWithError(err)
+		verr := <-errCh
+		if err != nil {
+			return fmt.Errorf("failed to read backup object %q: %w", entry.S3Key, err)
+		}
+		if verr != nil {
+			return verr
+		}
+	}
+
+	return sum.check(entry)
+}
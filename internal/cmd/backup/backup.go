@@ -2,12 +2,17 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 
 	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/cmd/util/table"
+	"github.com/joshvanl/yazbu/internal/manager"
 	"github.com/joshvanl/yazbu/internal/util"
 )
 
@@ -17,6 +22,24 @@ type backup struct {
 
 	// options is the command options.
 	options *options.Options
+
+	// incremental indicates that incremental backups should be written.
+	incremental bool
+
+	// auto indicates that incremental backups should be written, falling back
+	// to full backups when the incremental base snapshot no longer exists.
+	auto bool
+
+	// continueOnError indicates that writing to the remaining buckets should
+	// continue when writing to a bucket fails.
+	continueOnError bool
+
+	// filesystem limits the backup to the filesystem, if set.
+	filesystem string
+
+	// dryRun indicates that the backups which would be written, and the
+	// backups which would be deleted as a result, should only be listed.
+	dryRun bool
 }
 
 // New constructs a new backup command.
@@ -32,7 +55,29 @@ func New(ctx context.Context, io util.IO) *cobra.Command {
 		Long:    "TODO",
 		Example: "",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := b.options.Manager.BackupFull(ctx); err != nil {
+			if b.incremental && b.auto {
+				return errors.New("--incremental and --auto are mutually exclusive")
+			}
+
+			mode := manager.ModeFull
+			switch {
+			case b.incremental:
+				mode = manager.ModeIncremental
+			case b.auto:
+				mode = manager.ModeAuto
+			}
+
+			opts := manager.BackupOptions{
+				Mode:            mode,
+				Filesystem:      b.filesystem,
+				ContinueOnError: b.continueOnError,
+			}
+
+			if b.dryRun {
+				return b.runDryRun(ctx, opts)
+			}
+
+			if err := b.options.Manager.Backup(ctx, opts); err != nil {
 				fmt.Fprintf(io.Err, "%s\n", err)
 				os.Exit(1)
 			}
@@ -41,7 +86,56 @@ func New(ctx context.Context, io util.IO) *cobra.Command {
 		},
 	}
 
+	cmd.Flags().BoolVar(&b.incremental, "incremental", false,
+		"Write incremental backups from the latest backup in each bucket. A full backup is written instead once the cadence incrementalPerLastFull is reached.")
+	cmd.Flags().BoolVar(&b.auto, "auto", false,
+		"Same as --incremental, but falls back to a full backup if neither the snapshot nor bookmark of the latest backup exist locally.")
+	cmd.Flags().BoolVar(&b.continueOnError, "continue-on-error", false,
+		"Continue writing backups to the remaining buckets when writing to a bucket fails. yazbu still exits non-zero.")
+
+	cmd.Flags().StringVar(&b.filesystem, "filesystem", "",
+		"Only backup this filesystem.")
+	cmd.Flags().BoolVar(&b.dryRun, "dry-run", false,
+		"List the snapshots which would be created with their estimated size, and the backups each bucket would delete, without creating snapshots or writing to the buckets.")
+
 	b.options = options.New(ctx, io, cmd)
 
 	return cmd
 }
+
+// runDryRun writes the backups which would be written, followed by the
+// backups which would be deleted as a result.
+func (b *backup) runDryRun(ctx context.Context, opts manager.BackupOptions) error {
+	planned, err := b.options.Manager.BackupDryRun(ctx, opts)
+
+	tbl := table.NewBuilder([]string{"dataset", "endpoint", "bucket", "snapshot", "type", "from", "estimated size"})
+	for _, p := range planned {
+		from := p.From
+		if len(from) == 0 {
+			from = "-"
+		}
+		tbl.AddRow(p.Filesystem, p.Endpoint, p.Bucket, p.Snapshot, p.Type, from, humanize.Bytes(p.Size))
+	}
+	if berr := tbl.Build(b.Out); berr != nil {
+		return berr
+	}
+
+	fmt.Fprintln(b.Out)
+
+	tbl = table.NewBuilder([]string{"dataset", "endpoint", "bucket", "id", "type", "timestamp", "size"})
+	for _, p := range planned {
+		for _, entry := range p.Removed {
+			tbl.AddRow(p.Filesystem, p.Endpoint, p.Bucket, entry.ID, entry.Type, entry.Timestamp.Format(time.RFC3339), humanize.Bytes(entry.Size))
+		}
+	}
+	if berr := tbl.Build(b.Out); berr != nil {
+		return berr
+	}
+
+	if err != nil {
+		fmt.Fprintf(b.Err, "%s\n", err)
+		os.Exit(1)
+	}
+
+	return nil
+}
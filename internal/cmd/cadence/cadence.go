@@ -0,0 +1,21 @@
+package cadence
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// New returns a new cadence command.
+func New(ctx context.Context, io util.IO) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cadence",
+		Short: "Inspect the configured cadence of backups.",
+	}
+
+	cmd.AddCommand(newSimulate(ctx, io))
+
+	return cmd
+}
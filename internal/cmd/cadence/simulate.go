@@ -0,0 +1,182 @@
+package cadence
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/client"
+	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/cmd/util/table"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// simulate is the cadence simulate command.
+type simulate struct {
+	util.IO
+
+	// options is the command options.
+	options *options.Options
+
+	// filesystem is the filesystem whose cadence is simulated. If empty, the
+	// global cadence is simulated.
+	filesystem string
+
+	// interval is the time between each simulated backup.
+	interval time.Duration
+
+	// years is the number of years to simulate.
+	years uint
+
+	// fullSize is the size of each simulated full backup.
+	fullSize string
+
+	// incrementalSize is the size of each simulated incremental backup.
+	incrementalSize string
+
+	// sampleInterval is the time between each row of the stored size table.
+	sampleInterval time.Duration
+
+	// csv indicates that the stored backups after every simulated backup
+	// should be written as CSV.
+	csv bool
+}
+
+// newSimulate constructs a new cadence simulate command.
+func newSimulate(ctx context.Context, io util.IO) *cobra.Command {
+	s := simulate{IO: io}
+
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Simulate which backups the configured cadence keeps over time.",
+		Long:  "Simulates taking a backup at every interval for a number of years, using the configured cadence to choose between full and incremental backups and to delete stale backups. Prints the backups which survive at the end of the simulation with the spacing between them, followed by the number and total size of the backups stored over time. No buckets or filesystems are accessed.",
+		Example: `  yazbu cadence simulate --interval 24h --years 5
+  yazbu cadence simulate --filesystem tank/db --interval 1h --years 1
+  yazbu cadence simulate --csv > stored.csv`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cadence := s.options.Config.Cadence
+			if len(s.filesystem) > 0 {
+				var found bool
+				for _, fs := range s.options.Config.Filesystems {
+					if fs.Name == s.filesystem {
+						cadence, found = cadence.Merge(fs.Cadence), true
+						break
+					}
+				}
+				if !found {
+					return fmt.Errorf("filesystem %q is not configured", s.filesystem)
+				}
+			}
+
+			fullSize, err := humanize.ParseBytes(s.fullSize)
+			if err != nil {
+				return fmt.Errorf("invalid --full-size: %w", err)
+			}
+			incrementalSize, err := humanize.ParseBytes(s.incrementalSize)
+			if err != nil {
+				return fmt.Errorf("invalid --incremental-size: %w", err)
+			}
+
+			sim, err := client.Simulate(client.SimulateOptions{
+				Log:             logr.Discard(),
+				Cadence:         cadence,
+				Start:           time.Now().UTC(),
+				Interval:        s.interval,
+				Duration:        time.Duration(s.years) * time.Hour * 24 * 365,
+				FullSize:        fullSize,
+				IncrementalSize: incrementalSize,
+			})
+			if err != nil {
+				fmt.Fprintf(io.Err, "%s\n", err)
+				os.Exit(1)
+			}
+
+			if s.csv {
+				return s.writeCSV(sim)
+			}
+			return s.writeTables(sim)
+		},
+	}
+
+	cmd.Flags().StringVar(&s.filesystem, "filesystem", "",
+		"Simulate the cadence of this filesystem, including its overrides. Defaults to the global cadence.")
+	cmd.Flags().DurationVar(&s.interval, "interval", time.Hour*24,
+		"Time between each simulated backup.")
+	cmd.Flags().UintVar(&s.years, "years", 5,
+		"Number of years to simulate.")
+	cmd.Flags().StringVar(&s.fullSize, "full-size", "10GB",
+		"Size of each simulated full backup.")
+	cmd.Flags().StringVar(&s.incrementalSize, "incremental-size", "1GB",
+		"Size of each simulated incremental backup.")
+	cmd.Flags().DurationVar(&s.sampleInterval, "sample-interval", time.Hour*24*30,
+		"Time between each row of the stored backups table. Ignored with --csv.")
+	cmd.Flags().BoolVar(&s.csv, "csv", false,
+		"Write the backups stored after every simulated backup as CSV, for plotting.")
+
+	s.options = options.NewConfig(ctx, io, cmd)
+
+	return cmd
+}
+
+// writeTables writes the surviving backups, and the backups stored over time
+// sampled at the sample interval.
+func (s *simulate) writeTables(sim client.Simulation) error {
+	if len(sim.Samples) == 0 {
+		return nil
+	}
+	end := sim.Samples[len(sim.Samples)-1].Time
+
+	tbl := table.NewBuilder([]string{"id", "type", "timestamp", "age", "spacing", "size"})
+	for i, entry := range sim.Entries {
+		spacing := "-"
+		if i > 0 {
+			spacing = backup.Duration(entry.Timestamp.Sub(sim.Entries[i-1].Timestamp)).String()
+		}
+		tbl.AddRow(entry.ID, entry.Type, entry.Timestamp.Format(time.RFC3339),
+			backup.Duration(end.Sub(entry.Timestamp)).String(), spacing, humanize.Bytes(entry.Size))
+	}
+	if err := tbl.Build(s.Out); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(s.Out)
+
+	tbl = table.NewBuilder([]string{"timestamp", "full", "incremental", "size"})
+	next := sim.Samples[0].Time
+	for i, sample := range sim.Samples {
+		if sample.Time.Before(next) && i < len(sim.Samples)-1 {
+			continue
+		}
+		next = sample.Time.Add(s.sampleInterval)
+		tbl.AddRow(sample.Time.Format(time.RFC3339), sample.Full, sample.Incremental, humanize.Bytes(sample.Size))
+	}
+	return tbl.Build(s.Out)
+}
+
+// writeCSV writes the backups stored after every simulated backup as CSV.
+func (s *simulate) writeCSV(sim client.Simulation) error {
+	w := csv.NewWriter(s.Out)
+	if err := w.Write([]string{"timestamp", "full", "incremental", "bytes"}); err != nil {
+		return err
+	}
+	for _, sample := range sim.Samples {
+		if err := w.Write([]string{
+			sample.Time.Format(time.RFC3339),
+			strconv.Itoa(sample.Full),
+			strconv.Itoa(sample.Incremental),
+			strconv.FormatUint(sample.Size, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
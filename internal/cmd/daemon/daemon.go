@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/daemon"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// New constructs a new daemon command.
+func New(ctx context.Context, io util.IO) *cobra.Command {
+	var (
+		opts        *options.Options
+		metricsAddr string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Run full and incremental backups, prune and verify on a schedule.",
+		Long:  "Runs in the foreground, running the jobs of each filesystem according to the schedule config. Each job is either an interval or a cron expression. Jobs of the same filesystem never run concurrently. The time each job last ran is recorded in the schedule state file, so that runs missed whilst the host was asleep or the daemon was stopped are run once on start or wake. Jobs which have never run are run immediately. On SIGINT or SIGTERM, no more jobs are started and the daemon exits once the running jobs have stopped.",
+		Example: `  yazbu daemon -c /etc/yazbu/config.yaml
+  yazbu daemon --metrics-addr :9100`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := daemon.New(daemon.Options{
+				Log:     opts.Log,
+				Manager: opts.Manager,
+				Config:  *opts.Config,
+			})
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			var wg sync.WaitGroup
+			if len(metricsAddr) > 0 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := opts.Metrics.Serve(ctx, metricsAddr); err != nil {
+						fmt.Fprintf(io.Err, "failed to serve metrics: %s\n", err)
+						cancel()
+					}
+				}()
+			}
+
+			err = d.Run(ctx)
+			cancel()
+			wg.Wait()
+			if err != nil {
+				fmt.Fprintf(io.Err, "%s\n", err)
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&metricsAddr, "metrics-addr", "",
+		"Address to serve Prometheus metrics on at /metrics, for example \":9100\". If empty, metrics are not served.")
+
+	opts = options.New(ctx, io, cmd)
+
+	return cmd
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 
+	"github.com/joshvanl/yazbu/internal/backup"
 	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/cmd/util/output"
 	"github.com/joshvanl/yazbu/internal/cmd/util/table"
+	"github.com/joshvanl/yazbu/internal/manager"
 	"github.com/joshvanl/yazbu/internal/util"
 )
 
@@ -19,6 +24,18 @@ type list struct {
 
 	// options is the command options.
 	options *options.Options
+
+	// output is the output format of the backups.
+	output output.Format
+
+	// list is the options for listing backups.
+	list manager.ListOptions
+
+	// since and until are the time filters, parsed by parseTime.
+	since, until string
+
+	// summary prints a summary of each database instead of each backup.
+	summary bool
 }
 
 // New returns a new list command.
@@ -26,50 +43,184 @@ func New(ctx context.Context, io util.IO) *cobra.Command {
 	b := list{IO: io}
 
 	cmd := &cobra.Command{
-		Use:     "list",
-		Short:   "TODO",
-		Long:    "TODO",
-		Example: "",
+		Use:   "list",
+		Short: "List the backups of each filesystem in each bucket.",
+		Long:  "List reads the database of each filesystem in each bucket and prints its backups, or with --summary the number, size and age of the backups in each database. Filters are applied to the backups of each database. The json and yaml output formats are a stable, versioned schema which includes the age of each backup and its position in its restore chain.",
+		Example: `  yazbu list
+  yazbu list -o wide --filesystem tank/data --since 7d
+  yazbu list --type full --sort size --latest 5
+  yazbu list --summary -o json`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fsDBs, err := b.options.Manager.ListDBs(ctx)
+			now := time.Now()
+
+			var err error
+			if b.list.Since, err = parseTime(b.since, now); err != nil {
+				return fmt.Errorf("invalid --since: %w", err)
+			}
+			if b.list.Until, err = parseTime(b.until, now); err != nil {
+				return fmt.Errorf("invalid --until: %w", err)
+			}
+
+			fsDBs, err := b.options.Manager.ListDBs(ctx, b.list)
 			if err != nil {
 				fmt.Fprintf(io.Err, "%s\n", err)
 				os.Exit(1)
 			}
 
-			tbl := table.NewBuilder([]string{"dataset", "endpoint", "bucket", "id", "parent", "type", "path", "size", "timestamp"})
-
-			for fs, dbs := range fsDBs {
-				if len(dbs) == 0 || len(dbs[0].Entries) == 0 {
-					continue
+			if b.summary {
+				out := newSummaryOutput(fsDBs)
+				switch b.output {
+				case output.FormatJSON, output.FormatYAML:
+					return output.Encode(io.Out, b.output, out)
+				default:
+					return b.printSummaryTable(out)
 				}
+			}
+
+			out := newOutput(fsDBs, now)
+			switch b.output {
+			case output.FormatJSON, output.FormatYAML:
+				return output.Encode(io.Out, b.output, out)
+			default:
+				return b.printTable(out)
+			}
+		},
+	}
 
-				for i, db := range dbs {
-					if len(db.Entries) == 0 {
-						continue
-					}
+	cmd.Flags().StringVar(&b.list.Filesystem, "filesystem", "", "Only list backups of this filesystem.")
+	cmd.Flags().StringVar(&b.list.Bucket, "bucket", "", "Only list backups in buckets with this name.")
+	cmd.Flags().StringVar(&b.list.Endpoint, "endpoint", "", "Only list backups in buckets at this endpoint.")
+	cmd.Flags().Var((*typeFlag)(&b.list.Type), "type", "Only list backups of this type. One of [full inc].")
+	cmd.Flags().StringVar(&b.since, "since", "", "Only list backups written at or after this time. Either an RFC 3339 time, or a duration before now such as 36h or 7d.")
+	cmd.Flags().StringVar(&b.until, "until", "", "Only list backups written at or before this time. Either an RFC 3339 time, or a duration before now such as 36h or 7d.")
+	cmd.Flags().IntVar(&b.list.Latest, "latest", 0, "Only list this number of the latest matching backups of each database. 0 lists all.")
+	cmd.Flags().StringVar((*string)(&b.list.Sort), "sort", string(manager.ListSortID), "Order of the backups of each database. One of [id time size]. Sizes are largest first.")
+	cmd.Flags().BoolVar(&b.summary, "summary", false, "Print the number, total size, and oldest and newest backup of each database instead of each backup.")
+	output.AddFlag(cmd, &b.output, output.FormatTable, output.FormatWide, output.FormatJSON, output.FormatYAML)
+	b.options = options.New(ctx, io, cmd)
 
-					{
-						entry := db.Entries[0]
-						if i == 0 {
-							tbl.AddRow(fs, db.Endpoint, db.Bucket, entry.ID, entry.Parent, entry.Type, entry.S3Key, humanize.Bytes(entry.Size), entry.Timestamp.UTC().String())
-						} else {
-							tbl.AddRow("", db.Endpoint, db.Bucket, entry.ID, entry.Parent, entry.Type, entry.S3Key, humanize.Bytes(entry.Size), entry.Timestamp.UTC().String())
-						}
-					}
+	return cmd
+}
 
-					for _, entry := range db.Entries[1:] {
-						tbl.AddRow("", "", "", entry.ID, entry.Parent, entry.Type, entry.S3Key, humanize.Bytes(entry.Size), entry.Timestamp.UTC().String())
-					}
+// printTable writes the backups as a table, with additional columns if the
+// output format is wide.
+func (b *list) printTable(out listOutput) error {
+	wide := b.output == output.FormatWide
 
+	headers := []string{"dataset", "endpoint", "bucket", "id", "parent", "type", "path", "size", "compressed", "timestamp"}
+	if wide {
+		headers = append(headers, "snapshot", "chain", "age", "encryption", "sha256")
+	}
+	tbl := table.NewBuilder(headers)
+
+	for _, fs := range out.Filesystems {
+		name := fs.Name
+		for _, db := range fs.Databases {
+			if len(db.Entries) == 0 {
+				continue
+			}
+
+			endpoint, bucket := db.Endpoint, db.Bucket
+			for _, entry := range db.Entries {
+				row := []interface{}{name, endpoint, bucket, entry.ID, entry.Parent, entry.Type, entry.Key, humanize.Bytes(entry.Size), compressedSize(entry), entry.Timestamp.String()}
+				if wide {
+					row = append(row, orDash(entry.Snapshot), chain(entry), entry.Age, orDash(entry.Encryption), orDash(entry.SHA256))
 				}
+				tbl.AddRow(row...)
+				name, endpoint, bucket = "", "", ""
 			}
+		}
+	}
 
-			return tbl.Build(io.Out)
-		},
+	return tbl.Build(b.Out)
+}
+
+// printSummaryTable writes the summary of each database as a table.
+func (b *list) printSummaryTable(out summaryOutput) error {
+	tbl := table.NewBuilder([]string{"dataset", "endpoint", "bucket", "backups", "full", "inc", "size", "stored", "oldest", "newest"})
+
+	for _, fs := range out.Filesystems {
+		name := fs.Name
+		for _, db := range fs.Databases {
+			tbl.AddRow(name, db.Endpoint, db.Bucket, db.Backups, db.Full, db.Incremental,
+				humanize.Bytes(db.Size), humanize.Bytes(db.StoredSize), timeOrDash(db.Oldest), timeOrDash(db.Newest))
+			name = ""
+		}
 	}
 
-	b.options = options.New(ctx, io, cmd)
+	return tbl.Build(b.Out)
+}
 
-	return cmd
+// parseTime parses the time as either an RFC 3339 time, or a duration before
+// now. Returns the zero time if empty.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := backup.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", s)
+	}
+	return now.Add(-d), nil
+}
+
+// typeFlag is a pflag.Value of a backup type.
+type typeFlag backup.Type
+
+// String implements pflag.Value.
+func (t *typeFlag) String() string {
+	return string(*t)
+}
+
+// Set implements pflag.Value.
+func (t *typeFlag) Set(s string) error {
+	switch backup.Type(s) {
+	case backup.TypeFull, backup.TypeIncremental:
+		*t = typeFlag(s)
+		return nil
+	default:
+		return fmt.Errorf("unknown backup type %q, must be one of [%s %s]", s, backup.TypeFull, backup.TypeIncremental)
+	}
+}
+
+// Type implements pflag.Value.
+func (t *typeFlag) Type() string {
+	return "type"
+}
+
+// compressedSize returns the human readable compressed size of the entry, or
+// "-" if the entry is not compressed.
+func compressedSize(entry entryOutput) string {
+	if len(entry.Compression) == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%s (%s)", humanize.Bytes(entry.CompressedSize), entry.Compression)
+}
+
+// chain returns the position of the entry in its restore chain and the ID of
+// the full backup it starts from, or "broken" if the chain is broken.
+func chain(entry entryOutput) string {
+	if entry.ChainPosition < 0 {
+		return "broken"
+	}
+	return strconv.Itoa(entry.ChainPosition) + " (" + strconv.Itoa(entry.ChainBase) + ")"
+}
+
+// timeOrDash returns the time in RFC 3339, or "-" if nil.
+func timeOrDash(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// orDash returns the string, or "-" if empty.
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
 }
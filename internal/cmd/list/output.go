@@ -0,0 +1,292 @@
+package list
+
+import (
+	"sort"
+	"time"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/manager"
+)
+
+// outputVersion is the version of the JSON and YAML output schema. Fields are
+// only added within a version, never renamed or removed.
+const outputVersion = "v1"
+
+// listOutput is the schema of the JSON and YAML output of the list command.
+type listOutput struct {
+	// Version is the version of the schema.
+	Version string `json:"version" yaml:"version"`
+
+	// Filesystems are the filesystems which have a database in any bucket, in
+	// name order. Empty, but never null, if there are no databases.
+	Filesystems []filesystemOutput `json:"filesystems" yaml:"filesystems"`
+}
+
+// filesystemOutput is the databases of a filesystem.
+type filesystemOutput struct {
+	// Name is the name of the filesystem.
+	Name string `json:"name" yaml:"name"`
+
+	// Databases are the databases of the filesystem in each bucket, in
+	// endpoint then bucket order.
+	Databases []databaseOutput `json:"databases" yaml:"databases"`
+}
+
+// databaseOutput is the database of a filesystem in a bucket.
+type databaseOutput struct {
+	// Endpoint is the endpoint of the bucket.
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+
+	// Bucket is the name of the bucket.
+	Bucket string `json:"bucket" yaml:"bucket"`
+
+	// Entries are the backups in the database matching the filters, in the
+	// sort order. Empty, but never null, if there are no matching backups.
+	Entries []entryOutput `json:"entries" yaml:"entries"`
+}
+
+// entryOutput is a backup in a database.
+type entryOutput struct {
+	// ID is the ID of the backup, unique within the database.
+	ID int `json:"id" yaml:"id"`
+
+	// Parent is the ID of the backup an incremental backup was sent from. 0
+	// for full backups.
+	Parent int `json:"parent" yaml:"parent"`
+
+	// Type is the type of the backup, either "full" or "inc".
+	Type backup.Type `json:"type" yaml:"type"`
+
+	// Key is the object key of the backup in the bucket.
+	Key string `json:"key" yaml:"key"`
+
+	// Snapshot is the ZFS snapshot the backup was sent from. Empty for backups
+	// written before snapshots were recorded.
+	Snapshot string `json:"snapshot,omitempty" yaml:"snapshot,omitempty"`
+
+	// GUID is the ZFS GUID of the snapshot. 0 if not recorded.
+	GUID uint64 `json:"guid,omitempty" yaml:"guid,omitempty"`
+
+	// Timestamp is the time the backup was written, in UTC.
+	Timestamp time.Time `json:"timestamp" yaml:"timestamp"`
+
+	// AgeSeconds is the number of seconds since the backup was written.
+	AgeSeconds int64 `json:"ageSeconds" yaml:"ageSeconds"`
+
+	// Age is the time since the backup was written, in days if a whole number
+	// of days, for example "3d" or "5h20m0s".
+	Age string `json:"age" yaml:"age"`
+
+	// ChainBase is the ID of the full backup the backup's restore chain starts
+	// from. Equal to ID for full backups. 0 if the backup cannot be restored.
+	ChainBase int `json:"chainBase" yaml:"chainBase"`
+
+	// ChainPosition is the position of the backup in its restore chain. 0 for
+	// full backups, 1 for the first incremental after it, and so on. -1 if the
+	// backup cannot be restored, because it is deleted or its chain is broken.
+	// Computed from all backups in the database, so unaffected by filters.
+	ChainPosition int `json:"chainPosition" yaml:"chainPosition"`
+
+	// Size is the estimated size in bytes of the snapshot stream.
+	Size uint64 `json:"size" yaml:"size"`
+
+	// StreamSize is the size in bytes of the snapshot stream as written. 0 if
+	// not recorded.
+	StreamSize uint64 `json:"streamSize,omitempty" yaml:"streamSize,omitempty"`
+
+	// Compression is the compression algorithm of the object. Empty if not
+	// compressed.
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+
+	// CompressedSize is the size in bytes of the stream after compression. 0
+	// if not compressed.
+	CompressedSize uint64 `json:"compressedSize,omitempty" yaml:"compressedSize,omitempty"`
+
+	// ObjectSize is the size in bytes of the object as stored in the bucket,
+	// after compression and encryption. 0 if not recorded.
+	ObjectSize uint64 `json:"objectSize,omitempty" yaml:"objectSize,omitempty"`
+
+	// Encryption is the encryption scheme of the object. Empty if not
+	// encrypted.
+	Encryption string `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+
+	// SHA256 is the hex encoded SHA-256 checksum of the snapshot stream.
+	// Empty if not recorded.
+	SHA256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+
+	// Deleted is the time the backup was marked for deletion by the cadence.
+	// Omitted unless marked.
+	Deleted *time.Time `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+}
+
+// newOutput returns the output of the databases of each filesystem, with
+// ages relative to now.
+func newOutput(fsDBs map[string][]manager.ListedDB, now time.Time) listOutput {
+	out := listOutput{
+		Version:     outputVersion,
+		Filesystems: []filesystemOutput{},
+	}
+
+	for _, name := range sortedNames(fsDBs) {
+		fs := filesystemOutput{Name: name, Databases: []databaseOutput{}}
+		for _, db := range fsDBs[name] {
+			fs.Databases = append(fs.Databases, newDatabaseOutput(db, now))
+		}
+		out.Filesystems = append(out.Filesystems, fs)
+	}
+
+	return out
+}
+
+// newDatabaseOutput returns the output of the database, with ages relative to
+// now.
+func newDatabaseOutput(db manager.ListedDB, now time.Time) databaseOutput {
+	out := databaseOutput{
+		Endpoint: db.Endpoint,
+		Bucket:   db.Bucket,
+		Entries:  []entryOutput{},
+	}
+
+	for _, entry := range db.Entries {
+		chain := db.Chains[entry.ID]
+		age := now.Sub(entry.Timestamp).Truncate(time.Second)
+		out.Entries = append(out.Entries, entryOutput{
+			ID:             entry.ID,
+			Parent:         entry.Parent,
+			Type:           entry.Type,
+			Key:            entry.S3Key,
+			Snapshot:       entry.Snapshot,
+			GUID:           entry.GUID,
+			Timestamp:      entry.Timestamp.UTC(),
+			AgeSeconds:     int64(age.Seconds()),
+			Age:            backup.Duration(age).String(),
+			ChainBase:      chain.Base,
+			ChainPosition:  chain.Position,
+			Size:           entry.Size,
+			StreamSize:     entry.StreamSize,
+			Compression:    entry.Compression,
+			CompressedSize: entry.CompressedSize,
+			ObjectSize:     entry.ObjectSize,
+			Encryption:     entry.Encryption,
+			SHA256:         entry.SHA256,
+			Deleted:        entry.Deleted,
+		})
+	}
+
+	return out
+}
+
+// summaryOutput is the schema of the JSON and YAML output of the list command
+// in summary mode.
+type summaryOutput struct {
+	// Version is the version of the schema.
+	Version string `json:"version" yaml:"version"`
+
+	// Filesystems are the filesystems which have a database in any bucket, in
+	// name order. Empty, but never null, if there are no databases.
+	Filesystems []filesystemSummaryOutput `json:"filesystems" yaml:"filesystems"`
+}
+
+// filesystemSummaryOutput is the summary of the databases of a filesystem.
+type filesystemSummaryOutput struct {
+	// Name is the name of the filesystem.
+	Name string `json:"name" yaml:"name"`
+
+	// Databases are the summaries of the databases of the filesystem in each
+	// bucket, in endpoint then bucket order.
+	Databases []databaseSummaryOutput `json:"databases" yaml:"databases"`
+}
+
+// databaseSummaryOutput is the summary of the backups in a database matching
+// the filters.
+type databaseSummaryOutput struct {
+	// Endpoint is the endpoint of the bucket.
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+
+	// Bucket is the name of the bucket.
+	Bucket string `json:"bucket" yaml:"bucket"`
+
+	// Backups is the number of backups.
+	Backups int `json:"backups" yaml:"backups"`
+
+	// Full is the number of full backups.
+	Full int `json:"full" yaml:"full"`
+
+	// Incremental is the number of incremental backups.
+	Incremental int `json:"incremental" yaml:"incremental"`
+
+	// Size is the total estimated size in bytes of the snapshot streams.
+	Size uint64 `json:"size" yaml:"size"`
+
+	// StoredSize is the total size in bytes of the objects in the bucket.
+	// Backups written before the object size was recorded count their
+	// compressed size, or otherwise their stream size.
+	StoredSize uint64 `json:"storedSize" yaml:"storedSize"`
+
+	// Oldest is the time the oldest backup was written, in UTC. Omitted if
+	// there are no backups.
+	Oldest *time.Time `json:"oldest,omitempty" yaml:"oldest,omitempty"`
+
+	// Newest is the time the newest backup was written, in UTC. Omitted if
+	// there are no backups.
+	Newest *time.Time `json:"newest,omitempty" yaml:"newest,omitempty"`
+}
+
+// newSummaryOutput returns the summary of the databases of each filesystem.
+func newSummaryOutput(fsDBs map[string][]manager.ListedDB) summaryOutput {
+	out := summaryOutput{
+		Version:     outputVersion,
+		Filesystems: []filesystemSummaryOutput{},
+	}
+
+	for _, name := range sortedNames(fsDBs) {
+		fs := filesystemSummaryOutput{Name: name, Databases: []databaseSummaryOutput{}}
+		for _, db := range fsDBs[name] {
+			fs.Databases = append(fs.Databases, newDatabaseSummaryOutput(db))
+		}
+		out.Filesystems = append(out.Filesystems, fs)
+	}
+
+	return out
+}
+
+// newDatabaseSummaryOutput returns the summary of the database.
+func newDatabaseSummaryOutput(db manager.ListedDB) databaseSummaryOutput {
+	out := databaseSummaryOutput{
+		Endpoint: db.Endpoint,
+		Bucket:   db.Bucket,
+		Backups:  len(db.Entries),
+	}
+
+	for _, entry := range db.Entries {
+		switch entry.Type {
+		case backup.TypeFull:
+			out.Full++
+		case backup.TypeIncremental:
+			out.Incremental++
+		}
+
+		out.Size += entry.Size
+		out.StoredSize += entry.StoredSize()
+
+		ts := entry.Timestamp.UTC()
+		if out.Oldest == nil || ts.Before(*out.Oldest) {
+			out.Oldest = &ts
+		}
+		if out.Newest == nil || ts.After(*out.Newest) {
+			out.Newest = &ts
+		}
+	}
+
+	return out
+}
+
+// sortedNames returns the filesystem names in name order.
+func sortedNames(fsDBs map[string][]manager.ListedDB) []string {
+	names := make([]string, 0, len(fsDBs))
+	for name := range fsDBs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,96 @@
+package list
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/manager"
+)
+
+var testNow = time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+
+// testDBs returns listed databases of two filesystems, one with no entries.
+func testDBs() map[string][]manager.ListedDB {
+	return map[string][]manager.ListedDB{
+		"tank/foo": {{DB: backup.DB{Endpoint: "s3.example.com", Bucket: "bucket-a", Filesystem: "tank/foo"}}},
+		"tank/db": {{
+			DB: backup.DB{
+				Endpoint: "s3.example.com", Bucket: "bucket-a", Filesystem: "tank/db",
+				Entries: []backup.Entry{
+					{ID: 1, Type: backup.TypeFull, S3Key: "tank/db/1", Size: 100, StreamSize: 90, Timestamp: testNow.Add(-time.Hour * 48)},
+					{ID: 2, Parent: 1, Type: backup.TypeIncremental, S3Key: "tank/db/2", Size: 10, Compression: "zstd", CompressedSize: 5, Timestamp: testNow.Add(-time.Hour * 5)},
+					{ID: 3, Parent: 2, Type: backup.TypeIncremental, S3Key: "tank/db/3", Size: 20, StreamSize: 25, Encryption: "age", ObjectSize: 40, Timestamp: testNow.Add(-time.Minute - time.Millisecond)},
+				},
+			},
+			Chains: map[int]manager.ChainPosition{
+				1: {Base: 1, Position: 0},
+				2: {Base: 1, Position: 1},
+				3: {Base: 0, Position: -1},
+			},
+		}},
+	}
+}
+
+func Test_newOutput(t *testing.T) {
+	assert.Equal(t, listOutput{Version: "v1", Filesystems: []filesystemOutput{}}, newOutput(nil, testNow))
+
+	out := newOutput(testDBs(), testNow)
+	assert.Equal(t, "v1", out.Version)
+	require.Len(t, out.Filesystems, 2)
+	assert.Equal(t, "tank/db", out.Filesystems[0].Name)
+	assert.Equal(t, "tank/foo", out.Filesystems[1].Name)
+	assert.Equal(t, []entryOutput{}, out.Filesystems[1].Databases[0].Entries)
+
+	type chainAge struct {
+		base, position int
+		age            string
+		ageSeconds     int64
+	}
+	var got []chainAge
+	for _, entry := range out.Filesystems[0].Databases[0].Entries {
+		got = append(got, chainAge{entry.ChainBase, entry.ChainPosition, entry.Age, entry.AgeSeconds})
+	}
+	assert.Equal(t, []chainAge{
+		{base: 1, position: 0, age: "2d", ageSeconds: 172800},
+		{base: 1, position: 1, age: "5h0m0s", ageSeconds: 18000},
+		{base: 0, position: -1, age: "1m0s", ageSeconds: 60},
+	}, got)
+}
+
+func Test_newSummaryOutput(t *testing.T) {
+	oldest, newest := testNow.Add(-time.Hour*48), testNow.Add(-time.Minute-time.Millisecond)
+	assert.Equal(t, summaryOutput{
+		Version: "v1",
+		Filesystems: []filesystemSummaryOutput{
+			{Name: "tank/db", Databases: []databaseSummaryOutput{{
+				Endpoint: "s3.example.com", Bucket: "bucket-a",
+				Backups: 3, Full: 1, Incremental: 2, Size: 130, StoredSize: 135,
+				Oldest: &oldest, Newest: &newest,
+			}}},
+			{Name: "tank/foo", Databases: []databaseSummaryOutput{{
+				Endpoint: "s3.example.com", Bucket: "bucket-a",
+			}}},
+		},
+	}, newSummaryOutput(testDBs()))
+}
+
+func Test_parseTime(t *testing.T) {
+	got, err := parseTime("", testNow)
+	require.NoError(t, err)
+	assert.True(t, got.IsZero())
+
+	got, err = parseTime("2020-04-01T12:00:00Z", testNow)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC), got)
+
+	got, err = parseTime("7d", testNow)
+	require.NoError(t, err)
+	assert.Equal(t, testNow.Add(-time.Hour*24*7), got)
+
+	_, err = parseTime("yesterday", testNow)
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/cmd/util/table"
+	"github.com/joshvanl/yazbu/internal/manager"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// prune is the prune command.
+type prune struct {
+	util.IO
+
+	// options is the command options.
+	options *options.Options
+
+	// prune is the options for pruning.
+	prune manager.PruneOptions
+}
+
+// New constructs a new prune command.
+func New(ctx context.Context, io util.IO) *cobra.Command {
+	p := prune{IO: io}
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete backups from the buckets according to the cadence.",
+		Long:  "Loads the database of each filesystem in each bucket, runs the configured cadence, deletes the backup objects which should no longer be kept and rewrites the database, without writing a new backup. Backups left over from an interrupted prune are also deleted. Pruning also happens automatically after each backup is written, but not when a backup fails. Use with --force to prune with a changed cadence.",
+		Example: `  yazbu prune --dry-run
+  yazbu prune
+  yazbu prune --filesystem tank/data --bucket my-bucket`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pruned, err := p.options.Manager.Prune(ctx, p.prune)
+
+			tbl := table.NewBuilder([]string{"dataset", "endpoint", "bucket", "id", "type", "timestamp", "size"})
+			for _, b := range pruned {
+				tbl.AddRow(b.Filesystem, b.Endpoint, b.Bucket, b.Entry.ID, b.Entry.Type,
+					b.Entry.Timestamp.Format(time.RFC3339), humanize.Bytes(b.Entry.Size))
+			}
+			if berr := tbl.Build(io.Out); berr != nil {
+				return berr
+			}
+
+			if err != nil {
+				fmt.Fprintf(io.Err, "%s\n", err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&p.prune.Filesystem, "filesystem", "", "Only prune backups of this filesystem.")
+	cmd.Flags().StringVar(&p.prune.Bucket, "bucket", "", "Only prune backups in the bucket with this name.")
+	cmd.Flags().BoolVar(&p.prune.DryRun, "dry-run", false, "List the backups which would be deleted, without deleting them.")
+
+	p.options = options.New(ctx, io, cmd)
+
+	return cmd
+}
@@ -0,0 +1,57 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/manager"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// restore is the restore command.
+type restore struct {
+	util.IO
+
+	// options is the command options.
+	options *options.Options
+
+	// restore is the options for the restore.
+	restore manager.RestoreOptions
+}
+
+// New constructs a new restore command.
+func New(ctx context.Context, io util.IO) *cobra.Command {
+	r := restore{IO: io}
+
+	cmd := &cobra.Command{
+		Use:   "restore <filesystem>",
+		Short: "Restore a backup of a filesystem into a ZFS dataset or file.",
+		Long:  "Restore a backup of a filesystem. The full backup, and the chain of incremental backups required to restore the backup, are downloaded in order and received into the target ZFS dataset, or written to a file.",
+		Example: `  yazbu restore tank/data --to tank/restored
+  yazbu restore tank/data --to tank/restored --id 12 --bucket my-bucket
+  yazbu restore tank/data --file /tmp/data.zfs`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r.restore.Filesystem = args[0]
+			if err := r.options.Manager.Restore(ctx, r.restore); err != nil {
+				fmt.Fprintf(io.Err, "%s\n", err)
+				os.Exit(1)
+			}
+			r.options.Log.Info("restore complete.")
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&r.restore.Dataset, "to", "", "ZFS dataset to receive the backup into.")
+	cmd.Flags().StringVar(&r.restore.File, "file", "", "File to write the backup streams into instead of a ZFS dataset. Streams of the backup chain are concatenated in order.")
+	cmd.Flags().IntVar(&r.restore.ID, "id", 0, "ID of the backup entry to restore. Defaults to the latest backup.")
+	cmd.Flags().StringVar(&r.restore.Bucket, "bucket", "", "Name of the bucket to restore from. Defaults to the first bucket containing a valid backup chain.")
+
+	r.options = options.New(ctx, io, cmd)
+
+	return cmd
+}
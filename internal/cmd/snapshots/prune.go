@@ -0,0 +1,65 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/cmd/util/table"
+	"github.com/joshvanl/yazbu/internal/manager"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// prune is the snapshots prune command.
+type prune struct {
+	util.IO
+
+	// options is the command options.
+	options *options.Options
+
+	// dryRun indicates that snapshots should only be listed, not destroyed.
+	dryRun bool
+}
+
+// newPrune constructs a new snapshots prune command.
+func newPrune(ctx context.Context, io util.IO) *cobra.Command {
+	p := prune{IO: io}
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Destroy local snapshots and bookmarks which are no longer needed.",
+		Long:  "Destroys the local ZFS snapshots created by yazbu which have been backed up to every bucket. Incremental backups are sent from bookmarks, so snapshots which are the incremental base of a bucket are only kept if they have no bookmark. Bookmarks which are not the incremental base of any bucket are destroyed. The most recent snapshots.retain snapshots of each filesystem are kept. Snapshots and bookmarks not created by yazbu are never destroyed. Pruning also happens automatically after each successful backup.",
+		Example: `  yazbu snapshots prune --dry-run
+  yazbu snapshots prune`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pruned, err := p.options.Manager.PruneSnapshots(ctx, manager.PruneSnapshotsOptions{
+				DryRun: p.dryRun,
+			})
+
+			tbl := table.NewBuilder([]string{"dataset", "snapshot"})
+			for _, s := range pruned {
+				tbl.AddRow(s.Filesystem, s.Snapshot)
+			}
+			if berr := tbl.Build(io.Out); berr != nil {
+				return berr
+			}
+
+			if err != nil {
+				fmt.Fprintf(io.Err, "%s\n", err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&p.dryRun, "dry-run", false,
+		"List the snapshots which would be destroyed, without destroying them.")
+
+	p.options = options.New(ctx, io, cmd)
+
+	return cmd
+}
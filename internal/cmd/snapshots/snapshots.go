@@ -0,0 +1,21 @@
+package snapshots
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// New returns a new snapshots command.
+func New(ctx context.Context, io util.IO) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshots",
+		Short: "Manage the local ZFS snapshots and bookmarks created by yazbu.",
+	}
+
+	cmd.AddCommand(newPrune(ctx, io))
+
+	return cmd
+}
@@ -0,0 +1,136 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/cmd/util/output"
+	"github.com/joshvanl/yazbu/internal/cmd/util/table"
+	"github.com/joshvanl/yazbu/internal/manager"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// outputVersion is the version of the JSON and YAML output schema. Fields are
+// only added within a version, never renamed or removed.
+const outputVersion = "v1"
+
+// statusOutput is the schema of the JSON and YAML output of the status
+// command.
+type statusOutput struct {
+	// Version is the version of the schema.
+	Version string `json:"version" yaml:"version"`
+
+	// Filesystems is the status of each filesystem, in configured order.
+	Filesystems []manager.FilesystemStatus `json:"filesystems" yaml:"filesystems"`
+}
+
+// status is the status command.
+type status struct {
+	util.IO
+
+	// options is the command options.
+	options *options.Options
+
+	// status is the options for the consistency check.
+	status manager.StatusOptions
+
+	// output is the output format of the statuses.
+	output output.Format
+}
+
+// New constructs a new status command.
+func New(ctx context.Context, io util.IO) *cobra.Command {
+	s := status{IO: io}
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Check the databases of each filesystem are consistent across buckets.",
+		Long:  "Status compares the database of each filesystem in every bucket it is backed up to, and reports backups missing from a bucket, backups whose snapshots diverge, cadence mismatches, and size or checksum disagreements. Backups are matched across buckets by their snapshot. Redundancy is the number of buckets holding a consistent, restorable copy of the latest backup. Exits non-zero if the redundancy of any filesystem is below the configured minRedundancy.",
+		Example: `  yazbu status
+  yazbu status --filesystem tank/data -o json`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			statuses, err := s.options.Manager.Status(ctx, s.status)
+			if err != nil {
+				fmt.Fprintf(io.Err, "%s\n", err)
+				os.Exit(1)
+			}
+
+			if err := s.print(statuses); err != nil {
+				return err
+			}
+
+			var degraded bool
+			for _, st := range statuses {
+				if st.Degraded() {
+					degraded = true
+					fmt.Fprintf(io.Err, "filesystem %q has redundancy %d, below the minimum %d\n", st.Filesystem, st.Redundancy, st.MinRedundancy)
+				}
+			}
+			if degraded {
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&s.status.Filesystem, "filesystem", "", "Only check the databases of this filesystem.")
+	output.AddFlag(cmd, &s.output, output.FormatTable, output.FormatJSON, output.FormatYAML)
+
+	s.options = options.New(ctx, io, cmd)
+
+	return cmd
+}
+
+// print writes the statuses in the output format. The table of issues is only
+// written if there are any.
+func (s *status) print(statuses []manager.FilesystemStatus) error {
+	if s.output != output.FormatTable {
+		if statuses == nil {
+			statuses = []manager.FilesystemStatus{}
+		}
+		return output.Encode(s.Out, s.output, statusOutput{Version: outputVersion, Filesystems: statuses})
+	}
+
+	tbl := table.NewBuilder([]string{"dataset", "buckets", "latest", "redundancy", "min", "issues", "status"})
+	var issues int
+	for _, st := range statuses {
+		state := "ok"
+		if st.Degraded() {
+			state = "degraded"
+		}
+		latest := "-"
+		if len(st.Latest) > 0 {
+			latest = st.Latest
+		}
+		tbl.AddRow(st.Filesystem, st.Buckets, latest, st.Redundancy, st.MinRedundancy, len(st.Issues), state)
+		issues += len(st.Issues)
+	}
+	if err := tbl.Build(s.Out); err != nil {
+		return err
+	}
+
+	if issues == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(s.Out)
+	tbl = table.NewBuilder([]string{"dataset", "endpoint", "bucket", "id", "snapshot", "issue", "message"})
+	for _, st := range statuses {
+		for _, issue := range st.Issues {
+			id, snapshot := "-", "-"
+			if issue.ID > 0 {
+				id = fmt.Sprint(issue.ID)
+			}
+			if len(issue.Snapshot) > 0 {
+				snapshot = issue.Snapshot
+			}
+			tbl.AddRow(st.Filesystem, issue.Endpoint, issue.Bucket, id, snapshot, issue.Kind, issue.Message)
+		}
+	}
+	return tbl.Build(s.Out)
+}
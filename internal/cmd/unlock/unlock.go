@@ -0,0 +1,63 @@
+package unlock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/cmd/util/table"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// unlock is the unlock command.
+type unlock struct {
+	util.IO
+
+	// options is the command options.
+	options *options.Options
+
+	// breakUnexpired breaks leases which have not yet expired.
+	breakUnexpired bool
+}
+
+// New constructs a new unlock command.
+func New(ctx context.Context, io util.IO) *cobra.Command {
+	u := unlock{IO: io}
+
+	cmd := &cobra.Command{
+		Use:   "unlock",
+		Short: "Break stale leases held on filesystems in buckets.",
+		Long:  "yazbu holds a lease on each filesystem in each bucket whilst performing a backup or prune, preventing concurrent runs. Leases are renewed whilst held and released on completion, but may be left behind if yazbu is killed. Unlock breaks expired leases, or all leases with --break-unexpired.",
+		Example: `  yazbu unlock
+  yazbu unlock --break-unexpired`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			broken, err := u.options.Manager.Unlock(ctx, u.breakUnexpired)
+
+			tbl := table.NewBuilder([]string{"dataset", "endpoint", "bucket", "host", "pid", "started", "expires"})
+			for _, b := range broken {
+				tbl.AddRow(b.Filesystem, b.Endpoint, b.Bucket, b.Lease.Host, b.Lease.PID,
+					b.Lease.Started.UTC().Format(time.RFC3339), b.Lease.Expires.UTC().Format(time.RFC3339))
+			}
+			if berr := tbl.Build(io.Out); berr != nil {
+				return berr
+			}
+
+			if err != nil {
+				fmt.Fprintf(io.Err, "%s\n", err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&u.breakUnexpired, "break-unexpired", false, "Break leases which have not yet expired. WARNING: only do this if you are sure no other yazbu run is in progress.")
+
+	u.options = options.New(ctx, io, cmd)
+
+	return cmd
+}
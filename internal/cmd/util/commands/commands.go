@@ -6,8 +6,16 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/joshvanl/yazbu/internal/cmd/backup"
+	"github.com/joshvanl/yazbu/internal/cmd/cadence"
 	"github.com/joshvanl/yazbu/internal/cmd/config"
+	"github.com/joshvanl/yazbu/internal/cmd/daemon"
 	"github.com/joshvanl/yazbu/internal/cmd/list"
+	"github.com/joshvanl/yazbu/internal/cmd/prune"
+	"github.com/joshvanl/yazbu/internal/cmd/restore"
+	"github.com/joshvanl/yazbu/internal/cmd/snapshots"
+	"github.com/joshvanl/yazbu/internal/cmd/status"
+	"github.com/joshvanl/yazbu/internal/cmd/unlock"
+	"github.com/joshvanl/yazbu/internal/cmd/verify"
 	"github.com/joshvanl/yazbu/internal/util"
 )
 
@@ -17,6 +25,14 @@ func Commands() []func(context.Context, util.IO) *cobra.Command {
 	return []func(context.Context, util.IO) *cobra.Command{
 		backup.New,
 		list.New,
+		restore.New,
+		unlock.New,
+		verify.New,
+		prune.New,
+		snapshots.New,
+		cadence.New,
 		config.New,
+		daemon.New,
+		status.New,
 	}
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/joshvanl/yazbu/config"
 	"github.com/joshvanl/yazbu/internal/manager"
+	"github.com/joshvanl/yazbu/internal/metrics"
 	"github.com/joshvanl/yazbu/internal/util"
 )
 
@@ -28,19 +29,46 @@ type Options struct {
 	Config *config.Config
 
 	// Manager is the configured manager which are used to perform operations.
+	// Nil if the Options were constructed with NewConfig.
 	Manager *manager.Manager
 
+	// Metrics are the metrics recorded by the Manager. Nil if the Options were
+	// constructed with NewConfig.
+	Metrics *metrics.Metrics
+
+	// metricsTextfile is the path the metrics are written to, if set.
+	metricsTextfile string
+
 	// force indicates that the cadence should be overriden
 	force bool
+
+	// configOnly indicates that only the config is read, and the Manager is
+	// not constructed.
+	configOnly bool
 }
 
 // New constructs a new shared Options.
 func New(ctx context.Context, io util.IO, cmd *cobra.Command) *Options {
-	o := new(Options)
-
-	cmd.PersistentFlags().StringVarP(&o.configPath, "config", "c", "~/.config/yazbu/config.yaml", "File path location to the yaml config.")
+	o := newOptions(io, cmd, false)
 	cmd.PersistentFlags().BoolVar(&o.force, "force", false,
 		"If the local Cadence is different from the remote discovered one then it will be overridden. WARNING: doing so is incredibly dangerous since you may end up deleting old backups you want. Make sure you know what you are doing before you do this.")
+	cmd.PersistentFlags().StringVar(&o.metricsTextfile, "metrics-textfile", "",
+		"Write Prometheus metrics of the run to this file, for the node exporter textfile collector. The file is rewritten as each operation completes, keeping the metrics of previous runs.")
+	return o
+}
+
+// NewConfig constructs a new shared Options which only reads the config, for
+// commands which don't need to connect to buckets.
+func NewConfig(ctx context.Context, io util.IO, cmd *cobra.Command) *Options {
+	return newOptions(io, cmd, true)
+}
+
+// newOptions constructs a new shared Options, populated before the command is
+// run.
+func newOptions(io util.IO, cmd *cobra.Command, configOnly bool) *Options {
+	o := &Options{configOnly: configOnly}
+
+	cmd.PersistentFlags().StringVarP(&o.configPath, "config", "c", "~/.config/yazbu/config.yaml", "File path location to the yaml config.")
 
 	// Setup a PreRun to populate the Factory. Catch the existing PreRun command
 	// if one was defined, and execute it second.
@@ -85,7 +113,12 @@ func (o *Options) complete(io util.IO, cmd *cobra.Command) error {
 		return err
 	}
 
-	o.Manager, err = manager.New(o.Log, io, *o.Config, o.force)
+	if o.configOnly {
+		return nil
+	}
+
+	o.Metrics = metrics.New(metrics.Options{Log: o.Log, Textfile: o.metricsTextfile})
+	o.Manager, err = manager.New(o.Log, io, *o.Config, o.force, o.Metrics)
 	if err != nil {
 		return err
 	}
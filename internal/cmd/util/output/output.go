@@ -0,0 +1,95 @@
+// Package output provides the --output flag of read commands, and encodes
+// their results as JSON or YAML.
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is an output format of a read command.
+type Format string
+
+const (
+	// FormatTable is a human readable table.
+	FormatTable Format = "table"
+
+	// FormatWide is a human readable table with additional columns.
+	FormatWide Format = "wide"
+
+	// FormatJSON is indented JSON.
+	FormatJSON Format = "json"
+
+	// FormatYAML is YAML.
+	FormatYAML Format = "yaml"
+)
+
+// AddFlag adds the --output, -o flag to the command, which sets the format to
+// one of the given formats. The format defaults to the first format.
+func AddFlag(cmd *cobra.Command, format *Format, formats ...Format) {
+	*format = formats[0]
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = string(f)
+	}
+	cmd.Flags().VarP(&flag{format: format, formats: formats}, "output", "o",
+		fmt.Sprintf("Output format. One of [%s].", strings.Join(names, " ")))
+}
+
+// Encode writes the value in the JSON or YAML format. Errors if the format is
+// not JSON or YAML.
+func Encode(w io.Writer, format Format, v interface{}) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+
+	default:
+		return fmt.Errorf("format %q cannot be encoded", format)
+	}
+}
+
+// flag is a pflag.Value which only accepts the given formats.
+type flag struct {
+	format  *Format
+	formats []Format
+}
+
+// String implements pflag.Value.
+func (f *flag) String() string {
+	return string(*f.format)
+}
+
+// Set implements pflag.Value.
+func (f *flag) Set(s string) error {
+	for _, format := range f.formats {
+		if Format(s) == format {
+			*f.format = format
+			return nil
+		}
+	}
+	names := make([]string, len(f.formats))
+	for i, format := range f.formats {
+		names[i] = string(format)
+	}
+	return fmt.Errorf("unsupported output format %q, must be one of [%s]", s, strings.Join(names, " "))
+}
+
+// Type implements pflag.Value.
+func (f *flag) Type() string {
+	return "format"
+}
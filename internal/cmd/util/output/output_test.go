@@ -0,0 +1,39 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_AddFlag(t *testing.T) {
+	var format Format
+	cmd := &cobra.Command{Use: "test"}
+	AddFlag(cmd, &format, FormatTable, FormatJSON)
+	assert.Equal(t, FormatTable, format)
+
+	require.NoError(t, cmd.Flags().Set("output", "json"))
+	assert.Equal(t, FormatJSON, format)
+	assert.Error(t, cmd.Flags().Set("output", "yaml"), "format should not be accepted")
+	assert.Equal(t, FormatJSON, format)
+}
+
+func Test_Encode(t *testing.T) {
+	v := struct {
+		Name  string   `json:"name" yaml:"name"`
+		Items []string `json:"items" yaml:"items"`
+	}{Name: "foo", Items: []string{}}
+
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, FormatJSON, v))
+	assert.Equal(t, "{\n  \"name\": \"foo\",\n  \"items\": []\n}\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, Encode(&buf, FormatYAML, v))
+	assert.Equal(t, "name: foo\nitems: []\n", buf.String())
+
+	assert.Error(t, Encode(&buf, FormatTable, v))
+}
@@ -0,0 +1,95 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshvanl/yazbu/internal/cmd/util/options"
+	"github.com/joshvanl/yazbu/internal/cmd/util/output"
+	"github.com/joshvanl/yazbu/internal/cmd/util/table"
+	"github.com/joshvanl/yazbu/internal/manager"
+	"github.com/joshvanl/yazbu/internal/util"
+)
+
+// verify is the verify command.
+type verify struct {
+	util.IO
+
+	// options is the command options.
+	options *options.Options
+
+	// verify is the options for the verification.
+	verify manager.VerifyOptions
+
+	// output is the output format of the results.
+	output output.Format
+}
+
+// New constructs a new verify command.
+func New(ctx context.Context, io util.IO) *cobra.Command {
+	v := verify{IO: io}
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Download backups and verify them against their recorded checksums.",
+		Long:  "Verify downloads backup objects referenced by each database, decrypts and decompresses them, and checks the resulting stream against the SHA-256 checksum and size recorded when the backup was written. Optionally, each stream is also parsed with zstream dump to confirm it is a valid zfs send stream. Exits non-zero if any backup fails verification.",
+		Example: `  yazbu verify
+  yazbu verify --all --validate-stream
+  yazbu verify --filesystem tank/data --bucket my-bucket --sample 3 -o json`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			results, err := v.options.Manager.Verify(ctx, v.verify)
+
+			if berr := v.print(results); berr != nil {
+				return berr
+			}
+
+			if err == nil {
+				for _, result := range results {
+					if result.Status == manager.VerifyFail {
+						err = errors.New("one or more backups failed verification")
+						break
+					}
+				}
+			}
+
+			if err != nil {
+				fmt.Fprintf(io.Err, "%s\n", err)
+				os.Exit(1)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&v.verify.Filesystem, "filesystem", "", "Only verify backups of this filesystem.")
+	cmd.Flags().StringVar(&v.verify.Bucket, "bucket", "", "Only verify backups in the bucket with this name.")
+	cmd.Flags().IntVar(&v.verify.Sample, "sample", 1, "Number of randomly chosen backups to verify for each filesystem in each bucket.")
+	cmd.Flags().BoolVar(&v.verify.All, "all", false, "Verify all backups.")
+	cmd.Flags().BoolVar(&v.verify.ValidateStream, "validate-stream", false, "Also check each backup is a valid zfs send stream using zstream dump.")
+	output.AddFlag(cmd, &v.output, output.FormatTable, output.FormatJSON)
+	cmd.MarkFlagsMutuallyExclusive("sample", "all")
+
+	v.options = options.New(ctx, io, cmd)
+
+	return cmd
+}
+
+// print writes the verify results in the output format.
+func (v *verify) print(results []manager.VerifyResult) error {
+	if v.output == output.FormatJSON {
+		if results == nil {
+			results = []manager.VerifyResult{}
+		}
+		return output.Encode(v.Out, v.output, results)
+	}
+
+	tbl := table.NewBuilder([]string{"dataset", "bucket", "id", "type", "path", "status", "error"})
+	for _, r := range results {
+		tbl.AddRow(r.Filesystem, r.Bucket, r.Entry.ID, r.Entry.Type, r.Entry.S3Key, r.Status, r.Error)
+	}
+	return tbl.Build(v.Out)
+}
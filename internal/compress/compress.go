@@ -0,0 +1,156 @@
+// Package compress provides streaming compression and decompression of backup
+// streams.
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Algorithm is a compression algorithm.
+type Algorithm string
+
+const (
+	// None performs no compression.
+	None Algorithm = "none"
+
+	// Gzip compresses using gzip.
+	Gzip Algorithm = "gzip"
+
+	// Zstd compresses using zstandard.
+	Zstd Algorithm = "zstd"
+
+	// LZ4 compresses using lz4 frames.
+	LZ4 Algorithm = "lz4"
+)
+
+// Algorithms is the set of supported compression algorithms.
+var Algorithms = []Algorithm{None, Gzip, Zstd, LZ4}
+
+// Valid returns an error if the algorithm is not supported, or the level is
+// out of range for the algorithm. A level of 0 uses the algorithm's default.
+func Valid(alg Algorithm, level int) error {
+	var max int
+	switch alg {
+	case "", None:
+		if level != 0 {
+			return fmt.Errorf("compression level cannot be set when not compressing")
+		}
+		return nil
+	case Gzip:
+		max = gzip.BestCompression
+	case Zstd:
+		max = 22
+	case LZ4:
+		max = 9
+	default:
+		return fmt.Errorf("unsupported compression algorithm %q, must be one of %v", alg, Algorithms)
+	}
+
+	if level < 0 || level > max {
+		return fmt.Errorf("compression level for %q must be between 0 and %d", alg, max)
+	}
+
+	return nil
+}
+
+// Ext returns the file extension used for objects compressed with the
+// algorithm. Returns an empty string for no compression.
+func (a Algorithm) Ext() string {
+	switch a {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	case LZ4:
+		return ".lz4"
+	default:
+		return ""
+	}
+}
+
+// NewReader returns a reader which compresses the given stream using the
+// algorithm and level. Compression is performed in a separate goroutine as
+// the returned reader is read from. Closing the returned reader stops
+// compression.
+func NewReader(r io.Reader, alg Algorithm, level int) (io.ReadCloser, error) {
+	if alg == "" || alg == None {
+		return io.NopCloser(r), nil
+	}
+
+	pr, pw := io.Pipe()
+	w, err := newWriter(pw, alg, level)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	return pr, nil
+}
+
+// NewDecompressReader returns a reader which decompresses the given stream
+// compressed with the algorithm.
+func NewDecompressReader(r io.Reader, alg Algorithm) (io.ReadCloser, error) {
+	switch alg {
+	case "", None:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case LZ4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", alg)
+	}
+}
+
+// newWriter returns a writer which compresses to w using the algorithm and
+// level.
+func newWriter(w io.Writer, alg Algorithm, level int) (io.WriteCloser, error) {
+	if err := Valid(alg, level); err != nil {
+		return nil, err
+	}
+
+	switch alg {
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+
+	case Zstd:
+		opts := []zstd.EOption{}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+
+	case LZ4:
+		lw := lz4.NewWriter(w)
+		if level > 0 {
+			if err := lw.Apply(lz4.CompressionLevelOption(lz4.CompressionLevel(1 << (8 + level)))); err != nil {
+				return nil, err
+			}
+		}
+		return lw, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", alg)
+	}
+}
@@ -0,0 +1,66 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RoundTrip(t *testing.T) {
+	data := make([]byte, 1<<20)
+	_, err := rand.Read(data[:1<<19])
+	require.NoError(t, err)
+
+	for _, alg := range Algorithms {
+		for _, level := range []int{0, 1} {
+			if alg == None && level != 0 {
+				continue
+			}
+
+			t.Run(string(alg), func(t *testing.T) {
+				cr, err := NewReader(bytes.NewReader(data), alg, level)
+				require.NoError(t, err)
+				compressed, err := io.ReadAll(cr)
+				require.NoError(t, err)
+
+				if alg != None {
+					assert.Less(t, len(compressed), len(data))
+				}
+
+				dr, err := NewDecompressReader(bytes.NewReader(compressed), alg)
+				require.NoError(t, err)
+				got, err := io.ReadAll(dr)
+				require.NoError(t, err)
+				assert.Equal(t, data, got)
+			})
+		}
+	}
+}
+
+func Test_Valid(t *testing.T) {
+	tests := map[string]struct {
+		alg    Algorithm
+		level  int
+		expErr bool
+	}{
+		"if empty algorithm, expect no error":    {alg: "", level: 0, expErr: false},
+		"if none with a level, expect error":     {alg: None, level: 1, expErr: true},
+		"if gzip default level, expect no error": {alg: Gzip, level: 0, expErr: false},
+		"if gzip over max level, expect error":   {alg: Gzip, level: 10, expErr: true},
+		"if zstd max level, expect no error":     {alg: Zstd, level: 22, expErr: false},
+		"if zstd over max level, expect error":   {alg: Zstd, level: 23, expErr: true},
+		"if lz4 negative level, expect error":    {alg: LZ4, level: -1, expErr: true},
+		"if unknown algorithm, expect error":     {alg: "brotli", level: 0, expErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := Valid(test.alg, test.level)
+			assert.Equal(t, test.expErr, err != nil, "%v", err)
+		})
+	}
+}
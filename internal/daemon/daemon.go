@@ -0,0 +1,364 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/utils/clock"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/manager"
+	"github.com/joshvanl/yazbu/internal/schedule"
+)
+
+const (
+	// tickInterval is the interval the daemon checks for due jobs. Cron
+	// expressions have a resolution of a minute.
+	tickInterval = time.Minute
+
+	// maxRetryBackoff is the maximum time to wait before retrying a failed
+	// job. The wait doubles from tickInterval with each consecutive failure.
+	maxRetryBackoff = time.Hour
+)
+
+// Job is a job which the daemon runs for a filesystem.
+type Job string
+
+const (
+	// JobFull writes a full backup.
+	JobFull Job = "full"
+
+	// JobIncremental writes an incremental backup, falling back to a full
+	// backup if needed.
+	JobIncremental Job = "incremental"
+
+	// JobPrune deletes backups according to the cadence.
+	JobPrune Job = "prune"
+
+	// JobVerify verifies a randomly chosen backup in each bucket.
+	JobVerify Job = "verify"
+)
+
+// jobs is the order in which the due jobs of a filesystem are run.
+var jobs = []Job{JobFull, JobIncremental, JobPrune, JobVerify}
+
+// Manager performs the jobs. Implemented by manager.Manager.
+type Manager interface {
+	Backup(context.Context, manager.BackupOptions) error
+	Prune(context.Context, manager.PruneOptions) ([]manager.PrunedBackup, error)
+	Verify(context.Context, manager.VerifyOptions) ([]manager.VerifyResult, error)
+}
+
+// Options are the options for constructing a Daemon.
+type Options struct {
+	// Log is the logger of the Daemon.
+	Log logr.Logger
+
+	// Manager performs the jobs.
+	Manager Manager
+
+	// Config is the config of the schedule of each filesystem. Assumes the
+	// config has been validated.
+	Config config.Config
+
+	// Clock is the clock used to schedule jobs. If nil, the real clock is
+	// used.
+	Clock clock.WithTicker
+}
+
+// Daemon runs the scheduled jobs of each filesystem. Jobs of the same
+// filesystem never run concurrently, whilst jobs of different filesystems do.
+type Daemon struct {
+	log     logr.Logger
+	manager Manager
+	clock   clock.WithTicker
+
+	// filesystems is the configured order of the filesystems.
+	filesystems []string
+
+	// schedules is the schedule of each job, indexed by filesystem.
+	schedules map[string]map[Job]schedule.Schedule
+
+	// stateFile is the path to the file recording the last run of each job.
+	stateFile string
+
+	lock sync.Mutex
+
+	// state is the time each job last ran.
+	state state
+
+	// queued are the jobs which are queued or running, indexed by filesystem.
+	queued map[string]map[Job]bool
+
+	// retries are the jobs which failed on their last run, indexed by
+	// filesystem.
+	retries map[string]map[Job]retry
+}
+
+// retry is a failed job waiting to be retried.
+type retry struct {
+	// failures is the number of consecutive times the job has failed.
+	failures int
+
+	// after is the time after which the job is retried.
+	after time.Time
+}
+
+// run is a due job.
+type run struct {
+	job Job
+
+	// due is the time the job was found to be due.
+	due time.Time
+}
+
+// New constructs a new Daemon from the schedule config. Errors if no jobs are
+// scheduled.
+func New(opts Options) (*Daemon, error) {
+	d := &Daemon{
+		log:       opts.Log.WithName("daemon"),
+		manager:   opts.Manager,
+		clock:     opts.Clock,
+		stateFile: opts.Config.Schedule.StateFile,
+		schedules: make(map[string]map[Job]schedule.Schedule),
+		queued:    make(map[string]map[Job]bool),
+		retries:   make(map[string]map[Job]retry),
+	}
+	if d.clock == nil {
+		d.clock = clock.RealClock{}
+	}
+	if len(d.stateFile) == 0 {
+		d.stateFile = config.DefaultScheduleStateFile
+	}
+
+	var scheduled bool
+	for _, fs := range opts.Config.Filesystems {
+		sched := opts.Config.Schedule.Merge(fs.Schedule)
+		specs := map[Job]string{
+			JobFull:        sched.Full,
+			JobIncremental: sched.Incremental,
+			JobPrune:       sched.Prune,
+			JobVerify:      sched.Verify,
+		}
+
+		d.filesystems = append(d.filesystems, fs.Name)
+		d.schedules[fs.Name] = make(map[Job]schedule.Schedule)
+		d.queued[fs.Name] = make(map[Job]bool)
+		d.retries[fs.Name] = make(map[Job]retry)
+		for job, spec := range specs {
+			if len(spec) == 0 {
+				continue
+			}
+			s, err := schedule.Parse(spec)
+			if err != nil {
+				return nil, fmt.Errorf("filesystem %q: %s: %w", fs.Name, job, err)
+			}
+			d.schedules[fs.Name][job] = s
+			scheduled = true
+		}
+	}
+
+	if !scheduled {
+		return nil, errors.New("no jobs are scheduled, configure the schedule to run the daemon")
+	}
+
+	return d, nil
+}
+
+// Run runs the scheduled jobs until the context is cancelled. Jobs which were
+// due whilst the daemon was not running, or the host was asleep, are run
+// once on start or wake. Jobs which have never run are due immediately. Failed
+// jobs are retried with an exponential backoff until they succeed. Once
+// the context is cancelled, no more jobs are started and Run returns after the
+// running jobs have exited.
+func (d *Daemon) Run(ctx context.Context) error {
+	st, err := readState(d.stateFile)
+	if err != nil {
+		return err
+	}
+	d.state = st
+
+	d.log.Info("starting daemon", "filesystems", d.filesystems, "state_file", d.stateFile)
+
+	var wg sync.WaitGroup
+	queues := make(map[string]chan run, len(d.filesystems))
+	for _, fs := range d.filesystems {
+		// Each job is queued at most once, so the queue never blocks.
+		queue := make(chan run, len(jobs))
+		queues[fs] = queue
+		wg.Add(1)
+		go func(fs string) {
+			defer wg.Done()
+			d.worker(ctx, fs, queue)
+		}(fs)
+	}
+
+	ticker := d.clock.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		d.enqueueDue(queues)
+
+		select {
+		case <-ctx.Done():
+			d.log.Info("shutting down, waiting for running jobs to exit")
+			wg.Wait()
+			d.log.Info("daemon stopped")
+			return nil
+		case <-ticker.C():
+		}
+	}
+}
+
+// enqueueDue queues the due jobs of every filesystem which are not already
+// queued or running.
+func (d *Daemon) enqueueDue(queues map[string]chan run) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.clock.Now()
+	for _, fs := range d.filesystems {
+		for _, job := range jobs {
+			sched, ok := d.schedules[fs][job]
+			if !ok || d.queued[fs][job] {
+				continue
+			}
+
+			// A full backup supersedes an incremental backup.
+			if job == JobIncremental && d.queued[fs][JobFull] {
+				continue
+			}
+
+			if last := d.state.last(fs, job); !last.IsZero() && sched.Next(last).After(now) {
+				continue
+			}
+
+			if retry, ok := d.retries[fs][job]; ok && retry.after.After(now) {
+				continue
+			}
+
+			d.log.Info("queueing job", "filesystem", fs, "job", job)
+			d.queued[fs][job] = true
+			queues[fs] <- run{job: job, due: now}
+		}
+	}
+}
+
+// worker runs the queued jobs of the filesystem in order, until the context
+// is cancelled.
+func (d *Daemon) worker(ctx context.Context, fs string, queue <-chan run) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-queue:
+			// Don't start jobs once shutting down.
+			if ctx.Err() != nil {
+				return
+			}
+
+			log := d.log.WithValues("filesystem", fs, "job", r.job)
+			log.Info("running job")
+			start := d.clock.Now()
+			err := d.runJob(ctx, fs, r.job)
+
+			// Jobs interrupted by shutdown are not recorded, so are caught up
+			// on the next start.
+			if ctx.Err() != nil {
+				log.Info("job interrupted by shutdown")
+				return
+			}
+
+			if err != nil {
+				log.Error(err, "job failed")
+			} else {
+				log.Info("job complete", "duration", d.clock.Since(start))
+			}
+
+			d.complete(fs, r, err)
+		}
+	}
+}
+
+// runJob runs the job of the filesystem.
+func (d *Daemon) runJob(ctx context.Context, fs string, job Job) error {
+	switch job {
+	case JobFull, JobIncremental:
+		mode := manager.ModeFull
+		if job == JobIncremental {
+			mode = manager.ModeAuto
+		}
+		return d.manager.Backup(ctx, manager.BackupOptions{
+			Mode:            mode,
+			Filesystem:      fs,
+			ContinueOnError: true,
+		})
+
+	case JobPrune:
+		pruned, err := d.manager.Prune(ctx, manager.PruneOptions{Filesystem: fs})
+		for _, p := range pruned {
+			d.log.Info("pruned backup", "filesystem", fs, "bucket", p.Bucket, "id", p.Entry.ID, "key", p.Entry.S3Key)
+		}
+		return err
+
+	case JobVerify:
+		results, err := d.manager.Verify(ctx, manager.VerifyOptions{Filesystem: fs, Sample: 1})
+		if err != nil {
+			return err
+		}
+		var failed []string
+		for _, result := range results {
+			if result.Status == manager.VerifyFail {
+				failed = append(failed, fmt.Sprintf("%q: %q: %s", result.Bucket, result.Entry.S3Key, result.Error))
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("backups failed verification: %v", failed)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown job %q", job)
+	}
+}
+
+// complete records the job as having run at the time it was due, and writes
+// the state file. A full backup also completes a scheduled incremental
+// backup. A failed job is not recorded, and is instead retried after a
+// backoff.
+func (d *Daemon) complete(fs string, r run, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.queued[fs][r.job] = false
+
+	if err != nil {
+		rt := d.retries[fs][r.job]
+		rt.failures++
+		backoff := tickInterval
+		for i := 1; i < rt.failures && backoff < maxRetryBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		rt.after = d.clock.Now().Add(backoff)
+		d.retries[fs][r.job] = rt
+		d.log.Info("retrying failed job", "filesystem", fs, "job", r.job, "failures", rt.failures, "backoff", backoff)
+		return
+	}
+
+	delete(d.retries[fs], r.job)
+	d.state.set(fs, r.job, r.due)
+	if _, ok := d.schedules[fs][JobIncremental]; ok && r.job == JobFull {
+		d.state.set(fs, JobIncremental, r.due)
+	}
+
+	if err := d.state.write(d.stateFile); err != nil {
+		d.log.Error(err, "failed to write state file, missed jobs may be run again on restart", "state_file", d.stateFile)
+	}
+}
@@ -0,0 +1,280 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/manager"
+)
+
+// call is a job run by the fake manager.
+type call struct {
+	filesystem string
+	job        Job
+}
+
+// fakeManager records the jobs it runs. Jobs block until released if block
+// is set, and fail the number of times given in fail.
+type fakeManager struct {
+	lock    sync.Mutex
+	calls   []call
+	running map[string]int
+	overlap bool
+	block   chan struct{}
+	fail    map[call]int
+}
+
+func (f *fakeManager) record(ctx context.Context, fs string, job Job) error {
+	f.lock.Lock()
+	c := call{filesystem: fs, job: job}
+	f.calls = append(f.calls, c)
+	var err error
+	if f.fail[c] > 0 {
+		f.fail[c]--
+		err = errors.New("job failed")
+	}
+	if f.running == nil {
+		f.running = make(map[string]int)
+	}
+	f.running[fs]++
+	if f.running[fs] > 1 {
+		f.overlap = true
+	}
+	block := f.block
+	f.lock.Unlock()
+
+	defer func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.running[fs]--
+	}()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (f *fakeManager) Backup(ctx context.Context, opts manager.BackupOptions) error {
+	job := JobFull
+	if opts.Mode != manager.ModeFull {
+		job = JobIncremental
+	}
+	return f.record(ctx, opts.Filesystem, job)
+}
+
+func (f *fakeManager) Prune(ctx context.Context, opts manager.PruneOptions) ([]manager.PrunedBackup, error) {
+	return nil, f.record(ctx, opts.Filesystem, JobPrune)
+}
+
+func (f *fakeManager) Verify(ctx context.Context, opts manager.VerifyOptions) ([]manager.VerifyResult, error) {
+	return nil, f.record(ctx, opts.Filesystem, JobVerify)
+}
+
+func (f *fakeManager) takeCalls() []call {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func Test_New(t *testing.T) {
+	_, err := New(Options{
+		Log:    logr.Discard(),
+		Config: config.Config{Filesystems: []config.Filesystem{{Name: "tank/foo"}}},
+	})
+	assert.Error(t, err, "no jobs are scheduled")
+}
+
+func Test_Run(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	cfg := config.Config{
+		Filesystems: []config.Filesystem{
+			{Name: "tank/foo"},
+			{Name: "tank/db", Schedule: &config.Schedule{Incremental: "15m", Prune: "1d"}},
+		},
+		Schedule: config.Schedule{
+			Full:        "1d",
+			Incremental: "1h",
+			StateFile:   filepath.Join(t.TempDir(), "state", "schedule.json"),
+		},
+	}
+
+	// start runs a new daemon, returning a function which stops the daemon
+	// and waits for it to exit.
+	start := func(t *testing.T, m *fakeManager) func() {
+		t.Helper()
+		d, err := New(Options{Log: logr.Discard(), Manager: m, Config: cfg, Clock: clock})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- d.Run(ctx) }()
+
+		return func() {
+			cancel()
+			select {
+			case err := <-errCh:
+				require.NoError(t, err)
+			case <-time.After(time.Second * 5):
+				t.Fatal("daemon did not shut down")
+			}
+		}
+	}
+
+	// waitCalls steps the clock once the daemon is waiting, and waits for the
+	// expected jobs to be run.
+	waitCalls := func(t *testing.T, m *fakeManager, step time.Duration, exp ...call) {
+		t.Helper()
+		if step > 0 {
+			require.Eventually(t, clock.HasWaiters, time.Second*5, time.Millisecond)
+			clock.Step(step)
+		}
+		var calls []call
+		require.Eventually(t, func() bool {
+			calls = append(calls, m.takeCalls()...)
+			return len(calls) >= len(exp)
+		}, time.Second*5, time.Millisecond)
+		assert.ElementsMatch(t, exp, calls)
+	}
+
+	m := new(fakeManager)
+	stop := start(t, m)
+
+	// Jobs which have never run are due immediately, and the full backup
+	// supersedes the incremental.
+	waitCalls(t, m, 0,
+		call{"tank/foo", JobFull},
+		call{"tank/db", JobFull},
+		call{"tank/db", JobPrune},
+	)
+
+	for i := 0; i < 3; i++ {
+		waitCalls(t, m, time.Minute*15, call{"tank/db", JobIncremental})
+	}
+	waitCalls(t, m, time.Minute*15,
+		call{"tank/foo", JobIncremental},
+		call{"tank/db", JobIncremental},
+	)
+
+	stop()
+	assert.False(t, m.overlap)
+
+	// Missed runs whilst stopped are caught up once on start.
+	clock.Step(time.Hour * 24 * 3)
+	m = new(fakeManager)
+	stop = start(t, m)
+	waitCalls(t, m, 0,
+		call{"tank/foo", JobFull},
+		call{"tank/db", JobFull},
+		call{"tank/db", JobPrune},
+	)
+	stop()
+
+	// Jobs of the same filesystem never overlap, and jobs interrupted by
+	// shutdown are caught up on the next start.
+	clock.Step(time.Hour * 24)
+	m = &fakeManager{block: make(chan struct{})}
+	stop = start(t, m)
+	waitCalls(t, m, 0,
+		call{"tank/foo", JobFull},
+		call{"tank/db", JobFull},
+	)
+	require.Eventually(t, clock.HasWaiters, time.Second*5, time.Millisecond)
+	clock.Step(time.Hour)
+	time.Sleep(time.Millisecond * 50)
+	assert.Empty(t, m.takeCalls(), "jobs should wait for the running job of the filesystem")
+	stop()
+	assert.False(t, m.overlap)
+
+	m = new(fakeManager)
+	stop = start(t, m)
+	waitCalls(t, m, 0,
+		call{"tank/foo", JobFull},
+		call{"tank/db", JobFull},
+		call{"tank/db", JobPrune},
+	)
+	stop()
+}
+
+func Test_Run_Retry(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	stateFile := filepath.Join(t.TempDir(), "schedule.json")
+	cfg := config.Config{
+		Filesystems: []config.Filesystem{{Name: "tank/foo"}},
+		Schedule:    config.Schedule{Full: "1d", StateFile: stateFile},
+	}
+
+	m := &fakeManager{fail: map[call]int{{"tank/foo", JobFull}: 2}}
+	d, err := New(Options{Log: logr.Discard(), Manager: m, Config: cfg, Clock: clock})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- d.Run(ctx) }()
+	defer func() {
+		cancel()
+		require.NoError(t, <-errCh)
+	}()
+
+	// step steps the clock once the daemon is waiting and the job has
+	// completed.
+	step := func(t *testing.T, step time.Duration) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			d.lock.Lock()
+			defer d.lock.Unlock()
+			return clock.HasWaiters() && !d.queued["tank/foo"][JobFull]
+		}, time.Second*5, time.Millisecond)
+		clock.Step(step)
+	}
+
+	// waitCalls steps the clock, and waits for the number of calls to be
+	// made.
+	waitCalls := func(t *testing.T, d time.Duration, n int) {
+		t.Helper()
+		if d > 0 {
+			step(t, d)
+		}
+		var calls []call
+		require.Eventually(t, func() bool {
+			calls = append(calls, m.takeCalls()...)
+			return len(calls) >= n
+		}, time.Second*5, time.Millisecond)
+		assert.Len(t, calls, n)
+	}
+
+	// The failed job is retried after a minute, then two minutes.
+	waitCalls(t, 0, 1)
+	waitCalls(t, time.Minute, 1)
+	st, err := readState(stateFile)
+	require.NoError(t, err)
+	assert.True(t, st.last("tank/foo", JobFull).IsZero(), "failed job should not be recorded")
+
+	step(t, time.Minute)
+	time.Sleep(time.Millisecond * 50)
+	assert.Empty(t, m.takeCalls(), "retry should back off")
+
+	waitCalls(t, time.Minute, 1)
+	step(t, time.Hour)
+	st, err = readState(stateFile)
+	require.NoError(t, err)
+	assert.False(t, st.last("tank/foo", JobFull).IsZero(), "successful job should be recorded")
+	time.Sleep(time.Millisecond * 50)
+	assert.Empty(t, m.takeCalls(), "successful job should not be run again until due")
+}
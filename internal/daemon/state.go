@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// state is the time each job last ran, indexed by filesystem then job.
+type state map[string]map[Job]time.Time
+
+// readState reads the state file. Returns an empty state if the file does
+// not exist.
+func readState(path string) (state, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(state), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %q: %w", path, err)
+	}
+
+	st := make(state)
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("failed to decode state file %q: %w", path, err)
+	}
+	return st, nil
+}
+
+// last returns the time the job of the filesystem last ran, or zero if it
+// has never run.
+func (s state) last(fs string, job Job) time.Time {
+	return s[fs][job]
+}
+
+// set records the time the job of the filesystem last ran.
+func (s state) set(fs string, job Job, t time.Time) {
+	if s[fs] == nil {
+		s[fs] = make(map[Job]time.Time)
+	}
+	s[fs][job] = t
+}
+
+// write atomically writes the state to the file, creating its directory if
+// needed.
+func (s state) write(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state file directory: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed to write state file %q: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write state file %q: %w", path, err)
+	}
+	return nil
+}
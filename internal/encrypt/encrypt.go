@@ -0,0 +1,97 @@
+// Package encrypt provides streaming authenticated encryption and decryption
+// of backup streams, using age with X25519 recipients.
+package encrypt
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// Scheme is the encryption scheme of a backup object.
+type Scheme string
+
+const (
+	// SchemeAge is age encryption to X25519 recipients.
+	SchemeAge Scheme = "age"
+)
+
+// ParseRecipients parses the given age X25519 public keys, i.e. "age1...".
+func ParseRecipients(keys []string) ([]age.Recipient, error) {
+	recipients := make([]age.Recipient, len(keys))
+	for i, key := range keys {
+		recipient, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption recipient %d: %w", i, err)
+		}
+		recipients[i] = recipient
+	}
+	return recipients, nil
+}
+
+// ReadIdentityFile reads the age identities from the given file.
+func ReadIdentityFile(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file: %w", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity file %q: %w", path, err)
+	}
+
+	return identities, nil
+}
+
+// NewReader returns a reader which encrypts the given stream to the
+// recipients. Encryption is performed in a separate goroutine as the returned
+// reader is read from. Closing the returned reader stops encryption. If no
+// recipients are given, the stream is returned unencrypted.
+func NewReader(r io.Reader, recipients []age.Recipient) io.ReadCloser {
+	if len(recipients) == 0 {
+		return io.NopCloser(r)
+	}
+
+	// The age header is written to the pipe on Encrypt, so must be done in the
+	// goroutine, once the returned reader is being read from.
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := age.Encrypt(pw, recipients...)
+		if err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to encrypt: %w", err))
+			return
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	return pr
+}
+
+// NewDecryptReader returns a reader which decrypts the given stream which was
+// encrypted with the scheme. If the scheme is empty, the stream is returned
+// as is.
+func NewDecryptReader(r io.Reader, scheme Scheme, identities []age.Identity) (io.Reader, error) {
+	switch scheme {
+	case "":
+		return r, nil
+	case SchemeAge:
+		if len(identities) == 0 {
+			return nil, fmt.Errorf("backup is encrypted but no identity file is configured")
+		}
+		dr, err := age.Decrypt(r, identities...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt: %w", err)
+		}
+		return dr, nil
+	default:
+		return nil, fmt.Errorf("unsupported encryption scheme %q", scheme)
+	}
+}
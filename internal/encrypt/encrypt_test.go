@@ -0,0 +1,52 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	identityFile := filepath.Join(t.TempDir(), "key.txt")
+	require.NoError(t, os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600))
+
+	recipients, err := ParseRecipients([]string{identity.Recipient().String()})
+	require.NoError(t, err)
+
+	data := make([]byte, 1<<20)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	encrypted, err := io.ReadAll(NewReader(bytes.NewReader(data), recipients))
+	require.NoError(t, err)
+	assert.NotEqual(t, data, encrypted[:len(data)])
+
+	identities, err := ReadIdentityFile(identityFile)
+	require.NoError(t, err)
+	dr, err := NewDecryptReader(bytes.NewReader(encrypted), SchemeAge, identities)
+	require.NoError(t, err)
+	got, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = NewDecryptReader(bytes.NewReader(encrypted), SchemeAge, []age.Identity{other})
+	assert.Error(t, err, "expected error decrypting with wrong identity")
+
+	_, err = NewDecryptReader(bytes.NewReader(encrypted), SchemeAge, nil)
+	assert.Error(t, err, "expected error decrypting with no identity")
+
+	_, err = ParseRecipients([]string{"not-a-key"})
+	assert.Error(t, err)
+}
@@ -3,20 +3,88 @@ package manager
 import (
 	"context"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strings"
 	"sync"
 
+	"github.com/go-logr/logr"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/backup"
 	"github.com/joshvanl/yazbu/internal/client"
+	"github.com/joshvanl/yazbu/internal/util/fanout"
 	"github.com/joshvanl/yazbu/internal/zfs"
 )
 
-// BackupFull create a full ZFS backup for each filesystem, and writes those
-// backups to all S3 endpoints, updating their respective databases.
-func (m *Manager) BackupFull(ctx context.Context) error {
+const (
+	// fanoutBufferChunks is the number of 1MiB chunks of a snapshot stream
+	// buffered for each bucket.
+	fanoutBufferChunks = 16
+)
+
+// Mode is the mode of backup to perform.
+type Mode int
+
+const (
+	// ModeFull always writes a full backup.
+	ModeFull Mode = iota
+
+	// ModeIncremental writes an incremental backup from the latest entry in
+	// each bucket's database. A full backup is written instead if the database
+	// has no full backup, or the cadence IncrementalPerLastFull has been
+	// reached. Incrementals are sent from the bookmark of the latest entry's
+	// snapshot, or the snapshot itself. Errors if neither exist on the host.
+	ModeIncremental
+
+	// ModeAuto behaves the same as ModeIncremental, but falls back to a full
+	// backup if neither the bookmark nor snapshot of the latest entry exist on
+	// the host.
+	ModeAuto
+)
+
+// String returns the string representation of the Mode.
+func (m Mode) String() string {
+	switch m {
+	case ModeIncremental:
+		return "incremental"
+	case ModeAuto:
+		return "auto"
+	default:
+		return "full"
+	}
+}
+
+// BackupOptions are the options for performing a backup.
+type BackupOptions struct {
+	// Mode is the mode of backup to perform.
+	Mode Mode
+
+	// Filesystem limits the backup to the filesystem. If empty, all
+	// filesystems are backed up.
+	Filesystem string
+
+	// ContinueOnError continues writing the backup to the remaining buckets
+	// when writing to a bucket fails, rather than aborting all writes. An
+	// error is still returned once all writes have finished.
+	ContinueOnError bool
+}
+
+// Backup creates a ZFS backup for each filesystem using the given options,
+// and writes those backups to all S3 endpoints, updating their respective
+// databases. Each snapshot stream is sent once, and written to all buckets
+// which require the same stream. Once a filesystem's backup has been written
+// to all buckets, its local snapshots which are no longer needed are
+// destroyed.
+func (m *Manager) Backup(ctx context.Context, opts BackupOptions) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	m.log.Info("performing full backup")
+	m.log.Info("performing backup", "mode", opts.Mode)
+
+	filesystems, err := m.filesystemsFor(opts.Filesystem)
+	if err != nil {
+		return err
+	}
 
 	var (
 		errs []string
@@ -24,79 +92,431 @@ func (m *Manager) BackupFull(ctx context.Context) error {
 		lock sync.Mutex
 	)
 
-	wg.Add(len(m.filesystems))
-	for _, fs := range m.filesystems {
-		go func(fs string) {
+	wg.Add(len(filesystems))
+	for _, fs := range filesystems {
+		go func(fs config.Filesystem) {
 			defer wg.Done()
 
-			if err := m.backupFullFS(ctx, fs); err != nil {
+			if err := m.backupFS(ctx, fs, opts); err != nil {
 				lock.Lock()
 				defer lock.Unlock()
 				errs = append(errs, err.Error())
-				cancel()
+				if !opts.ContinueOnError {
+					cancel()
+				}
+				return
+			}
+
+			// The backup has been written to all buckets, so snapshots which are
+			// no longer needed can be destroyed. The backup itself succeeded, so
+			// failing to prune is not a backup error.
+			if _, err := m.pruneSnapshotsFS(ctx, fs, false); err != nil {
+				m.log.Error(err, "failed to prune local snapshots", "filesystem", fs.Name)
 			}
 		}(fs)
 	}
 	wg.Wait()
 
 	if len(errs) > 0 {
-		return fmt.Errorf("backupFull: [%s]", strings.Join(errs, ", "))
+		return fmt.Errorf("backup: [%s]", strings.Join(errs, ", "))
 	}
 
 	return nil
 }
 
-// backupFullFS creates a backup in all buckets, for the given filesystem.
-func (m *Manager) backupFullFS(ctx context.Context, fs string) error {
-	snapshot, size, err := zfs.SnapshotCreate(ctx, m.log, fs)
+// PlannedBackup is a backup which would be written to a bucket.
+type PlannedBackup struct {
+	// Filesystem is the filesystem of the backup.
+	Filesystem string
+
+	// Endpoint is the S3 endpoint of the bucket.
+	Endpoint string
+
+	// Bucket is the bucket the backup would be written to.
+	Bucket string
+
+	// Type is the type of the backup.
+	Type backup.Type
+
+	// Snapshot is the name of the snapshot which would be created.
+	Snapshot string
+
+	// From is the snapshot an incremental backup would be sent from.
+	From string
+
+	// Size is the estimated size in bytes of the backup.
+	Size uint64
+
+	// Removed are the entries which would be deleted from the bucket according
+	// to the cadence once the backup was written.
+	Removed []backup.Entry
+}
+
+// BackupDryRun returns the backups which Backup would write with the given
+// options, and the entries each bucket would delete as a result. No snapshot
+// is created, and nothing is written to or deleted from the buckets. Sizes are
+// estimated from the filesystem, so may differ from the size of the stream
+// which is sent. ContinueOnError is ignored; the backups of every filesystem
+// are planned.
+func (m *Manager) BackupDryRun(ctx context.Context, opts BackupOptions) ([]PlannedBackup, error) {
+	m.log.Info("performing backup dry run", "mode", opts.Mode)
+
+	filesystems, err := m.filesystemsFor(opts.Filesystem)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		planned = make([][]PlannedBackup, len(filesystems))
+		errs    []string
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+	)
+
+	wg.Add(len(filesystems))
+	for i, fs := range filesystems {
+		go func(i int, fs config.Filesystem) {
+			defer wg.Done()
+
+			p, err := m.backupFSDryRun(ctx, fs, opts.Mode)
+			lock.Lock()
+			defer lock.Unlock()
+			planned[i] = p
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}(i, fs)
+	}
+	wg.Wait()
+
+	var all []PlannedBackup
+	for _, p := range planned {
+		all = append(all, p...)
+	}
+
+	if len(errs) > 0 {
+		return all, fmt.Errorf("backup dry run: [%s]", strings.Join(errs, ", "))
+	}
+
+	return all, nil
+}
+
+// backupFSDryRun returns the backups of the filesystem which would be written
+// to each of its buckets.
+func (m *Manager) backupFSDryRun(ctx context.Context, fs config.Filesystem, mode Mode) ([]PlannedBackup, error) {
+	snapshot := zfs.SnapshotName(fs.Name, snapshotPrefix(fs), m.clock.Now())
+	size, err := m.zfs.EstimateSize(ctx, m.log, fs.Name, "")
 	if err != nil {
-		return fmt.Errorf("failed to create full snapshot: %w", err)
+		return nil, fmt.Errorf("backupFS %q: failed to estimate snapshot size: %w", fs.Name, err)
+	}
+
+	var (
+		planned []PlannedBackup
+		errs    []string
+	)
+	for _, cl := range m.clientsFor(fs.Name) {
+		b, _, err := m.planBackup(ctx, cl, fs, snapshot, 0, size, mode, true)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%q: %s", cl.Bucket(), err))
+			continue
+		}
+
+		removed, err := cl.BackupDryRun(ctx, b)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		m.log.Info("would write backup", "bucket", cl.Bucket(), "snapshot", snapshot, "type", b.Type, "from", b.From, "size", b.Size)
+		planned = append(planned, PlannedBackup{
+			Filesystem: fs.Name,
+			Endpoint:   cl.Endpoint(),
+			Bucket:     cl.Bucket(),
+			Type:       b.Type,
+			Snapshot:   snapshot,
+			From:       b.From,
+			Size:       b.Size,
+			Removed:    removed,
+		})
+	}
+
+	if len(errs) > 0 {
+		return planned, fmt.Errorf("backupFS %q: [%s]", fs.Name, strings.Join(errs, ", "))
+	}
+
+	return planned, nil
+}
+
+// backupFS creates a backup in all buckets of the given filesystem. Buckets
+// which require the same snapshot stream share a single zfs send.
+func (m *Manager) backupFS(ctx context.Context, fs config.Filesystem, opts BackupOptions) error {
+	snapshot, size, err := m.zfs.SnapshotCreate(ctx, m.log, fs.Name, snapshotPrefix(fs))
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	// The size is estimated when creating the snapshot without send flags,
+	// which may change the size of the stream.
+	if len(fs.SendFlags) > 0 {
+		size, err = m.zfs.SnapshotSize(ctx, m.log, snapshot, fs.SendFlags)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshot size: %w", err)
+		}
+	}
+
+	guid, err := m.zfs.GUID(ctx, m.log, snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to get snapshot guid: %w", err)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	var (
-		errs []string
-		wg   sync.WaitGroup
-		lock sync.Mutex
+		errs    []string
+		written bool
+		wg      sync.WaitGroup
+		lock    sync.Mutex
 	)
 
-	wg.Add(len(m.clients))
-	for _, cl := range m.clients {
-		go func(cl *client.Client) {
+	addErr := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = append(errs, err.Error())
+		if !opts.ContinueOnError {
+			cancel()
+		}
+	}
+
+	// Group the clients by the stream they require.
+	type group struct {
+		backup  client.Backup
+		source  string
+		clients []*client.Client
+	}
+	var groups []*group
+	for _, cl := range m.clientsFor(fs.Name) {
+		b, source, err := m.planBackup(ctx, cl, fs, snapshot, guid, size, opts.Mode, false)
+		if err != nil {
+			addErr(fmt.Errorf("%q: %w", cl.Bucket(), err))
+			if !opts.ContinueOnError {
+				break
+			}
+			continue
+		}
+
+		var found bool
+		for _, g := range groups {
+			if g.backup.Type == b.Type && g.backup.From == b.From {
+				g.clients = append(g.clients, cl)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, &group{backup: b, source: source, clients: []*client.Client{cl}})
+		}
+	}
+
+	if len(errs) > 0 && !opts.ContinueOnError {
+		return fmt.Errorf("backupFS %q: [%s]", fs.Name, strings.Join(errs, ", "))
+	}
+
+	for _, g := range groups {
+		src, err := m.sendBackup(ctx, g.backup, g.source, fs.SendFlags)
+		if err != nil {
+			addErr(err)
+			continue
+		}
+
+		fan := fanout.New(len(g.clients), fanoutBufferChunks)
+
+		wg.Add(1)
+		go func(b client.Backup) {
 			defer wg.Done()
 
-			f := func() error {
-				rc, err := zfs.SnapshotSendFull(ctx, m.log, snapshot)
-				if err != nil {
-					return fmt.Errorf("failed to send snapshot: %w", err)
-				}
+			rc, err := src(ctx, m.log)
+			if err != nil {
+				// Fail all destinations with the error.
+				rc = io.NopCloser(errReader{err})
+			}
+
+			if err := fan.Run(ctx, rc); err != nil {
+				addErr(fmt.Errorf("failed to send snapshot %q: %w", b.Snapshot, err))
+			}
+		}(g.backup)
+
+		wg.Add(len(g.clients))
+		for i, cl := range g.clients {
+			go func(b client.Backup, cl *client.Client, dest *fanout.Destination) {
+				defer wg.Done()
+				defer dest.Close()
 
-				split := strings.Split(snapshot, "@")
-				if err := cl.BackupWriteFull(ctx,
-					filepath.Join(split[0], fmt.Sprintf("%s.full", split[1])),
-					size, rc,
-				); err != nil {
-					return err
+				b.Reader = func(context.Context, logr.Logger) (io.ReadCloser, error) {
+					return dest, nil
 				}
 
-				return nil
-			}
+				if err := cl.BackupWrite(ctx, b); err != nil {
+					addErr(err)
+					return
+				}
 
-			if err := f(); err != nil {
 				lock.Lock()
 				defer lock.Unlock()
-				errs = append(errs, err.Error())
-				cancel()
-			}
-		}(cl)
+				written = true
+			}(g.backup, cl, fan.Destination(i))
+		}
 	}
 	wg.Wait()
 
+	// Bookmark the snapshot once written to a bucket, so it can be used as the
+	// incremental base of the next backup after the snapshot is destroyed.
+	// Without a bookmark the snapshot is kept instead, so failing is not an
+	// error.
+	if written {
+		if _, err := m.zfs.BookmarkCreate(ctx, m.log, snapshot); err != nil {
+			m.log.Error(err, "failed to bookmark snapshot, snapshot will be kept as the incremental base", "snapshot", snapshot)
+		}
+	}
+
 	if len(errs) > 0 {
-		return fmt.Errorf("backupFullFS %q: [%s]", fs, strings.Join(errs, ", "))
+		return fmt.Errorf("backupFS %q: [%s]", fs.Name, strings.Join(errs, ", "))
 	}
 
 	return nil
 }
+
+// planBackup returns the backup that should be written to the client for the
+// given snapshot, according to the mode and the client's database, and the
+// local snapshot or bookmark an incremental backup is sent from. The returned
+// backup has no Reader. If dryRun, the snapshot does not exist yet so the size
+// of an incremental backup is estimated from the filesystem.
+func (m *Manager) planBackup(ctx context.Context, cl *client.Client, fs config.Filesystem, snapshot string, guid, size uint64, mode Mode, dryRun bool) (client.Backup, string, error) {
+	typ := backup.TypeFull
+	var (
+		from, source string
+		fromGUID     uint64
+	)
+
+	if mode != ModeFull {
+		next, base, err := cl.NextBackup(ctx, fs.Name)
+		if err != nil {
+			return client.Backup{}, "", err
+		}
+
+		if next == backup.TypeIncremental {
+			from = base.SnapshotName(fs.Name)
+			source, fromGUID, err = m.incrementalSource(ctx, fs.Name, base)
+			if err != nil {
+				return client.Backup{}, "", err
+			}
+
+			switch {
+			case len(source) > 0:
+				typ = backup.TypeIncremental
+			case mode == ModeAuto:
+				m.log.Info("incremental base snapshot no longer exists, falling back to full backup", "snapshot", from)
+				from = ""
+			default:
+				return client.Backup{}, "", fmt.Errorf("incremental base snapshot %q no longer exists", from)
+			}
+		}
+	}
+
+	split := strings.SplitN(snapshot, "@", 2)
+	b := client.Backup{
+		Filesystem: fs.Name,
+		Type:       typ,
+		Key:        filepath.Join(split[0], fmt.Sprintf("%s.%s", split[1], typ)),
+		Snapshot:   snapshot,
+		GUID:       guid,
+		From:       from,
+		FromGUID:   fromGUID,
+		Size:       size,
+	}
+
+	if typ == backup.TypeIncremental {
+		var err error
+		if dryRun {
+			b.Size, err = m.zfs.EstimateSize(ctx, m.log, fs.Name, source)
+		} else {
+			b.Size, err = m.zfs.SnapshotSizeInc(ctx, m.log, source, snapshot, fs.SendFlags)
+		}
+		if err != nil {
+			return client.Backup{}, "", fmt.Errorf("failed to get incremental snapshot size: %w", err)
+		}
+	}
+
+	return b, source, nil
+}
+
+// incrementalSource returns the local bookmark or snapshot of the given entry
+// which an incremental backup can be sent from, and its GUID. The bookmark is
+// preferred, as the snapshot may be destroyed once backed up. If the entry
+// recorded a GUID, the source must have the same GUID. Returns an empty source
+// if neither exist.
+func (m *Manager) incrementalSource(ctx context.Context, fs string, base backup.Entry) (string, uint64, error) {
+	snapshot := base.SnapshotName(fs)
+
+	var candidates []string
+	bookmarks, err := m.zfs.BookmarkList(ctx, m.log, fs)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, bookmark := range bookmarks {
+		if bookmark == zfs.BookmarkName(snapshot) {
+			candidates = append(candidates, bookmark)
+		}
+	}
+
+	exists, err := m.zfs.SnapshotExists(ctx, m.log, snapshot)
+	if err != nil {
+		return "", 0, err
+	}
+	if exists {
+		candidates = append(candidates, snapshot)
+	}
+
+	for _, candidate := range candidates {
+		guid, err := m.zfs.GUID(ctx, m.log, candidate)
+		if err != nil {
+			return "", 0, err
+		}
+		if base.GUID == 0 || guid == base.GUID {
+			return candidate, guid, nil
+		}
+		m.log.Info("incremental base does not match the GUID of the backup, ignoring",
+			"name", candidate, "guid", guid, "expected", base.GUID)
+	}
+
+	return "", 0, nil
+}
+
+// sendBackup returns the zfs send stream of the given backup, sent with the
+// given additional zfs send flags. Incremental backups are sent from the given
+// source snapshot or bookmark.
+func (m *Manager) sendBackup(ctx context.Context, b client.Backup, source string, flags []string) (zfs.ZFSReader, error) {
+	var (
+		rc  zfs.ZFSReader
+		err error
+	)
+	if b.Type == backup.TypeIncremental {
+		rc, err = m.zfs.SnapshotSendInc(ctx, m.log, source, b.Snapshot, flags)
+	} else {
+		rc, err = m.zfs.SnapshotSendFull(ctx, m.log, b.Snapshot, flags)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to send snapshot: %w", err)
+	}
+	return rc, nil
+}
+
+// errReader is an io.Reader which always returns the given error.
+type errReader struct {
+	err error
+}
+
+// Read implements the io.Reader interface.
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
@@ -6,13 +6,112 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/joshvanl/yazbu/internal/backup"
 	"github.com/joshvanl/yazbu/internal/client"
 )
 
-// ListDBs lists all databases for all buckets.
-func (m *Manager) ListDBs(ctx context.Context) (map[string][]backup.DB, error) {
+// ListSort is the order of the entries of each listed database.
+type ListSort string
+
+const (
+	// ListSortID sorts entries by ID, oldest first.
+	ListSortID ListSort = "id"
+
+	// ListSortTime sorts entries by timestamp, oldest first.
+	ListSortTime ListSort = "time"
+
+	// ListSortSize sorts entries by size, largest first.
+	ListSortSize ListSort = "size"
+)
+
+// ListOptions are the options for listing databases. Filters which are unset
+// match everything.
+type ListOptions struct {
+	// Filesystem limits listing to the filesystem.
+	Filesystem string
+
+	// Bucket limits listing to buckets with the name.
+	Bucket string
+
+	// Endpoint limits listing to buckets at the endpoint.
+	Endpoint string
+
+	// Type limits listing to entries of the backup type.
+	Type backup.Type
+
+	// Since limits listing to entries written at or after the time.
+	Since time.Time
+
+	// Until limits listing to entries written at or before the time.
+	Until time.Time
+
+	// Latest limits listing to the latest number of matching entries of each
+	// database. If 0, all matching entries are listed.
+	Latest int
+
+	// Sort is the order of the entries of each database. Defaults to
+	// ListSortID.
+	Sort ListSort
+}
+
+// ListedDB is a database of a filesystem in a bucket, with only the entries
+// matching the list options.
+type ListedDB struct {
+	backup.DB
+
+	// Chains is the position of each listed entry in its restore chain,
+	// indexed by entry ID. Computed from all entries of the database, so is
+	// unaffected by filtering.
+	Chains map[int]ChainPosition
+}
+
+// ChainPosition is the position of an entry in the chain of entries required
+// to restore it.
+type ChainPosition struct {
+	// Base is the ID of the full backup the chain starts from. 0 if the entry
+	// cannot be restored.
+	Base int
+
+	// Position is the number of incremental backups from the full backup to
+	// the entry, i.e. 0 for full backups. -1 if the entry cannot be restored,
+	// because it is deleted or its chain is broken.
+	Position int
+}
+
+// validate validates the list options.
+func (o ListOptions) validate() error {
+	switch o.Type {
+	case "", backup.TypeFull, backup.TypeIncremental:
+	default:
+		return fmt.Errorf("unknown backup type %q, must be one of [%s %s]", o.Type, backup.TypeFull, backup.TypeIncremental)
+	}
+
+	switch o.Sort {
+	case "", ListSortID, ListSortTime, ListSortSize:
+	default:
+		return fmt.Errorf("unknown sort order %q, must be one of [%s %s %s]", o.Sort, ListSortID, ListSortTime, ListSortSize)
+	}
+
+	if o.Latest < 0 {
+		return fmt.Errorf("latest must not be negative, got %d", o.Latest)
+	}
+
+	if !o.Since.IsZero() && !o.Until.IsZero() && o.Since.After(o.Until) {
+		return fmt.Errorf("since (%s) must not be after until (%s)", o.Since.Format(time.RFC3339), o.Until.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// ListDBs lists the databases of each filesystem in each bucket matching the
+// options, indexed by filesystem.
+func (m *Manager) ListDBs(ctx context.Context, opts ListOptions) (map[string][]ListedDB, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -21,10 +120,19 @@ func (m *Manager) ListDBs(ctx context.Context) (map[string][]backup.DB, error) {
 		wg        sync.WaitGroup
 		lock      sync.Mutex
 		clientDBs []backup.DB
+		found     bool
 	)
 
-	wg.Add(len(m.clients))
 	for _, cl := range m.clients {
+		if len(opts.Bucket) > 0 && cl.Bucket() != opts.Bucket {
+			continue
+		}
+		if len(opts.Endpoint) > 0 && cl.Endpoint() != opts.Endpoint {
+			continue
+		}
+		found = true
+
+		wg.Add(1)
 		go func(cl *client.Client) {
 			defer wg.Done()
 
@@ -44,13 +152,20 @@ func (m *Manager) ListDBs(ctx context.Context) (map[string][]backup.DB, error) {
 	}
 	wg.Wait()
 
+	if !found {
+		return nil, fmt.Errorf("no bucket configured matching endpoint %q and bucket %q", opts.Endpoint, opts.Bucket)
+	}
+
 	if len(errs) > 0 {
 		return nil, fmt.Errorf("ListDBs: [%s]", strings.Join(errs, ", "))
 	}
 
-	fsBackupList := make(map[string][]backup.DB)
+	fsBackupList := make(map[string][]ListedDB)
 	for _, db := range clientDBs {
-		fsBackupList[db.Filesystem] = append(fsBackupList[db.Filesystem], db)
+		if len(opts.Filesystem) > 0 && db.Filesystem != opts.Filesystem {
+			continue
+		}
+		fsBackupList[db.Filesystem] = append(fsBackupList[db.Filesystem], listDB(db, opts))
 	}
 
 	for fs, dbs := range fsBackupList {
@@ -66,3 +181,83 @@ func (m *Manager) ListDBs(ctx context.Context) (map[string][]backup.DB, error) {
 
 	return fsBackupList, nil
 }
+
+// listDB returns the database with only the entries matching the options, in
+// the sort order.
+func listDB(db backup.DB, opts ListOptions) ListedDB {
+	all := make([]backup.Entry, len(db.Entries))
+	copy(all, db.Entries)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].ID < all[j].ID
+	})
+
+	chains := chainPositions(all)
+
+	entries := make([]backup.Entry, 0, len(all))
+	for _, entry := range all {
+		if len(opts.Type) > 0 && entry.Type != opts.Type {
+			continue
+		}
+		if !opts.Since.IsZero() && entry.Timestamp.Before(opts.Since) {
+			continue
+		}
+		if !opts.Until.IsZero() && entry.Timestamp.After(opts.Until) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if opts.Latest > 0 && len(entries) > opts.Latest {
+		entries = entries[len(entries)-opts.Latest:]
+	}
+
+	switch opts.Sort {
+	case ListSortTime:
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Timestamp.Before(entries[j].Timestamp)
+		})
+	case ListSortSize:
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Size > entries[j].Size
+		})
+	}
+
+	listed := ListedDB{DB: db, Chains: make(map[int]ChainPosition, len(entries))}
+	listed.Entries = entries
+	for _, entry := range entries {
+		listed.Chains[entry.ID] = chains[entry.ID]
+	}
+
+	return listed
+}
+
+// chainPositions returns the chain position of each entry, indexed by ID.
+// Entries must be in ID order. Follows the same rules as backup.DB.Chain, so
+// an entry has a position only if it can be restored.
+func chainPositions(entries []backup.Entry) map[int]ChainPosition {
+	broken := ChainPosition{Position: -1}
+	chains := make(map[int]ChainPosition, len(entries))
+
+	for _, entry := range entries {
+		switch {
+		case entry.Deleted != nil:
+			chains[entry.ID] = broken
+
+		case entry.Type == backup.TypeFull:
+			chains[entry.ID] = ChainPosition{Base: entry.ID}
+
+		case entry.Type == backup.TypeIncremental:
+			parent, ok := chains[entry.Parent]
+			if !ok || parent.Position < 0 || entry.Parent != entry.ID-1 {
+				chains[entry.ID] = broken
+				continue
+			}
+			chains[entry.ID] = ChainPosition{Base: parent.Base, Position: parent.Position + 1}
+
+		default:
+			chains[entry.ID] = broken
+		}
+	}
+
+	return chains
+}
@@ -5,10 +5,13 @@ import (
 	"strings"
 
 	"github.com/go-logr/logr"
+	"k8s.io/utils/clock"
 
-	"github.com/joshvanl/yazbu/internal/client"
 	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/client"
+	"github.com/joshvanl/yazbu/internal/metrics"
 	"github.com/joshvanl/yazbu/internal/util"
+	"github.com/joshvanl/yazbu/internal/zfs"
 )
 
 // Manager is the database manager for a set of buckets over a set of
@@ -18,10 +21,24 @@ type Manager struct {
 	log logr.Logger
 
 	// filesystems is the set of ZFS dataset filesystems to backup.
-	filesystems []string
+	filesystems []config.Filesystem
 
 	// clients is the set of real S3 clients to backup data.
 	clients []*client.Client
+
+	// zfs performs the zfs operations on the host.
+	zfs zfs.Interface
+
+	// snapshotRetain is the number of most recent yazbu snapshots of each
+	// filesystem to keep locally.
+	snapshotRetain uint
+
+	// minRedundancy is the minimum redundancy of each filesystem, indexed by
+	// name.
+	minRedundancy map[string]uint
+
+	// clock is used to predict the name of snapshots in dry runs.
+	clock clock.Clock
 }
 
 // New creates a new Database manager for backups. Assumes the given config is
@@ -29,7 +46,8 @@ type Manager struct {
 // Force is used to signal that cadence should be overridden if the remote
 // Cadence is configured differently to the local. Should only be used by users
 // if they know what they are doing!
-func New(log logr.Logger, io util.IO, cfg config.Config, force bool) (*Manager, error) {
+// Metrics records the outcome of operations on each bucket, and may be nil.
+func New(log logr.Logger, io util.IO, cfg config.Config, force bool, metrics *metrics.Metrics) (*Manager, error) {
 	log = log.WithName("manager")
 
 	var (
@@ -37,15 +55,24 @@ func New(log logr.Logger, io util.IO, cfg config.Config, force bool) (*Manager,
 		errs    []string
 	)
 
-	// Create a client for each S3 endpoint bucket.
+	// Create a client for each S3 endpoint bucket, with the filesystems which
+	// are backed up to it.
 	for _, bucket := range cfg.Buckets {
+		var filesystems []config.Filesystem
+		for _, fs := range cfg.Filesystems {
+			if fs.HasBucket(bucket.Name) {
+				filesystems = append(filesystems, fs)
+			}
+		}
+
 		cl, err := client.New(client.Options{
 			Log:         log,
 			IO:          io,
-			Filesystems: cfg.Filesystems,
+			Filesystems: filesystems,
 			Cadence:     cfg.Cadence,
 			Bucket:      bucket,
 			Force:       force,
+			Metrics:     metrics,
 		})
 		if err != nil {
 			errs = append(errs, err.Error())
@@ -58,9 +85,62 @@ func New(log logr.Logger, io util.IO, cfg config.Config, force bool) (*Manager,
 		return nil, fmt.Errorf("%s", strings.Join(errs, ", "))
 	}
 
+	minRedundancy := make(map[string]uint, len(cfg.Filesystems))
+	for _, fs := range cfg.Filesystems {
+		minRedundancy[fs.Name] = cfg.MinRedundancyOf(fs)
+	}
+
 	return &Manager{
-		log:         log,
-		filesystems: cfg.Filesystems,
-		clients:     clients,
+		log:            log,
+		filesystems:    cfg.Filesystems,
+		clients:        clients,
+		zfs:            zfs.Exec{},
+		snapshotRetain: cfg.Snapshots.Retain,
+		minRedundancy:  minRedundancy,
+		clock:          clock.RealClock{},
 	}, nil
 }
+
+// clientsFor returns the clients of the buckets which the filesystem is backed
+// up to.
+func (m *Manager) clientsFor(filesystem string) []*client.Client {
+	var clients []*client.Client
+	for _, cl := range m.clients {
+		if cl.HasFilesystem(filesystem) {
+			clients = append(clients, cl)
+		}
+	}
+	return clients
+}
+
+// filesystemNames returns the names of the filesystems.
+func (m *Manager) filesystemNames() []string {
+	names := make([]string, len(m.filesystems))
+	for i, fs := range m.filesystems {
+		names[i] = fs.Name
+	}
+	return names
+}
+
+// filesystemsFor returns the filesystem with the given name, or all
+// filesystems if the name is empty.
+func (m *Manager) filesystemsFor(name string) ([]config.Filesystem, error) {
+	if len(name) == 0 {
+		return m.filesystems, nil
+	}
+	for _, fs := range m.filesystems {
+		if fs.Name == name {
+			return []config.Filesystem{fs}, nil
+		}
+	}
+	return nil, fmt.Errorf("filesystem %q is not configured", name)
+}
+
+// snapshotPrefix returns the prefix of the snapshots yazbu creates for the
+// filesystem.
+func snapshotPrefix(fs config.Filesystem) string {
+	if len(fs.SnapshotPrefix) > 0 {
+		return fs.SnapshotPrefix
+	}
+	return zfs.DefaultSnapshotPrefix
+}
@@ -0,0 +1,962 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/backend/fakes3"
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/client"
+	"github.com/joshvanl/yazbu/internal/util"
+	"github.com/joshvanl/yazbu/internal/zfs"
+	"github.com/joshvanl/yazbu/internal/zfs/fake"
+)
+
+// newTestManager returns a Manager of the filesystem "tank/foo" on the fake
+// zfs host, with a client for each of the given buckets on the fake S3
+// server.
+func newTestManager(t *testing.T, srv *fakes3.Server, z *fake.ZFS, buckets ...string) *Manager {
+	t.Helper()
+
+	var cfg config.Config
+	m := &Manager{
+		log:         logr.Discard(),
+		filesystems: []config.Filesystem{{Name: "tank/foo"}},
+		zfs:         z,
+	}
+
+	for _, bucket := range buckets {
+		be, err := srv.Backend(bucket)
+		require.NoError(t, err)
+
+		cl, err := client.New(client.Options{
+			Log:         logr.Discard(),
+			Filesystems: m.filesystems,
+			Cadence:     cfg.DefaultValues().Cadence,
+			Bucket:      config.Bucket{Name: bucket},
+			IO:          util.IO{Out: io.Discard, Err: io.Discard},
+			Backend:     be,
+		})
+		require.NoError(t, err)
+		m.clients = append(m.clients, cl)
+	}
+
+	return m
+}
+
+// newCadenceClient returns a client of the filesystems for the bucket on the
+// fake S3 server, whose cadence keeps the given number of incrementals per
+// full backup rather than the default.
+func newCadenceClient(t *testing.T, srv *fakes3.Server, filesystems []config.Filesystem, bucket string, incrementals uint) *client.Client {
+	t.Helper()
+
+	be, err := srv.Backend(bucket)
+	require.NoError(t, err)
+	cfg := config.Config{Cadence: config.Cadence{IncrementalPerLastFull: &incrementals}}
+	cl, err := client.New(client.Options{
+		Log:         logr.Discard(),
+		Filesystems: filesystems,
+		Cadence:     cfg.DefaultValues().Cadence,
+		Bucket:      config.Bucket{Name: bucket},
+		IO:          util.IO{Out: io.Discard, Err: io.Discard},
+		Backend:     be,
+	})
+	require.NoError(t, err)
+	return cl
+}
+
+// newTestZFS returns a fake zfs host whose clock starts at a fixed time.
+func newTestZFS() *fake.ZFS {
+	return fake.New(clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)))
+}
+
+// writeBackup writes a backup with the given data to all clients of the
+// manager.
+func writeBackup(t *testing.T, m *Manager, typ backup.Type, snapshot, from string, data []byte) {
+	t.Helper()
+	for _, cl := range m.clients {
+		require.NoError(t, cl.BackupWrite(context.Background(), client.Backup{
+			Filesystem: "tank/foo",
+			Type:       typ,
+			Key:        "tank/foo/" + snapshot + "." + string(typ),
+			Snapshot:   "tank/foo@" + snapshot,
+			From:       from,
+			Size:       uint64(len(data)),
+			Reader: func(context.Context, logr.Logger) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(data)), nil
+			},
+		}))
+	}
+}
+
+func Test_Backup(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	z := fake.New(clock)
+	m := newTestManager(t, srv, z, "bucket-1", "bucket-2")
+
+	z.Write("tank/foo", []byte("a"))
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+
+	clock.Step(time.Hour)
+	z.Write("tank/foo", []byte("b"))
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+
+	for _, cl := range m.clients {
+		db, err := cl.DB(ctx, "tank/foo")
+		require.NoError(t, err)
+		require.Len(t, db.Entries, 2, cl.Bucket())
+		assert.Equal(t, backup.TypeFull, db.Entries[0].Type)
+		assert.Equal(t, backup.TypeIncremental, db.Entries[1].Type)
+		assert.Equal(t, "tank/foo/yazbu_2020-05-01_01-00-00.inc", db.Entries[1].S3Key)
+	}
+
+	results, err := m.Verify(ctx, VerifyOptions{All: true, ValidateStream: true})
+	require.NoError(t, err)
+	for _, r := range results {
+		assert.Equal(t, VerifyPass, r.Status, "%s: %s", r.Entry.S3Key, r.Error)
+	}
+
+	require.NoError(t, m.Restore(ctx, RestoreOptions{Filesystem: "tank/foo", Bucket: "bucket-2", Dataset: "tank/bar"}))
+	data, ok := z.Data("tank/bar")
+	require.True(t, ok)
+	assert.Equal(t, "ab", string(data))
+
+	// Snapshots are destroyed once backed up, leaving the bookmark of the
+	// latest as the incremental base.
+	snapshots, err := z.SnapshotList(ctx, logr.Discard(), "tank/foo")
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+	bookmarks, err := z.BookmarkList(ctx, logr.Discard(), "tank/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tank/foo#yazbu_2020-05-01_01-00-00"}, bookmarks)
+
+	clock.Step(time.Hour)
+	z.Write("tank/foo", []byte("c"))
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+
+	// Remove the latest bookmark, so there is no longer an incremental base.
+	require.NoError(t, z.BookmarkDestroy(ctx, logr.Discard(), "tank/foo#yazbu_2020-05-01_02-00-00"))
+
+	clock.Step(time.Hour)
+	z.Write("tank/foo", []byte("d"))
+	assert.Error(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}), "incremental base should be missing")
+
+	clock.Step(time.Hour)
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeAuto}))
+	for _, cl := range m.clients {
+		db, err := cl.DB(ctx, "tank/foo")
+		require.NoError(t, err)
+		require.Len(t, db.Entries, 2, cl.Bucket(), "incrementals should be removed by the new full backup")
+		assert.Equal(t, backup.TypeFull, db.Entries[1].Type, "should fall back to a full backup")
+	}
+
+	require.NoError(t, m.Restore(ctx, RestoreOptions{Filesystem: "tank/foo", Dataset: "tank/baz"}))
+	data, ok = z.Data("tank/baz")
+	require.True(t, ok)
+	assert.Equal(t, "abcd", string(data))
+}
+
+func Test_BackupDryRun(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	z := fake.New(clock)
+	m := newTestManager(t, srv, z, "bucket-1", "bucket-2")
+	m.clock = clock
+
+	z.Write("tank/foo", []byte("a"))
+	planned, err := m.BackupDryRun(ctx, BackupOptions{Mode: ModeIncremental})
+	require.NoError(t, err)
+	require.Len(t, planned, 2)
+	for i, p := range planned {
+		assert.Equal(t, m.clients[i].Bucket(), p.Bucket)
+		assert.Equal(t, backup.TypeFull, p.Type, "buckets are empty")
+		assert.Equal(t, "tank/foo@yazbu_2020-05-01_00-00-00", p.Snapshot)
+		assert.Equal(t, uint64(1), p.Size)
+	}
+	assert.Empty(t, srv.Keys("bucket-1"))
+	assert.Empty(t, z.Sends())
+
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+	clock.Step(time.Hour)
+	z.Write("tank/foo", []byte("bc"))
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+	clock.Step(time.Hour)
+	z.Write("tank/foo", []byte("def"))
+
+	sends := len(z.Sends())
+	snapshots, err := z.SnapshotList(ctx, logr.Discard(), "tank/foo")
+	require.NoError(t, err)
+
+	planned, err = m.BackupDryRun(ctx, BackupOptions{Mode: ModeIncremental})
+	require.NoError(t, err)
+	require.Len(t, planned, 2)
+	for _, p := range planned {
+		assert.Equal(t, PlannedBackup{
+			Filesystem: "tank/foo",
+			Endpoint:   p.Endpoint,
+			Bucket:     p.Bucket,
+			Type:       backup.TypeIncremental,
+			Snapshot:   "tank/foo@yazbu_2020-05-01_02-00-00",
+			From:       "tank/foo@yazbu_2020-05-01_01-00-00",
+			Size:       3,
+		}, p)
+	}
+
+	planned, err = m.BackupDryRun(ctx, BackupOptions{Mode: ModeFull})
+	require.NoError(t, err)
+	require.Len(t, planned, 2)
+	for _, p := range planned {
+		assert.Equal(t, backup.TypeFull, p.Type)
+		assert.Equal(t, uint64(6), p.Size)
+		require.Len(t, p.Removed, 1, "incremental should be removed by the full backup")
+		assert.Equal(t, "tank/foo/yazbu_2020-05-01_01-00-00.inc", p.Removed[0].S3Key)
+	}
+
+	assert.Len(t, z.Sends(), sends, "nothing should be sent")
+	after, err := z.SnapshotList(ctx, logr.Discard(), "tank/foo")
+	require.NoError(t, err)
+	assert.Equal(t, snapshots, after, "no snapshot should be created")
+	for _, cl := range m.clients {
+		db, err := cl.DB(ctx, "tank/foo")
+		require.NoError(t, err)
+		assert.Len(t, db.Entries, 2, cl.Bucket())
+	}
+}
+
+func Test_Prune(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	z := fake.New(clock)
+
+	var cfg config.Config
+	m := &Manager{log: logr.Discard(), zfs: z}
+	setFilesystems := func(dbCadence *config.Cadence, force bool) {
+		m.filesystems = []config.Filesystem{
+			{Name: "tank/foo"},
+			{Name: "tank/db", Buckets: []string{"bucket-2"}, Cadence: dbCadence},
+		}
+		m.clients = nil
+		for _, bucket := range []string{"bucket-1", "bucket-2"} {
+			var filesystems []config.Filesystem
+			for _, fs := range m.filesystems {
+				if fs.HasBucket(bucket) {
+					filesystems = append(filesystems, fs)
+				}
+			}
+			be, err := srv.Backend(bucket)
+			require.NoError(t, err)
+			cl, err := client.New(client.Options{
+				Log:         logr.Discard(),
+				Filesystems: filesystems,
+				Cadence:     cfg.DefaultValues().Cadence,
+				Bucket:      config.Bucket{Name: bucket},
+				IO:          util.IO{Out: io.Discard, Err: io.Discard},
+				Backend:     be,
+				Force:       force,
+			})
+			require.NoError(t, err)
+			m.clients = append(m.clients, cl)
+		}
+	}
+	setFilesystems(nil, false)
+
+	z.Write("tank/foo", []byte("a"))
+	z.Write("tank/db", []byte("b"))
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeFull}))
+	clock.Step(time.Hour)
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeFull}))
+
+	pruned, err := m.Prune(ctx, PruneOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, pruned, "backups should be kept by the cadence")
+
+	// Shrink the tank/db cadence so that all but the latest full backup are
+	// older than every window.
+	var zero uint = 0
+	setFilesystems(&config.Cadence{
+		IncrementalPerLastFull: &zero,
+		Windows:                []backup.Window{{MaxAge: backup.Duration(time.Nanosecond), Keep: 1}},
+	}, true)
+
+	keys := srv.Keys("bucket-2")
+	pruned, err = m.Prune(ctx, PruneOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, "tank/db", pruned[0].Filesystem)
+	assert.Equal(t, "bucket-2", pruned[0].Bucket)
+	assert.Equal(t, 1, pruned[0].Entry.ID)
+	assert.Equal(t, keys, srv.Keys("bucket-2"), "dry run should not delete")
+
+	pruned, err = m.Prune(ctx, PruneOptions{Bucket: "bucket-1", DryRun: true})
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+	pruned, err = m.Prune(ctx, PruneOptions{Filesystem: "tank/foo", DryRun: true})
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+	_, err = m.Prune(ctx, PruneOptions{Bucket: "bucket-3"})
+	assert.Error(t, err, "bucket should not exist")
+	_, err = m.Prune(ctx, PruneOptions{Filesystem: "tank/bar"})
+	assert.Error(t, err, "filesystem should not exist")
+
+	pruned, err = m.Prune(ctx, PruneOptions{Filesystem: "tank/db", Bucket: "bucket-2"})
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, 1, pruned[0].Entry.ID)
+	assert.NotContains(t, srv.Keys("bucket-2"), pruned[0].Entry.S3Key)
+	assert.Len(t, srv.Keys("bucket-1"), 3, "tank/foo should be untouched")
+}
+
+func Test_Backup_GUIDMismatch(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	z := fake.New(clock)
+	m := newTestManager(t, srv, z, "bucket-1")
+
+	z.Write("tank/foo", []byte("a"))
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+
+	db, err := m.clients[0].DB(ctx, "tank/foo")
+	require.NoError(t, err)
+	require.Len(t, db.Entries, 1)
+	guid, err := z.GUID(ctx, logr.Discard(), "tank/foo#yazbu_2020-05-01_00-00-00")
+	require.NoError(t, err)
+	assert.Equal(t, guid, db.Entries[0].GUID)
+
+	// Replace the base with a different snapshot of the same name.
+	require.NoError(t, z.BookmarkDestroy(ctx, logr.Discard(), "tank/foo#yazbu_2020-05-01_00-00-00"))
+	require.NoError(t, z.Snapshot("tank/foo@yazbu_2020-05-01_00-00-00"))
+
+	clock.Step(time.Hour)
+	assert.Error(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}), "base with a different GUID should not be used")
+}
+
+func Test_Backup_SendFailure(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	z := fake.New(clock)
+	m := newTestManager(t, srv, z, "bucket-1", "bucket-2")
+
+	z.Write("tank/foo", []byte("a"))
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+
+	clock.Step(time.Hour)
+	z.Write("tank/foo", []byte("b"))
+	z.FailSend(errors.New("zfs send failed"))
+	assert.Error(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}), "truncated send stream should fail the backup")
+
+	for _, cl := range m.clients {
+		db, err := cl.DB(ctx, "tank/foo")
+		require.NoError(t, err)
+		assert.Len(t, db.Entries, 1, "%s: truncated backup should not be recorded", cl.Bucket())
+	}
+
+	_, err := m.PruneSnapshots(ctx, PruneSnapshotsOptions{})
+	require.NoError(t, err)
+	snapshots, err := z.SnapshotList(ctx, logr.Discard(), "tank/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tank/foo@yazbu_2020-05-01_01-00-00"}, snapshots, "snapshot of failed send should be kept")
+	bookmarks, err := z.BookmarkList(ctx, logr.Discard(), "tank/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tank/foo#yazbu_2020-05-01_00-00-00"}, bookmarks, "snapshot of failed send should not be bookmarked")
+
+	// The next backup is sent from the last successful backup.
+	clock.Step(time.Hour)
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+	require.NoError(t, m.Restore(ctx, RestoreOptions{Filesystem: "tank/foo", Dataset: "tank/bar"}))
+	data, ok := z.Data("tank/bar")
+	require.True(t, ok)
+	assert.Equal(t, "ab", string(data))
+}
+
+func Test_Backup_Filesystems(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+	z := newTestZFS()
+
+	var cfg config.Config
+	m := &Manager{
+		log: logr.Discard(),
+		filesystems: []config.Filesystem{
+			{Name: "tank/foo"},
+			{Name: "tank/db", Buckets: []string{"bucket-2"}, SnapshotPrefix: "db_", SendFlags: []string{"--compressed"}},
+		},
+		zfs: z,
+	}
+	for _, bucket := range []string{"bucket-1", "bucket-2"} {
+		var filesystems []config.Filesystem
+		for _, fs := range m.filesystems {
+			if fs.HasBucket(bucket) {
+				filesystems = append(filesystems, fs)
+			}
+		}
+		be, err := srv.Backend(bucket)
+		require.NoError(t, err)
+		cl, err := client.New(client.Options{
+			Log:         logr.Discard(),
+			Filesystems: filesystems,
+			Cadence:     cfg.DefaultValues().Cadence,
+			Bucket:      config.Bucket{Name: bucket},
+			IO:          util.IO{Out: io.Discard, Err: io.Discard},
+			Backend:     be,
+		})
+		require.NoError(t, err)
+		m.clients = append(m.clients, cl)
+	}
+
+	z.Write("tank/foo", []byte("a"))
+	z.Write("tank/db", []byte("b"))
+	assert.Error(t, m.Backup(ctx, BackupOptions{Mode: ModeFull, Filesystem: "tank/bar"}), "filesystem is not configured")
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeFull, Filesystem: "tank/db"}))
+	for _, send := range z.Sends() {
+		assert.Equal(t, "tank/db@db_2020-05-01_00-00-00", send.To, "only tank/db should be backed up")
+	}
+	require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeFull, Filesystem: "tank/foo"}))
+
+	assert.False(t, m.clients[0].HasFilesystem("tank/db"))
+	db, err := m.clients[1].DB(ctx, "tank/db")
+	require.NoError(t, err)
+	require.Len(t, db.Entries, 1)
+	assert.Equal(t, "tank/db/db_2020-05-01_00-00-00.full", db.Entries[0].S3Key)
+
+	var dbSends []fake.Send
+	for _, send := range z.Sends() {
+		if send.To == "tank/db@db_2020-05-01_00-00-00" {
+			dbSends = append(dbSends, send)
+		} else {
+			assert.Empty(t, send.Flags, send.To)
+		}
+	}
+	require.Len(t, dbSends, 1, "should only be sent to one bucket")
+	assert.Equal(t, []string{"--compressed"}, dbSends[0].Flags)
+
+	bookmarks, err := z.BookmarkList(ctx, logr.Discard(), "tank/db")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tank/db#db_2020-05-01_00-00-00"}, bookmarks)
+
+	results, err := m.Verify(ctx, VerifyOptions{All: true, ValidateStream: true})
+	require.NoError(t, err)
+	assert.Len(t, results, 3)
+	for _, r := range results {
+		assert.Equal(t, VerifyPass, r.Status, "%s: %s", r.Entry.S3Key, r.Error)
+	}
+
+	require.NoError(t, m.Restore(ctx, RestoreOptions{Filesystem: "tank/db", Dataset: "tank/db2"}))
+	data, ok := z.Data("tank/db2")
+	require.True(t, ok)
+	assert.Equal(t, "b", string(data))
+}
+
+func Test_Restore(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+
+	m := newTestManager(t, srv, newTestZFS(), "bucket-1", "bucket-2")
+	writeBackup(t, m, backup.TypeFull, "a", "", []byte("full"))
+	writeBackup(t, m, backup.TypeIncremental, "b", "tank/foo@a", []byte("inc-1"))
+	writeBackup(t, m, backup.TypeIncremental, "c", "tank/foo@b", []byte("inc-2"))
+
+	// Break the chain in the first bucket, so the second is restored from.
+	be, err := srv.Backend("bucket-1")
+	require.NoError(t, err)
+	require.NoError(t, be.Delete(ctx, "tank/foo/b.inc"))
+
+	tests := map[string]struct {
+		opts   RestoreOptions
+		exp    string
+		expErr bool
+	}{
+		"if no id, expect full chain to the latest entry": {
+			opts: RestoreOptions{Filesystem: "tank/foo"},
+			exp:  "fullinc-1inc-2",
+		},
+		"if id given, expect chain to that entry": {
+			opts: RestoreOptions{Filesystem: "tank/foo", ID: 2},
+			exp:  "fullinc-1",
+		},
+		"if bucket has a broken chain, expect error": {
+			opts:   RestoreOptions{Filesystem: "tank/foo", Bucket: "bucket-1"},
+			expErr: true,
+		},
+		"if both dataset and file are given, expect error": {
+			opts:   RestoreOptions{Filesystem: "tank/foo", Dataset: "tank/bar", File: "foo"},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if len(test.opts.Dataset) == 0 {
+				test.opts.File = filepath.Join(t.TempDir(), "restore")
+			}
+
+			err := m.Restore(ctx, test.opts)
+			assert.Equal(t, test.expErr, err != nil, "%v", err)
+			if test.expErr {
+				return
+			}
+
+			b, err := os.ReadFile(test.opts.File)
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, string(b))
+		})
+	}
+
+	err = m.Restore(ctx, RestoreOptions{Filesystem: "tank/bar", File: filepath.Join(t.TempDir(), "restore")})
+	assert.ErrorContains(t, err, `filesystem "tank/bar" is not configured`)
+
+	// Restoring on a host whose cadence differs from the remote, from a bucket
+	// after one with no database, should not need forcing, nor write a
+	// database.
+	fresh := &Manager{log: logr.Discard(), filesystems: m.filesystems, zfs: m.zfs}
+	for _, bucket := range []string{"bucket-3", "bucket-2"} {
+		fresh.clients = append(fresh.clients, newCadenceClient(t, srv, fresh.filesystems, bucket, 3))
+	}
+	file := filepath.Join(t.TempDir(), "restore")
+	require.NoError(t, fresh.Restore(ctx, RestoreOptions{Filesystem: "tank/foo", File: file}))
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "fullinc-1inc-2", string(b))
+	assert.Empty(t, srv.Keys("bucket-3"), "restore should not write a database")
+
+	// An object which does not match its recorded checksum should fail the
+	// restore.
+	srv.PutObject("bucket-2", "tank/foo/c.inc", []byte("inc-3"))
+	err = m.Restore(ctx, RestoreOptions{Filesystem: "tank/foo", Bucket: "bucket-2", File: filepath.Join(t.TempDir(), "restore")})
+	assert.ErrorIs(t, err, client.ErrChecksumMismatch)
+}
+
+func Test_Verify(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+
+	m := newTestManager(t, srv, newTestZFS(), "bucket-1", "bucket-2")
+	writeBackup(t, m, backup.TypeFull, "a", "", []byte("full"))
+	writeBackup(t, m, backup.TypeIncremental, "b", "tank/foo@a", []byte("inc"))
+	srv.PutObject("bucket-2", "tank/foo/b.inc", []byte("corrupt"))
+
+	results, err := m.Verify(ctx, VerifyOptions{All: true})
+	require.NoError(t, err)
+
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Bucket+"/"+r.Entry.S3Key+":"+string(r.Status))
+	}
+	assert.Equal(t, []string{
+		"bucket-1/tank/foo/a.full:pass",
+		"bucket-1/tank/foo/b.inc:pass",
+		"bucket-2/tank/foo/a.full:pass",
+		"bucket-2/tank/foo/b.inc:fail",
+	}, got)
+
+	results, err = m.Verify(ctx, VerifyOptions{Bucket: "bucket-1", Sample: 1})
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	_, err = m.Verify(ctx, VerifyOptions{Bucket: "bucket-3"})
+	assert.Error(t, err)
+	_, err = m.Verify(ctx, VerifyOptions{Filesystem: "tank/bar"})
+	assert.ErrorContains(t, err, `filesystem "tank/bar" is not configured`)
+
+	// Verifying on a host whose cadence differs from the remote should not
+	// need forcing, nor write a database to a bucket without one.
+	mismatched := &Manager{log: logr.Discard(), filesystems: m.filesystems, zfs: m.zfs}
+	for _, bucket := range []string{"bucket-1", "bucket-3"} {
+		mismatched.clients = append(mismatched.clients, newCadenceClient(t, srv, mismatched.filesystems, bucket, 3))
+	}
+	results, err = mismatched.Verify(ctx, VerifyOptions{All: true})
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.Empty(t, srv.Keys("bucket-3"), "verify should not write a database")
+}
+
+func Test_PruneSnapshots(t *testing.T) {
+	ctx := context.Background()
+	log := logr.Discard()
+
+	snapshots := func(t *testing.T, z *fake.ZFS) []string {
+		t.Helper()
+		s, err := z.SnapshotList(ctx, log, "tank/foo")
+		require.NoError(t, err)
+		return s
+	}
+
+	t.Run("after backup, only retained snapshots should be kept", func(t *testing.T) {
+		srv := fakes3.New()
+		defer srv.Close()
+		clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+		z := fake.New(clock)
+		m := newTestManager(t, srv, z, "bucket-1", "bucket-2")
+		m.snapshotRetain = 1
+
+		z.Write("tank/foo", []byte("a"))
+		require.NoError(t, z.Snapshot("tank/foo@manual"))
+		for i := 0; i < 4; i++ {
+			clock.Step(time.Hour)
+			require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+		}
+
+		assert.Equal(t, []string{
+			"tank/foo@manual",
+			"tank/foo@yazbu_2020-05-01_04-00-00",
+		}, snapshots(t, z))
+
+		// Retain an extra snapshot, so the previous incremental base is kept.
+		m.snapshotRetain = 2
+		clock.Step(time.Hour)
+		require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+		assert.Equal(t, []string{
+			"tank/foo@manual",
+			"tank/foo@yazbu_2020-05-01_04-00-00",
+			"tank/foo@yazbu_2020-05-01_05-00-00",
+		}, snapshots(t, z))
+	})
+
+	t.Run("snapshots not backed up to every bucket should be kept, and bookmarks used as bases", func(t *testing.T) {
+		srv := fakes3.New()
+		defer srv.Close()
+		clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+		z := fake.New(clock)
+		m := newTestManager(t, srv, z, "bucket-1", "bucket-2")
+
+		z.Write("tank/foo", []byte("a"))
+		require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+
+		srv.InjectFailure(fakes3.Failure{Op: fakes3.OpPutObject, Key: "bucket-2/tank/foo/backup.db"})
+		for i := 0; i < 2; i++ {
+			clock.Step(time.Hour)
+			require.Error(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental, ContinueOnError: true}))
+		}
+		srv.ClearFailures()
+
+		// bucket-2 has only backed up the first snapshot, which was destroyed
+		// after being bookmarked. The second snapshot is not the incremental
+		// base of either bucket, so only its bookmark is destroyed.
+		pruned, err := m.PruneSnapshots(ctx, PruneSnapshotsOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []PrunedSnapshot{
+			{Filesystem: "tank/foo", Snapshot: "tank/foo#yazbu_2020-05-01_01-00-00"},
+		}, pruned)
+		assert.Equal(t, []string{
+			"tank/foo@yazbu_2020-05-01_01-00-00",
+			"tank/foo@yazbu_2020-05-01_02-00-00",
+		}, snapshots(t, z))
+
+		clock.Step(time.Hour)
+		require.NoError(t, m.Backup(ctx, BackupOptions{Mode: ModeIncremental}))
+		assert.Empty(t, snapshots(t, z))
+
+		bookmarks, err := z.BookmarkList(ctx, log, "tank/foo")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"tank/foo#yazbu_2020-05-01_03-00-00"}, bookmarks)
+	})
+
+	t.Run("dry run should not destroy snapshots", func(t *testing.T) {
+		srv := fakes3.New()
+		defer srv.Close()
+		clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+		z := fake.New(clock)
+		m := newTestManager(t, srv, z, "bucket-1")
+
+		z.Write("tank/foo", []byte("a"))
+		_, _, err := z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+		require.NoError(t, err)
+		clock.Step(time.Hour)
+		writeBackup(t, m, backup.TypeFull, "yazbu_2020-05-01_01-00-00", "", []byte("a"))
+		_, _, err = z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+		require.NoError(t, err)
+
+		pruned, err := m.PruneSnapshots(ctx, PruneSnapshotsOptions{DryRun: true})
+		require.NoError(t, err)
+		assert.Equal(t, []PrunedSnapshot{
+			{Filesystem: "tank/foo", Snapshot: "tank/foo@yazbu_2020-05-01_00-00-00"},
+		}, pruned)
+		assert.Len(t, snapshots(t, z), 2)
+
+		_, err = m.PruneSnapshots(ctx, PruneSnapshotsOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"tank/foo@yazbu_2020-05-01_01-00-00"}, snapshots(t, z))
+	})
+}
+
+func Test_ListDBs(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+
+	m := newTestManager(t, srv, newTestZFS(), "bucket-1", "bucket-2")
+	writeBackup(t, m, backup.TypeFull, "a", "", []byte("full"))
+	writeBackup(t, m, backup.TypeIncremental, "b", "tank/foo@a", []byte("inc"))
+
+	fsDBs, err := m.ListDBs(ctx, ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, fsDBs["tank/foo"], 2)
+	assert.Equal(t, "bucket-1", fsDBs["tank/foo"][0].Bucket)
+	assert.Equal(t, "bucket-2", fsDBs["tank/foo"][1].Bucket)
+	assert.Equal(t, map[int]ChainPosition{1: {Base: 1}, 2: {Base: 1, Position: 1}}, fsDBs["tank/foo"][0].Chains)
+
+	fsDBs, err = m.ListDBs(ctx, ListOptions{Bucket: "bucket-2", Type: backup.TypeIncremental})
+	require.NoError(t, err)
+	require.Len(t, fsDBs["tank/foo"], 1)
+	assert.Equal(t, "bucket-2", fsDBs["tank/foo"][0].Bucket)
+	require.Len(t, fsDBs["tank/foo"][0].Entries, 1)
+	assert.Equal(t, 2, fsDBs["tank/foo"][0].Entries[0].ID)
+	assert.Equal(t, map[int]ChainPosition{2: {Base: 1, Position: 1}}, fsDBs["tank/foo"][0].Chains)
+
+	fsDBs, err = m.ListDBs(ctx, ListOptions{Filesystem: "tank/bar"})
+	require.NoError(t, err)
+	assert.Empty(t, fsDBs)
+
+	_, err = m.ListDBs(ctx, ListOptions{Bucket: "bucket-3"})
+	assert.Error(t, err)
+	_, err = m.ListDBs(ctx, ListOptions{Sort: "name"})
+	assert.Error(t, err)
+}
+
+func Test_listDB(t *testing.T) {
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	deleted := now
+	db := backup.DB{
+		Filesystem: "tank/foo",
+		Entries: []backup.Entry{
+			{ID: 1, Type: backup.TypeFull, Size: 100, Timestamp: now.Add(-time.Hour * 5), Deleted: &deleted},
+			{ID: 2, Parent: 1, Type: backup.TypeIncremental, Size: 10, Timestamp: now.Add(-time.Hour * 4)},
+			{ID: 3, Parent: 1, Type: backup.TypeFull, Size: 300, Timestamp: now.Add(-time.Hour * 3)},
+			{ID: 5, Parent: 4, Type: backup.TypeIncremental, Size: 30, Timestamp: now.Add(-time.Hour * 2)},
+			{ID: 4, Parent: 3, Type: backup.TypeIncremental, Size: 20, Timestamp: now.Add(-time.Hour)},
+		},
+	}
+
+	tests := map[string]struct {
+		opts      ListOptions
+		expIDs    []int
+		expChains map[int]ChainPosition
+	}{
+		"if no options, expect all entries in ID order": {
+			expIDs: []int{1, 2, 3, 4, 5},
+			expChains: map[int]ChainPosition{
+				1: {Position: -1}, 2: {Position: -1}, 3: {Base: 3}, 4: {Base: 3, Position: 1}, 5: {Base: 3, Position: 2},
+			},
+		},
+		"if type, expect only entries of the type": {
+			opts:      ListOptions{Type: backup.TypeFull},
+			expIDs:    []int{1, 3},
+			expChains: map[int]ChainPosition{1: {Position: -1}, 3: {Base: 3}},
+		},
+		"if since and until, expect only entries within the times": {
+			opts:   ListOptions{Since: now.Add(-time.Hour * 4), Until: now.Add(-time.Hour * 2)},
+			expIDs: []int{2, 3, 5},
+		},
+		"if latest, expect only the latest entries": {
+			opts:   ListOptions{Latest: 2},
+			expIDs: []int{4, 5},
+		},
+		"if sort by time, expect oldest first": {
+			opts:   ListOptions{Sort: ListSortTime},
+			expIDs: []int{1, 2, 3, 5, 4},
+		},
+		"if sort by size with latest, expect largest of the latest first": {
+			opts:   ListOptions{Sort: ListSortSize, Latest: 3},
+			expIDs: []int{3, 5, 4},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			listed := listDB(db, test.opts)
+			var ids []int
+			for _, entry := range listed.Entries {
+				ids = append(ids, entry.ID)
+			}
+			assert.Equal(t, test.expIDs, ids)
+			assert.Len(t, listed.Chains, len(test.expIDs))
+			if test.expChains != nil {
+				assert.Equal(t, test.expChains, listed.Chains)
+			}
+			assert.Len(t, db.Entries, 5, "database should not be modified")
+		})
+	}
+}
+
+func Test_Status(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New()
+	defer srv.Close()
+
+	m := newTestManager(t, srv, newTestZFS(), "bucket-1", "bucket-2", "bucket-3")
+	writeBackup(t, m, backup.TypeFull, "a", "", []byte("full"))
+
+	// The incremental in the third bucket disagrees, and the next incremental
+	// is only written to the first bucket.
+	for i, cl := range m.clients {
+		data := []byte("inc")
+		if i == 2 {
+			data = []byte("corrupt")
+		}
+		require.NoError(t, cl.BackupWrite(ctx, client.Backup{
+			Filesystem: "tank/foo", Type: backup.TypeIncremental, Key: "tank/foo/b.inc",
+			Snapshot: "tank/foo@b", From: "tank/foo@a", Size: uint64(len(data)),
+			Reader: func(context.Context, logr.Logger) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(data)), nil
+			},
+		}))
+	}
+	require.NoError(t, m.clients[0].BackupWrite(ctx, client.Backup{
+		Filesystem: "tank/foo", Type: backup.TypeIncremental, Key: "tank/foo/c.inc",
+		Snapshot: "tank/foo@c", From: "tank/foo@b", Size: 3,
+		Reader: func(context.Context, logr.Logger) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("inc"))), nil
+		},
+	}))
+
+	// The fourth bucket has a different cadence, and has only written the
+	// full backup, later than the other buckets. The fifth bucket has no
+	// database.
+	for _, bucket := range []string{"bucket-4", "bucket-5"} {
+		m.clients = append(m.clients, newCadenceClient(t, srv, m.filesystems, bucket, 3))
+	}
+	require.NoError(t, m.clients[3].BackupWrite(ctx, client.Backup{
+		Filesystem: "tank/foo", Type: backup.TypeFull, Key: "tank/foo/a.full",
+		Snapshot: "tank/foo@a", Size: 4,
+		Reader: func(context.Context, logr.Logger) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("full"))), nil
+		},
+	}))
+
+	// Databases are read without checking their cadence against the local
+	// cadence, and are never written.
+	statuses, err := m.Status(ctx, StatusOptions{})
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.Empty(t, srv.Keys("bucket-5"), "status should not write a database")
+
+	status := statuses[0]
+	assert.Equal(t, "tank/foo", status.Filesystem)
+	assert.Equal(t, 5, status.Buckets)
+	assert.Equal(t, "tank/foo@c", status.Latest)
+	assert.Equal(t, 1, status.Redundancy)
+	assert.Equal(t, 1, status.MinRedundancy)
+	assert.False(t, status.Degraded())
+
+	var got []string
+	for _, issue := range status.Issues {
+		got = append(got, fmt.Sprintf("%s/%d/%s:%s", issue.Bucket, issue.ID, issue.Snapshot, issue.Kind))
+	}
+	assert.Equal(t, []string{
+		"bucket-2/0/tank/foo@c:missing-backup",
+		"bucket-3/2/tank/foo@b:size-mismatch",
+		"bucket-3/2/tank/foo@b:checksum-mismatch",
+		"bucket-3/0/tank/foo@c:missing-backup",
+		"bucket-4/0/:cadence-mismatch",
+		"bucket-4/0/tank/foo@b:missing-backup",
+		"bucket-4/0/tank/foo@c:missing-backup",
+		"bucket-5/0/tank/foo@a:missing-backup",
+		"bucket-5/0/tank/foo@b:missing-backup",
+		"bucket-5/0/tank/foo@c:missing-backup",
+	}, got)
+
+	m.minRedundancy = map[string]uint{"tank/foo": 2}
+	statuses, err = m.Status(ctx, StatusOptions{Filesystem: "tank/foo"})
+	require.NoError(t, err)
+	assert.True(t, statuses[0].Degraded())
+
+	_, err = m.Status(ctx, StatusOptions{Filesystem: "tank/bar"})
+	assert.Error(t, err)
+}
+
+func Test_compareDBs(t *testing.T) {
+	srv := fakes3.New()
+	defer srv.Close()
+	m := newTestManager(t, srv, newTestZFS(), "bucket-1", "bucket-2")
+
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(id, parent int, typ backup.Type, snapshot string, guid uint64, age time.Duration) backup.Entry {
+		return backup.Entry{
+			ID: id, Parent: parent, Type: typ, Snapshot: snapshot, GUID: guid,
+			S3Key: "tank/foo/" + snapshotName(snapshot) + "." + string(typ), Size: 10,
+			Timestamp: now.Add(-age),
+		}
+	}
+
+	// bucket-2 consumed an extra ID for a write which failed, so its IDs are
+	// one ahead of bucket-1, and it holds a full backup of the snapshot
+	// bucket-1 holds an incremental of.
+	dbs := []bucketDB{
+		{cl: m.clients[0], db: backup.DB{Entries: []backup.Entry{
+			entry(1, 0, backup.TypeFull, "tank/foo@a", 1, time.Hour*3),
+			entry(2, 1, backup.TypeIncremental, "tank/foo@b", 2, time.Hour*2),
+			entry(3, 2, backup.TypeIncremental, "tank/foo@c", 3, time.Hour),
+		}}},
+		{cl: m.clients[1], db: backup.DB{Entries: []backup.Entry{
+			entry(1, 0, backup.TypeFull, "tank/foo@a", 1, time.Hour*3),
+			entry(3, 0, backup.TypeFull, "tank/foo@b", 2, time.Hour*2),
+			entry(4, 3, backup.TypeIncremental, "tank/foo@c", 3, time.Hour),
+		}}},
+	}
+	dbs[1].db.Entries[1].Size = 20
+
+	status := compareDBs("tank/foo", dbs)
+	assert.Empty(t, status.Issues)
+	assert.Equal(t, "tank/foo@c", status.Latest)
+	assert.Equal(t, 2, status.Redundancy)
+
+	// The latest backup is determined by snapshot, not the highest ID.
+	dbs[1].db.Entries = dbs[1].db.Entries[:2]
+	status = compareDBs("tank/foo", dbs)
+	assert.Equal(t, "tank/foo@c", status.Latest)
+	assert.Equal(t, 1, status.Redundancy)
+	require.Len(t, status.Issues, 1)
+	assert.Equal(t, StatusIssue{
+		Kind: IssueMissingBackup, Endpoint: m.clients[1].Endpoint(), Bucket: "bucket-2", Snapshot: "tank/foo@c",
+		Message: `inc backup "tank/foo/c.inc" exists in bucket "bucket-1"`,
+	}, status.Issues[0])
+
+	// A snapshot recreated with the same name diverges.
+	dbs[1].db.Entries = append(dbs[1].db.Entries, entry(4, 3, backup.TypeIncremental, "tank/foo@c", 4, time.Hour))
+	status = compareDBs("tank/foo", dbs)
+	assert.Equal(t, 1, status.Redundancy)
+	require.Len(t, status.Issues, 1)
+	assert.Equal(t, IssueDivergent, status.Issues[0].Kind)
+	assert.Equal(t, 4, status.Issues[0].ID)
+
+	// Backups written before snapshots were recorded are matched by ID.
+	legacy := func(id, parent int, typ backup.Type, age time.Duration) backup.Entry {
+		e := entry(id, parent, typ, "", 0, age)
+		e.S3Key = fmt.Sprintf("tank/foo/legacy-%d.%s", id, typ)
+		return e
+	}
+	dbs[0].db.Entries = []backup.Entry{legacy(1, 0, backup.TypeFull, time.Hour*2), legacy(2, 1, backup.TypeIncremental, time.Hour)}
+	dbs[1].db.Entries = []backup.Entry{legacy(1, 0, backup.TypeFull, time.Hour*2), legacy(2, 0, backup.TypeFull, time.Hour)}
+	status = compareDBs("tank/foo", dbs)
+	assert.Equal(t, "tank/foo@legacy-2", status.Latest)
+	assert.Equal(t, 1, status.Redundancy)
+	require.Len(t, status.Issues, 1)
+	assert.Equal(t, IssueDivergent, status.Issues[0].Kind)
+	assert.Equal(t, 2, status.Issues[0].ID)
+}
@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/client"
+)
+
+// PruneOptions are the options for pruning backups.
+type PruneOptions struct {
+	// Filesystem limits pruning to the filesystem. If empty, all filesystems
+	// are pruned.
+	Filesystem string
+
+	// Bucket limits pruning to the bucket with the name. If empty, all buckets
+	// are pruned.
+	Bucket string
+
+	// DryRun returns the backups which would be deleted, without deleting
+	// them.
+	DryRun bool
+}
+
+// PrunedBackup is a backup which was, or would be, deleted from a bucket.
+type PrunedBackup struct {
+	// Filesystem is the filesystem of the backup.
+	Filesystem string
+
+	// Endpoint is the S3 endpoint of the bucket.
+	Endpoint string
+
+	// Bucket is the bucket the backup was deleted from.
+	Bucket string
+
+	// Entry is the deleted database entry.
+	Entry backup.Entry
+}
+
+// Prune deletes the backups of every filesystem in every bucket which need to
+// be deleted according to the cadence, without writing a new backup. Backups
+// are otherwise only deleted once a new backup has been written, so are never
+// deleted while backups are failing, or after the cadence is changed.
+func (m *Manager) Prune(ctx context.Context, opts PruneOptions) ([]PrunedBackup, error) {
+	filesystems, err := m.filesystemsFor(opts.Filesystem)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		pruned []PrunedBackup
+		errs   []string
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		found  bool
+	)
+
+	for _, cl := range m.clients {
+		if len(opts.Bucket) > 0 && cl.Bucket() != opts.Bucket {
+			continue
+		}
+		found = true
+
+		wg.Add(1)
+		go func(cl *client.Client) {
+			defer wg.Done()
+
+			for _, fs := range filesystems {
+				if !cl.HasFilesystem(fs.Name) {
+					continue
+				}
+
+				entries, err := cl.Prune(ctx, fs.Name, opts.DryRun)
+				lock.Lock()
+				for _, entry := range entries {
+					pruned = append(pruned, PrunedBackup{
+						Filesystem: fs.Name,
+						Endpoint:   cl.Endpoint(),
+						Bucket:     cl.Bucket(),
+						Entry:      entry,
+					})
+				}
+				if err != nil {
+					errs = append(errs, err.Error())
+				}
+				lock.Unlock()
+			}
+		}(cl)
+	}
+	wg.Wait()
+
+	if !found {
+		return nil, fmt.Errorf("no bucket configured with name %q", opts.Bucket)
+	}
+
+	order := make(map[string]int)
+	for i, fs := range m.filesystemNames() {
+		order[fs] = i
+	}
+	sort.SliceStable(pruned, func(i, j int) bool {
+		if pruned[i].Filesystem != pruned[j].Filesystem {
+			return order[pruned[i].Filesystem] < order[pruned[j].Filesystem]
+		}
+		if pruned[i].Endpoint != pruned[j].Endpoint {
+			return pruned[i].Endpoint < pruned[j].Endpoint
+		}
+		if pruned[i].Bucket != pruned[j].Bucket {
+			return pruned[i].Bucket < pruned[j].Bucket
+		}
+		return pruned[i].Entry.ID < pruned[j].Entry.ID
+	})
+
+	if len(errs) > 0 {
+		return pruned, fmt.Errorf("prune: [%s]", strings.Join(errs, ", "))
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/client"
+)
+
+// RestoreOptions are the options for restoring a backup.
+type RestoreOptions struct {
+	// Filesystem is the filesystem whose backup is restored.
+	Filesystem string
+
+	// ID is the ID of the entry to restore. If 0, the latest entry is restored.
+	ID int
+
+	// Bucket is the name of the bucket to restore from. If empty, the first
+	// bucket which holds a valid chain for the entry is used.
+	Bucket string
+
+	// Dataset is the ZFS dataset to receive the backup into. Mutually exclusive
+	// with File.
+	Dataset string
+
+	// File is the path to a file which the backup streams are written to, in
+	// order. Mutually exclusive with Dataset.
+	File string
+}
+
+// Restore restores the backup chain for the filesystem from a bucket, either
+// into a ZFS dataset, or a file.
+func (m *Manager) Restore(ctx context.Context, opts RestoreOptions) error {
+	if (len(opts.Dataset) == 0) == (len(opts.File) == 0) {
+		return errors.New("exactly one of a dataset or file must be given to restore to")
+	}
+
+	cl, chain, err := m.restoreChain(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, len(chain))
+	for i, entry := range chain {
+		ids[i] = fmt.Sprintf("%d", entry.ID)
+	}
+	log := m.log.WithValues("filesystem", opts.Filesystem, "bucket", cl.Bucket(), "chain", strings.Join(ids, ","))
+	log.Info("restoring backup")
+
+	var out io.Writer
+	if len(opts.File) > 0 {
+		f, err := os.OpenFile(opts.File, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create restore file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	for _, entry := range chain {
+		if err := m.restoreEntry(ctx, cl, opts, entry, out); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreEntry restores a single entry of a chain, either into the dataset or
+// by writing to out.
+func (m *Manager) restoreEntry(ctx context.Context, cl *client.Client, opts RestoreOptions, entry backup.Entry, out io.Writer) error {
+	rc, err := cl.Read(ctx, opts.Filesystem, entry)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	r := client.VerifyReader(rc, entry)
+
+	if out != nil {
+		if _, err := io.Copy(out, r); err != nil {
+			return fmt.Errorf("failed to write entry %d to file: %w", entry.ID, err)
+		}
+		return nil
+	}
+
+	if err := m.zfs.Receive(ctx, m.log, opts.Dataset, r); err != nil {
+		return fmt.Errorf("failed to restore entry %d: %w", entry.ID, err)
+	}
+
+	// zfs receive may stop reading at the end of the send stream, so read
+	// the remainder to check the whole object against its checksum.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("failed to restore entry %d: %w", entry.ID, err)
+	}
+
+	return nil
+}
+
+// restoreChain returns the client and chain of entries to restore.
+func (m *Manager) restoreChain(ctx context.Context, opts RestoreOptions) (*client.Client, []backup.Entry, error) {
+	if _, err := m.filesystemsFor(opts.Filesystem); err != nil {
+		return nil, nil, err
+	}
+
+	var errs []string
+	for _, cl := range m.clientsFor(opts.Filesystem) {
+		if len(opts.Bucket) > 0 && cl.Bucket() != opts.Bucket {
+			continue
+		}
+
+		chain, err := cl.Chain(ctx, opts.Filesystem, opts.ID)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		return cl, chain, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("no bucket configured with name %q", opts.Bucket)
+	}
+
+	return nil, nil, fmt.Errorf("no valid backup chain to restore: [%s]", strings.Join(errs, ", "))
+}
@@ -0,0 +1,188 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/zfs"
+)
+
+// PruneSnapshotsOptions are the options for pruning local snapshots.
+type PruneSnapshotsOptions struct {
+	// DryRun returns the snapshots which would be destroyed, without
+	// destroying them.
+	DryRun bool
+}
+
+// PrunedSnapshot is a local snapshot or bookmark which was, or would be,
+// destroyed.
+type PrunedSnapshot struct {
+	// Filesystem is the filesystem of the snapshot.
+	Filesystem string
+
+	// Snapshot is the full name of the snapshot or bookmark.
+	Snapshot string
+}
+
+// PruneSnapshots destroys the local snapshots and bookmarks created by yazbu
+// which are no longer needed, for all filesystems. A snapshot is kept if it is
+// within the configured local retention, is not yet covered by a backup in
+// every bucket, or is the incremental base of a bucket and has no bookmark. A
+// bookmark is kept if it is the incremental base of a bucket. Snapshots and
+// bookmarks not created by yazbu are never destroyed.
+func (m *Manager) PruneSnapshots(ctx context.Context, opts PruneSnapshotsOptions) ([]PrunedSnapshot, error) {
+	var (
+		pruned []PrunedSnapshot
+		errs   []string
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+	)
+
+	wg.Add(len(m.filesystems))
+	for _, fs := range m.filesystems {
+		go func(fs config.Filesystem) {
+			defer wg.Done()
+
+			p, err := m.pruneSnapshotsFS(ctx, fs, opts.DryRun)
+			lock.Lock()
+			defer lock.Unlock()
+			pruned = append(pruned, p...)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}(fs)
+	}
+	wg.Wait()
+
+	sortPruned(pruned, m.filesystemNames())
+
+	if len(errs) > 0 {
+		return pruned, fmt.Errorf("prune snapshots: [%s]", strings.Join(errs, ", "))
+	}
+
+	return pruned, nil
+}
+
+// pruneSnapshotsFS destroys the unneeded local snapshots and bookmarks of the
+// given filesystem, returning those which were destroyed.
+func (m *Manager) pruneSnapshotsFS(ctx context.Context, fs config.Filesystem, dryRun bool) ([]PrunedSnapshot, error) {
+	names, err := m.prunableSnapshots(ctx, fs)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", fs.Name, err)
+	}
+
+	var pruned []PrunedSnapshot
+	for _, name := range names {
+		switch {
+		case dryRun:
+			m.log.Info("would destroy", "name", name)
+		case strings.Contains(name, "#"):
+			err = m.zfs.BookmarkDestroy(ctx, m.log, name)
+		default:
+			err = m.zfs.SnapshotDestroy(ctx, m.log, name)
+		}
+		if err != nil {
+			return pruned, fmt.Errorf("%q: %w", fs.Name, err)
+		}
+		pruned = append(pruned, PrunedSnapshot{Filesystem: fs.Name, Snapshot: name})
+	}
+
+	return pruned, nil
+}
+
+// prunableSnapshots returns the local yazbu snapshots, then bookmarks, of the
+// filesystem which can be destroyed, oldest first. Only snapshots and
+// bookmarks with the filesystem's snapshot prefix are considered.
+func (m *Manager) prunableSnapshots(ctx context.Context, fs config.Filesystem) ([]string, error) {
+	clients := m.clientsFor(fs.Name)
+	if len(clients) == 0 {
+		return nil, nil
+	}
+	prefix := snapshotPrefix(fs)
+
+	// Snapshots and bookmarks are listed before reading the databases, so
+	// that any created by a concurrent backup are newer than the databases.
+	snapshots, err := m.zfs.SnapshotList(ctx, m.log, fs.Name)
+	if err != nil {
+		return nil, err
+	}
+	bookmarks, err := m.zfs.BookmarkList(ctx, m.log, fs.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	bookmarked := make(map[string]bool)
+	for _, bookmark := range bookmarks {
+		bookmarked[snapshotName(bookmark)] = true
+	}
+
+	// yazbu snapshot names are ordered by the time they were created. Only
+	// snapshots at or before the latest backup of every bucket are covered by
+	// all buckets.
+	var covered string
+	bases := make(map[string]bool)
+	for _, cl := range clients {
+		db, err := cl.DB(ctx, fs.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", cl.Bucket(), err)
+		}
+
+		latest, ok := db.Latest()
+		if !ok {
+			return nil, nil
+		}
+
+		base := snapshotName(latest.SnapshotName(fs.Name))
+		bases[base] = true
+		if len(covered) == 0 || base < covered {
+			covered = base
+		}
+	}
+
+	var managed []string
+	for _, snapshot := range snapshots {
+		if zfs.Managed(snapshot, prefix) {
+			managed = append(managed, snapshot)
+		}
+	}
+	retained := len(managed) - int(m.snapshotRetain)
+
+	var prunable []string
+	for i, snapshot := range managed {
+		name := snapshotName(snapshot)
+		if name > covered || i >= retained || (bases[name] && !bookmarked[name]) {
+			continue
+		}
+		prunable = append(prunable, snapshot)
+	}
+
+	for _, bookmark := range bookmarks {
+		if zfs.Managed(bookmark, prefix) && !bases[snapshotName(bookmark)] {
+			prunable = append(prunable, bookmark)
+		}
+	}
+
+	return prunable, nil
+}
+
+// snapshotName returns the name of the snapshot or bookmark, without the
+// filesystem.
+func snapshotName(name string) string {
+	return name[strings.IndexAny(name, "@#")+1:]
+}
+
+// sortPruned sorts the pruned snapshots by the order of the given
+// filesystems, retaining the order of snapshots within each filesystem.
+func sortPruned(pruned []PrunedSnapshot, filesystems []string) {
+	order := make(map[string]int, len(filesystems))
+	for i, fs := range filesystems {
+		order[fs] = i
+	}
+	sort.SliceStable(pruned, func(i, j int) bool {
+		return order[pruned[i].Filesystem] < order[pruned[j].Filesystem]
+	})
+}
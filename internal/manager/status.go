@@ -0,0 +1,368 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/joshvanl/yazbu/config"
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/client"
+)
+
+// IssueKind is the kind of an inconsistency between the databases of a
+// filesystem in each bucket.
+type IssueKind string
+
+const (
+	// IssueUnreadable is a database which could not be read.
+	IssueUnreadable IssueKind = "unreadable"
+
+	// IssueMissingBackup is a backup which exists in another bucket, but not
+	// this one.
+	IssueMissingBackup IssueKind = "missing-backup"
+
+	// IssueDivergent is a backup whose snapshot GUID differs from the backup
+	// of the same snapshot in another bucket. Backups written before
+	// snapshots were recorded are divergent if their type or parent differs
+	// from the backup of the same ID.
+	IssueDivergent IssueKind = "divergent"
+
+	// IssueCadenceMismatch is a database whose cadence differs from the
+	// database in another bucket. Only databases holding backups are
+	// compared, as empty databases may have no cadence.
+	IssueCadenceMismatch IssueKind = "cadence-mismatch"
+
+	// IssueSizeMismatch is a backup whose size differs from the backup of the
+	// same snapshot and base in another bucket.
+	IssueSizeMismatch IssueKind = "size-mismatch"
+
+	// IssueChecksumMismatch is a backup whose checksum differs from the backup
+	// of the same snapshot and base in another bucket.
+	IssueChecksumMismatch IssueKind = "checksum-mismatch"
+)
+
+// StatusOptions are the options for checking the consistency of databases.
+type StatusOptions struct {
+	// Filesystem limits the check to the filesystem. If empty, all
+	// filesystems are checked.
+	Filesystem string
+}
+
+// StatusIssue is an inconsistency of the database of a filesystem in a bucket.
+type StatusIssue struct {
+	// Kind is the kind of the inconsistency.
+	Kind IssueKind `json:"kind" yaml:"kind"`
+
+	// Endpoint is the S3 endpoint of the bucket.
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+
+	// Bucket is the bucket of the inconsistent database.
+	Bucket string `json:"bucket" yaml:"bucket"`
+
+	// ID is the ID of the inconsistent backup in the bucket. 0 if the backup
+	// is missing from the bucket, or the inconsistency is of the database.
+	ID int `json:"id,omitempty" yaml:"id,omitempty"`
+
+	// Snapshot is the snapshot of the inconsistent backup. Empty if the
+	// inconsistency is of the database.
+	Snapshot string `json:"snapshot,omitempty" yaml:"snapshot,omitempty"`
+
+	// Message describes the inconsistency.
+	Message string `json:"message" yaml:"message"`
+}
+
+// FilesystemStatus is the consistency of the databases of a filesystem in
+// each bucket it is backed up to. Backups are matched across buckets by their
+// snapshot, and compared against the first bucket, in configured order, which
+// holds the same backup or database.
+type FilesystemStatus struct {
+	// Filesystem is the name of the filesystem.
+	Filesystem string `json:"filesystem" yaml:"filesystem"`
+
+	// Buckets is the number of buckets the filesystem is backed up to.
+	Buckets int `json:"buckets" yaml:"buckets"`
+
+	// Latest is the snapshot of the latest backup in any bucket: the most
+	// recently written backup which is not followed by another backup in any
+	// bucket. Empty if there are no backups.
+	Latest string `json:"latest,omitempty" yaml:"latest,omitempty"`
+
+	// Redundancy is the number of buckets holding a restorable copy of the
+	// latest backup, where every backup of its restore chain is consistent
+	// with the other buckets.
+	Redundancy int `json:"redundancy" yaml:"redundancy"`
+
+	// MinRedundancy is the configured minimum redundancy.
+	MinRedundancy int `json:"minRedundancy" yaml:"minRedundancy"`
+
+	// Issues are the inconsistencies between the databases.
+	Issues []StatusIssue `json:"issues" yaml:"issues"`
+}
+
+// Degraded returns true if the redundancy is below the minimum.
+func (s FilesystemStatus) Degraded() bool {
+	return s.Redundancy < s.MinRedundancy
+}
+
+// bucketDB is the database of a filesystem in a bucket.
+type bucketDB struct {
+	cl  *client.Client
+	db  backup.DB
+	err error
+}
+
+// Status compares the databases of each filesystem across every bucket it is
+// backed up to, reporting missing backups, divergent backups, cadence
+// mismatches and size or checksum disagreements, along with the redundancy of
+// the latest backup. Databases which cannot be read are reported as issues
+// rather than errors.
+func (m *Manager) Status(ctx context.Context, opts StatusOptions) ([]FilesystemStatus, error) {
+	filesystems, err := m.filesystemsFor(opts.Filesystem)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg  sync.WaitGroup
+		dbs = make([][]bucketDB, len(filesystems))
+	)
+
+	for i, fs := range filesystems {
+		clients := m.clientsFor(fs.Name)
+		dbs[i] = make([]bucketDB, len(clients))
+		for j, cl := range clients {
+			wg.Add(1)
+			go func(i, j int, fs string, cl *client.Client) {
+				defer wg.Done()
+				db, err := cl.DB(ctx, fs)
+				dbs[i][j] = bucketDB{cl: cl, db: db, err: err}
+			}(i, j, fs.Name, cl)
+		}
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]FilesystemStatus, len(filesystems))
+	for i, fs := range filesystems {
+		statuses[i] = compareDBs(fs.Name, dbs[i])
+		statuses[i].MinRedundancy = int(m.minRedundancyOf(fs.Name))
+	}
+
+	return statuses, nil
+}
+
+// backupKey identifies a backup across the databases of a filesystem. IDs are
+// allocated by each database, so differ between buckets once a write to one
+// bucket has failed. Backups are instead identified by their snapshot, falling
+// back to their ID for backups written before snapshots were recorded.
+type backupKey struct {
+	snapshot string
+	id       int
+}
+
+// keyOf returns the key of the backup.
+func keyOf(entry backup.Entry) backupKey {
+	if len(entry.Snapshot) > 0 {
+		return backupKey{snapshot: entry.Snapshot}
+	}
+	return backupKey{id: entry.ID}
+}
+
+// compareDBs compares the databases of the filesystem in each bucket.
+func compareDBs(filesystem string, dbs []bucketDB) FilesystemStatus {
+	status := FilesystemStatus{
+		Filesystem: filesystem,
+		Buckets:    len(dbs),
+		Issues:     []StatusIssue{},
+	}
+
+	addIssue := func(b bucketDB, kind IssueKind, id int, snapshot string, format string, args ...interface{}) {
+		status.Issues = append(status.Issues, StatusIssue{
+			Kind:     kind,
+			Endpoint: b.cl.Endpoint(),
+			Bucket:   b.cl.Bucket(),
+			ID:       id,
+			Snapshot: snapshot,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	// reference is the first readable database holding each backup, byKey the
+	// backups of each database, byID the keys of the backups of each database
+	// indexed by ID, superseded the backups which are followed by another
+	// backup in any database, and cadence the first readable database holding
+	// backups.
+	var (
+		reference  = make(map[backupKey]int)
+		byKey      = make([]map[backupKey]backup.Entry, len(dbs))
+		byID       = make([]map[int]backupKey, len(dbs))
+		superseded = make(map[backupKey]bool)
+		cadence    = -1
+	)
+	for i, b := range dbs {
+		if b.err != nil {
+			addIssue(b, IssueUnreadable, 0, "", "failed to read database: %s", b.err)
+			continue
+		}
+
+		if cadence < 0 && len(b.db.Entries) > 0 {
+			cadence = i
+		}
+
+		byKey[i] = make(map[backupKey]backup.Entry, len(b.db.Entries))
+		byID[i] = make(map[int]backupKey, len(b.db.Entries))
+		for j, entry := range b.db.Entries {
+			key := keyOf(entry)
+			byKey[i][key] = entry
+			byID[i][entry.ID] = key
+			if _, ok := reference[key]; !ok {
+				reference[key] = i
+			}
+			if j < len(b.db.Entries)-1 {
+				superseded[key] = true
+			}
+		}
+	}
+
+	// Backups are compared in the order they were written to their reference
+	// database.
+	keys := make([]backupKey, 0, len(reference))
+	for key := range reference {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ti, tj := byKey[reference[keys[i]]][keys[i]].Timestamp, byKey[reference[keys[j]]][keys[j]].Timestamp
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		if keys[i].snapshot != keys[j].snapshot {
+			return keys[i].snapshot < keys[j].snapshot
+		}
+		return keys[i].id < keys[j].id
+	})
+
+	// A bucket which is catching up may have written an older backup more
+	// recently, so only backups which are not superseded in any bucket are
+	// considered the latest.
+	var latest *backup.Entry
+	for _, key := range keys {
+		if ref := byKey[reference[key]][key]; !superseded[key] {
+			latest = &ref
+		}
+	}
+	if latest != nil {
+		status.Latest = latest.SnapshotName(filesystem)
+	}
+
+	for i, b := range dbs {
+		if b.err != nil {
+			continue
+		}
+
+		if len(b.db.Entries) > 0 {
+			if ref := dbs[cadence]; !b.db.Cadence.Equal(ref.db.Cadence) {
+				addIssue(b, IssueCadenceMismatch, 0, "", "cadence %s differs from %s in bucket %q",
+					b.db.Cadence.ToJSON(), ref.db.Cadence.ToJSON(), ref.cl.Bucket())
+			}
+		}
+
+		// consistent is false for backups which are missing or disagree with
+		// the reference.
+		consistent := make(map[backupKey]bool, len(keys))
+		for _, key := range keys {
+			r := reference[key]
+			ref := byKey[r][key]
+
+			entry, ok := byKey[i][key]
+			if !ok {
+				addIssue(b, IssueMissingBackup, 0, ref.SnapshotName(filesystem), "%s backup %q exists in bucket %q", ref.Type, ref.S3Key, dbs[r].cl.Bucket())
+				continue
+			}
+
+			if r == i {
+				consistent[key] = true
+				continue
+			}
+
+			sameStream := entry.Type == ref.Type && byID[i][entry.Parent] == byID[r][ref.Parent]
+			issues := compareEntries(entry, ref, sameStream)
+			for _, kind := range []IssueKind{IssueDivergent, IssueSizeMismatch, IssueChecksumMismatch} {
+				if msg, ok := issues[kind]; ok {
+					addIssue(b, kind, entry.ID, entry.SnapshotName(filesystem), "%s bucket %q", msg, dbs[r].cl.Bucket())
+				}
+			}
+			consistent[key] = len(issues) == 0
+		}
+
+		if latest == nil {
+			continue
+		}
+		entry, ok := byKey[i][keyOf(*latest)]
+		if !ok {
+			continue
+		}
+		chain, err := b.db.Chain(entry.ID)
+		if err != nil {
+			continue
+		}
+		redundant := true
+		for _, entry := range chain {
+			redundant = redundant && consistent[keyOf(entry)]
+		}
+		if redundant {
+			status.Redundancy++
+		}
+	}
+
+	return status
+}
+
+// compareEntries returns messages describing how the entry disagrees with the
+// reference entry of the same backup, indexed by issue kind. Sizes and
+// checksums are only compared if both entries were sent from the same base,
+// so are the same stream. Buckets may hold different backup types of the
+// same snapshot, but backups written before snapshots were recorded are
+// matched by ID, so must agree on their type and parent. Fields which were
+// not recorded by either entry are not compared.
+func compareEntries(entry, ref backup.Entry, sameStream bool) map[IssueKind]string {
+	issues := make(map[IssueKind]string)
+
+	switch {
+	case len(entry.Snapshot) == 0 && entry.Type != ref.Type:
+		issues[IssueDivergent] = fmt.Sprintf("type %q differs from %q in", entry.Type, ref.Type)
+	case len(entry.Snapshot) == 0 && entry.Parent != ref.Parent:
+		issues[IssueDivergent] = fmt.Sprintf("parent %d differs from %d in", entry.Parent, ref.Parent)
+	case entry.GUID != 0 && ref.GUID != 0 && entry.GUID != ref.GUID:
+		issues[IssueDivergent] = fmt.Sprintf("snapshot guid %d differs from %d in", entry.GUID, ref.GUID)
+	}
+
+	if !sameStream {
+		return issues
+	}
+
+	switch {
+	case entry.Size != ref.Size:
+		issues[IssueSizeMismatch] = fmt.Sprintf("size %d differs from %d in", entry.Size, ref.Size)
+	case entry.StreamSize != 0 && ref.StreamSize != 0 && entry.StreamSize != ref.StreamSize:
+		issues[IssueSizeMismatch] = fmt.Sprintf("stream size %d differs from %d in", entry.StreamSize, ref.StreamSize)
+	}
+
+	if len(entry.SHA256) > 0 && len(ref.SHA256) > 0 && entry.SHA256 != ref.SHA256 {
+		issues[IssueChecksumMismatch] = fmt.Sprintf("checksum %s differs from %s in", entry.SHA256, ref.SHA256)
+	}
+
+	return issues
+}
+
+// minRedundancyOf returns the minimum redundancy of the filesystem.
+func (m *Manager) minRedundancyOf(filesystem string) uint {
+	if min, ok := m.minRedundancy[filesystem]; ok {
+		return min
+	}
+	return config.DefaultMinRedundancy
+}
@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/joshvanl/yazbu/internal/client"
+)
+
+// BrokenLease is a lease which was broken by Unlock.
+type BrokenLease struct {
+	// Endpoint is the S3 endpoint of the bucket.
+	Endpoint string
+
+	// Bucket is the name of the bucket.
+	Bucket string
+
+	// Filesystem is the filesystem the lease was held on.
+	Filesystem string
+
+	// Lease is the lease which was broken.
+	Lease client.Lease
+}
+
+// Unlock breaks the leases held on all filesystems in all buckets. Leases
+// which have not yet expired are only broken if force is true.
+func (m *Manager) Unlock(ctx context.Context, force bool) ([]BrokenLease, error) {
+	var (
+		errs   []string
+		broken []BrokenLease
+	)
+
+	for _, cl := range m.clients {
+		leases, err := cl.Unlock(ctx, force)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		for fs, lease := range leases {
+			broken = append(broken, BrokenLease{
+				Endpoint:   cl.Endpoint(),
+				Bucket:     cl.Bucket(),
+				Filesystem: fs,
+				Lease:      lease,
+			})
+		}
+	}
+
+	sort.SliceStable(broken, func(i, j int) bool {
+		if broken[i].Filesystem == broken[j].Filesystem {
+			return broken[i].Bucket < broken[j].Bucket
+		}
+		return broken[i].Filesystem < broken[j].Filesystem
+	})
+
+	if len(errs) > 0 {
+		return broken, fmt.Errorf("Unlock: [%s]", strings.Join(errs, ", "))
+	}
+
+	return broken, nil
+}
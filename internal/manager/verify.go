@@ -0,0 +1,212 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+	"github.com/joshvanl/yazbu/internal/client"
+)
+
+// VerifyStatus is the result status of verifying a backup entry.
+type VerifyStatus string
+
+const (
+	// VerifyPass is the status of an entry whose object matches its recorded
+	// checksum.
+	VerifyPass VerifyStatus = "pass"
+
+	// VerifyFail is the status of an entry whose object could not be read,
+	// validated, or does not match its recorded checksum.
+	VerifyFail VerifyStatus = "fail"
+
+	// VerifyNoChecksum is the status of an entry whose object was read and
+	// validated, but has no recorded checksum to compare against.
+	VerifyNoChecksum VerifyStatus = "no-checksum"
+)
+
+// VerifyOptions are the options for verifying backups.
+type VerifyOptions struct {
+	// Filesystem limits verification to the filesystem. If empty, all
+	// filesystems are verified.
+	Filesystem string
+
+	// Bucket limits verification to the bucket with the name. If empty, all
+	// buckets are verified.
+	Bucket string
+
+	// Sample is the number of randomly chosen entries to verify in each
+	// database. Ignored if All is true.
+	Sample int
+
+	// All verifies every entry in each database.
+	All bool
+
+	// ValidateStream additionally checks that each object parses as a valid
+	// zfs send stream, using zstream dump.
+	ValidateStream bool
+}
+
+// VerifyResult is the result of verifying a single backup entry.
+type VerifyResult struct {
+	// Endpoint is the S3 endpoint of the bucket.
+	Endpoint string `json:"endpoint"`
+
+	// Bucket is the name of the bucket.
+	Bucket string `json:"bucket"`
+
+	// Filesystem is the filesystem the entry is a backup of.
+	Filesystem string `json:"filesystem"`
+
+	// Entry is the verified entry.
+	Entry backup.Entry `json:"entry"`
+
+	// Status is the result of the verification.
+	Status VerifyStatus `json:"status"`
+
+	// Error is the reason verification failed. Empty unless Status is
+	// VerifyFail.
+	Error string `json:"error,omitempty"`
+}
+
+// Verify downloads backup objects referenced by the databases, and checks
+// them against their recorded checksums. A result is returned for each entry
+// verified. Failing entries do not return an error, only failing to read a
+// database does.
+func (m *Manager) Verify(ctx context.Context, opts VerifyOptions) ([]VerifyResult, error) {
+	filesystems, err := m.filesystemsFor(opts.Filesystem)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		errs    []string
+		results []VerifyResult
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		found   bool
+	)
+
+	for _, cl := range m.clients {
+		if len(opts.Bucket) > 0 && cl.Bucket() != opts.Bucket {
+			continue
+		}
+		found = true
+
+		// Objects in the same bucket are verified in sequence to limit
+		// bandwidth, whilst buckets are verified concurrently.
+		wg.Add(1)
+		go func(cl *client.Client) {
+			defer wg.Done()
+
+			for _, fs := range filesystems {
+				if !cl.HasFilesystem(fs.Name) {
+					continue
+				}
+				res, err := m.verifyFS(ctx, cl, fs.Name, opts)
+				lock.Lock()
+				results = append(results, res...)
+				if err != nil {
+					errs = append(errs, err.Error())
+				}
+				lock.Unlock()
+			}
+		}(cl)
+	}
+	wg.Wait()
+
+	if !found {
+		return nil, fmt.Errorf("no bucket configured with name %q", opts.Bucket)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Filesystem != results[j].Filesystem {
+			return results[i].Filesystem < results[j].Filesystem
+		}
+		if results[i].Bucket != results[j].Bucket {
+			return results[i].Bucket < results[j].Bucket
+		}
+		return results[i].Entry.ID < results[j].Entry.ID
+	})
+
+	if len(errs) > 0 {
+		return results, fmt.Errorf("Verify: [%s]", strings.Join(errs, ", "))
+	}
+
+	return results, nil
+}
+
+// verifyFS verifies the entries of the filesystem database in the bucket.
+func (m *Manager) verifyFS(ctx context.Context, cl *client.Client, fs string, opts VerifyOptions) ([]VerifyResult, error) {
+	db, err := cl.DB(ctx, fs)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", cl.Bucket(), err)
+	}
+
+	entries := db.Entries
+	if !opts.All {
+		entries = sampleEntries(entries, opts.Sample)
+	}
+
+	var validate func(io.Reader) error
+	if opts.ValidateStream {
+		validate = func(r io.Reader) error {
+			return m.zfs.StreamDump(ctx, m.log, r)
+		}
+	}
+
+	results := make([]VerifyResult, 0, len(entries))
+	for _, entry := range entries {
+		m.log.Info("verifying backup", "bucket", cl.Bucket(), "filesystem", fs, "id", entry.ID, "key", entry.S3Key)
+
+		result := VerifyResult{
+			Endpoint:   cl.Endpoint(),
+			Bucket:     cl.Bucket(),
+			Filesystem: fs,
+			Entry:      entry,
+			Status:     VerifyPass,
+		}
+
+		if err := cl.Verify(ctx, fs, entry, validate); err != nil {
+			result.Status = VerifyFail
+			result.Error = err.Error()
+		} else if len(entry.SHA256) == 0 {
+			result.Status = VerifyNoChecksum
+		}
+
+		results = append(results, result)
+
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+	}
+
+	return results, nil
+}
+
+// sampleEntries returns n randomly chosen entries, in ID order. If n is
+// greater than or equal to the number of entries, all entries are returned.
+func sampleEntries(entries []backup.Entry, n int) []backup.Entry {
+	if n >= len(entries) {
+		return entries
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	sample := make([]backup.Entry, 0, n)
+	for _, i := range rand.Perm(len(entries))[:n] {
+		sample = append(sample, entries[i])
+	}
+
+	sort.SliceStable(sample, func(i, j int) bool {
+		return sample[i].ID < sample[j].ID
+	})
+
+	return sample
+}
@@ -0,0 +1,343 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+)
+
+const (
+	// namespace is the prefix of all metric names.
+	namespace = "yazbu"
+
+	// shutdownTimeout is the time given to the metrics server to finish
+	// serving requests once shutting down.
+	shutdownTimeout = time.Second * 5
+)
+
+// Operation is an operation on a filesystem in a bucket which can fail.
+type Operation string
+
+const (
+	// OperationBackup is writing a backup.
+	OperationBackup Operation = "backup"
+
+	// OperationPrune is deleting backups according to the cadence.
+	OperationPrune Operation = "prune"
+
+	// OperationVerify is verifying a backup.
+	OperationVerify Operation = "verify"
+)
+
+// labels are the labels of each metric of a filesystem in a bucket, as they
+// appear in backup.DB.
+var labels = []string{"endpoint", "bucket", "filesystem"}
+
+// Options are the options for constructing Metrics.
+type Options struct {
+	// Log is the logger for failing to write the textfile.
+	Log logr.Logger
+
+	// Textfile is the path to a file which the metrics are written to in the
+	// Prometheus text format after every update, for the node exporter
+	// textfile collector. Metrics already in the file are kept, and counters
+	// recorded by this process are added to them, so that the file accumulates
+	// the metrics of each run. If empty, no file is written.
+	Textfile string
+}
+
+// Metrics are the Prometheus metrics of backups. A nil Metrics records
+// nothing.
+type Metrics struct {
+	log      logr.Logger
+	textfile string
+	registry *prometheus.Registry
+
+	// lock serialises writes to the textfile.
+	lock sync.Mutex
+
+	// previous are the metric families of previous runs, read from the
+	// textfile on the first write.
+	previous     map[string]*dto.MetricFamily
+	previousRead bool
+
+	lastSuccess *prometheus.GaugeVec
+	uploaded    *prometheus.CounterVec
+	duration    *prometheus.GaugeVec
+	entries     *prometheus.GaugeVec
+	pruned      *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+}
+
+// New constructs new Metrics, registered to their own registry.
+func New(opts Options) *Metrics {
+	m := &Metrics{
+		log:      opts.Log.WithName("metrics"),
+		textfile: opts.Textfile,
+		registry: prometheus.NewRegistry(),
+
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backup_last_success_timestamp_seconds",
+			Help:      "Unix time of the last backup successfully written, by backup type.",
+		}, append(labels, "type")),
+		uploaded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backup_uploaded_bytes_total",
+			Help:      "Bytes of backup objects uploaded, after compression and encryption.",
+		}, labels),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backup_duration_seconds",
+			Help:      "Time taken to write the last successful backup.",
+		}, labels),
+		entries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backup_entries",
+			Help:      "Number of backups in the database, by backup type.",
+		}, append(labels, "type")),
+		pruned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "prune_deleted_backups_total",
+			Help:      "Number of backups deleted according to the cadence.",
+		}, labels),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "failures_total",
+			Help:      "Number of failed operations, by operation.",
+		}, append(labels, "operation")),
+	}
+
+	m.registry.MustRegister(m.lastSuccess, m.uploaded, m.duration, m.entries, m.pruned, m.failures)
+
+	return m
+}
+
+// BackupWritten records a successfully written backup entry of the database,
+// the number of bytes uploaded, and the time taken to write it.
+func (m *Metrics) BackupWritten(db backup.DB, entry backup.Entry, uploaded uint64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lastSuccess.WithLabelValues(db.Endpoint, db.Bucket, db.Filesystem, string(entry.Type)).Set(float64(entry.Timestamp.Unix()))
+	m.uploaded.WithLabelValues(db.Endpoint, db.Bucket, db.Filesystem).Add(float64(uploaded))
+	m.duration.WithLabelValues(db.Endpoint, db.Bucket, db.Filesystem).Set(duration.Seconds())
+	m.update()
+}
+
+// Entries records the number of backups in the database.
+func (m *Metrics) Entries(db backup.DB) {
+	if m == nil {
+		return
+	}
+	counts := map[backup.Type]int{backup.TypeFull: 0, backup.TypeIncremental: 0}
+	for _, entry := range db.Entries {
+		counts[entry.Type]++
+	}
+	for typ, n := range counts {
+		m.entries.WithLabelValues(db.Endpoint, db.Bucket, db.Filesystem, string(typ)).Set(float64(n))
+	}
+	m.update()
+}
+
+// Pruned records the number of backups deleted from the database according
+// to the cadence.
+func (m *Metrics) Pruned(db backup.DB, n int) {
+	if m == nil {
+		return
+	}
+	m.pruned.WithLabelValues(db.Endpoint, db.Bucket, db.Filesystem).Add(float64(n))
+	m.update()
+}
+
+// Failure records a failed operation on the filesystem in the bucket.
+func (m *Metrics) Failure(endpoint, bucket, filesystem string, op Operation) {
+	if m == nil {
+		return
+	}
+	m.failures.WithLabelValues(endpoint, bucket, filesystem, string(op)).Inc()
+	m.update()
+}
+
+// Gatherer returns the gatherer of the metrics.
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	return m.registry
+}
+
+// Serve serves the metrics at /metrics on the address until the context is
+// cancelled.
+func (m *Metrics) Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: time.Second * 10}
+
+	errCh := make(chan error, 1)
+	go func() {
+		m.log.Info("serving metrics", "addr", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+		if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+// update writes the textfile, if configured. Failing to write the textfile is
+// logged rather than failing the operation being recorded.
+func (m *Metrics) update() {
+	if len(m.textfile) == 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.writeTextfile(); err != nil {
+		m.log.Error(err, "failed to write metrics textfile", "path", m.textfile)
+	}
+}
+
+// writeTextfile atomically writes the metrics to the textfile, merged with
+// the metrics of previous runs in the file. The file is only read on the first
+// write, so that counters of this process are added to those of previous runs
+// once.
+func (m *Metrics) writeTextfile() error {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	if !m.previousRead {
+		m.previous, err = readTextfile(m.textfile)
+		if err != nil {
+			m.log.Error(err, "failed to read existing metrics textfile, metrics of previous runs will be lost", "path", m.textfile)
+		}
+		m.previousRead = true
+	}
+	families = mergeFamilies(families, m.previous)
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.textfile), filepath.Base(m.textfile))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(tmp, mf); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.textfile)
+}
+
+// readTextfile returns the metric families in the textfile. Returns nil if
+// the file does not exist.
+func readTextfile(path string) (map[string]*dto.MetricFamily, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics textfile: %w", err)
+	}
+	return families, nil
+}
+
+// mergeFamilies returns the current metric families merged with the previous
+// families, sorted by name. Counters with the same name and labels are added
+// together, and other series of the current families replace those of the
+// previous. Previous families whose type has changed are dropped. The previous
+// families are not modified.
+func mergeFamilies(current []*dto.MetricFamily, previous map[string]*dto.MetricFamily) []*dto.MetricFamily {
+	byName := make(map[string]*dto.MetricFamily, len(current)+len(previous))
+	for _, mf := range current {
+		byName[mf.GetName()] = mf
+	}
+
+	for name, prev := range previous {
+		mf, ok := byName[name]
+		if !ok {
+			byName[name] = prev
+			continue
+		}
+		if mf.GetType() != prev.GetType() {
+			continue
+		}
+
+		seen := make(map[string]*dto.Metric, len(mf.Metric))
+		for _, metric := range mf.Metric {
+			seen[labelsKey(metric)] = metric
+		}
+		for _, metric := range prev.Metric {
+			cur, ok := seen[labelsKey(metric)]
+			switch {
+			case !ok:
+				mf.Metric = append(mf.Metric, metric)
+			case mf.GetType() == dto.MetricType_COUNTER:
+				sum := cur.GetCounter().GetValue() + metric.GetCounter().GetValue()
+				cur.Counter.Value = &sum
+			}
+		}
+		sort.Slice(mf.Metric, func(i, j int) bool {
+			return labelsKey(mf.Metric[i]) < labelsKey(mf.Metric[j])
+		})
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+	return families
+}
+
+// labelsKey returns a key which uniquely identifies the labels of the series.
+func labelsKey(metric *dto.Metric) string {
+	pairs := make([]string, len(metric.Label))
+	for i, label := range metric.Label {
+		pairs[i] = fmt.Sprintf("%s=%q", label.GetName(), label.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+)
+
+func Test_Metrics(t *testing.T) {
+	var nilMetrics *Metrics
+	assert.NotPanics(t, func() {
+		nilMetrics.Failure("endpoint", "bucket", "tank/foo", OperationBackup)
+	}, "nil metrics should record nothing")
+
+	textfile := filepath.Join(t.TempDir(), "yazbu.prom")
+	m := New(Options{Log: logr.Discard(), Textfile: textfile})
+
+	db := backup.DB{Endpoint: "https://s3.example.com", Bucket: "bucket", Filesystem: "tank/foo"}
+	db.Entries = []backup.Entry{
+		{ID: 1, Type: backup.TypeFull, Timestamp: time.Unix(100, 0)},
+		{ID: 2, Type: backup.TypeIncremental, Timestamp: time.Unix(200, 0)},
+	}
+	m.BackupWritten(db, db.Entries[1], 1024, time.Second*3)
+	m.Entries(db)
+	m.Pruned(db, 2)
+	m.Failure(db.Endpoint, db.Bucket, db.Filesystem, OperationVerify)
+
+	exp := `
+# HELP yazbu_backup_last_success_timestamp_seconds Unix time of the last backup successfully written, by backup type.
+# TYPE yazbu_backup_last_success_timestamp_seconds gauge
+yazbu_backup_last_success_timestamp_seconds{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo",type="inc"} 200
+# HELP yazbu_backup_uploaded_bytes_total Bytes of backup objects uploaded, after compression and encryption.
+# TYPE yazbu_backup_uploaded_bytes_total counter
+yazbu_backup_uploaded_bytes_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo"} 1024
+# HELP yazbu_backup_duration_seconds Time taken to write the last successful backup.
+# TYPE yazbu_backup_duration_seconds gauge
+yazbu_backup_duration_seconds{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo"} 3
+# HELP yazbu_backup_entries Number of backups in the database, by backup type.
+# TYPE yazbu_backup_entries gauge
+yazbu_backup_entries{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo",type="full"} 1
+yazbu_backup_entries{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo",type="inc"} 1
+# HELP yazbu_prune_deleted_backups_total Number of backups deleted according to the cadence.
+# TYPE yazbu_prune_deleted_backups_total counter
+yazbu_prune_deleted_backups_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo"} 2
+# HELP yazbu_failures_total Number of failed operations, by operation.
+# TYPE yazbu_failures_total counter
+yazbu_failures_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo",operation="verify"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(m.Gatherer(), strings.NewReader(exp)))
+
+	b, err := os.ReadFile(textfile)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `yazbu_failures_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo",operation="verify"} 1`)
+}
+
+func Test_Metrics_Textfile(t *testing.T) {
+	textfile := filepath.Join(t.TempDir(), "yazbu.prom")
+	foo := backup.DB{Endpoint: "https://s3.example.com", Bucket: "bucket", Filesystem: "tank/foo"}
+	bar := backup.DB{Endpoint: "https://s3.example.com", Bucket: "bucket", Filesystem: "tank/bar"}
+
+	// A backup run, followed by a prune run, should keep the metrics of the
+	// backup run.
+	backupRun := New(Options{Log: logr.Discard(), Textfile: textfile})
+	backupRun.BackupWritten(foo, backup.Entry{ID: 1, Type: backup.TypeFull, Timestamp: time.Unix(100, 0)}, 1024, time.Second)
+	backupRun.Failure(bar.Endpoint, bar.Bucket, bar.Filesystem, OperationBackup)
+
+	pruneRun := New(Options{Log: logr.Discard(), Textfile: textfile})
+	pruneRun.Pruned(foo, 2)
+	pruneRun.Failure(bar.Endpoint, bar.Bucket, bar.Filesystem, OperationPrune)
+
+	b, err := os.ReadFile(textfile)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`yazbu_backup_last_success_timestamp_seconds{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo",type="full"} 100`,
+		`yazbu_backup_uploaded_bytes_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo"} 1024`,
+		`yazbu_failures_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/bar",operation="backup"} 1`,
+		`yazbu_failures_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/bar",operation="prune"} 1`,
+		`yazbu_prune_deleted_backups_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo"} 2`,
+	} {
+		assert.Contains(t, string(b), line)
+	}
+	assert.Equal(t, 1, strings.Count(string(b), "# TYPE yazbu_failures_total counter"), "families should be merged")
+
+	// Gauges recorded again replace those of previous runs, and counters are
+	// added to them.
+	backupRun = New(Options{Log: logr.Discard(), Textfile: textfile})
+	backupRun.BackupWritten(foo, backup.Entry{ID: 2, Type: backup.TypeFull, Timestamp: time.Unix(200, 0)}, 512, time.Second)
+
+	b, err = os.ReadFile(textfile)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `yazbu_backup_last_success_timestamp_seconds{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo",type="full"} 200`)
+	assert.Contains(t, string(b), `yazbu_backup_uploaded_bytes_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo"} 1536`)
+	assert.Contains(t, string(b), `operation="prune"} 1`)
+}
+
+func Test_Metrics_TextfileCounters(t *testing.T) {
+	textfile := filepath.Join(t.TempDir(), "yazbu.prom")
+	db := backup.DB{Endpoint: "https://s3.example.com", Bucket: "bucket", Filesystem: "tank/foo"}
+	line := `yazbu_failures_total{bucket="bucket",endpoint="https://s3.example.com",filesystem="tank/foo",operation="backup"} `
+
+	// Two failing runs should count two failures, however many times each run
+	// writes the textfile.
+	for i := 0; i < 2; i++ {
+		run := New(Options{Log: logr.Discard(), Textfile: textfile})
+		run.Entries(db)
+		run.Failure(db.Endpoint, db.Bucket, db.Filesystem, OperationBackup)
+		run.Entries(db)
+	}
+
+	b, err := os.ReadFile(textfile)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), line+"2\n")
+}
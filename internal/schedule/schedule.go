@@ -0,0 +1,44 @@
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/joshvanl/yazbu/internal/backup"
+)
+
+// Schedule is the schedule of a job.
+type Schedule interface {
+	// Next returns the next time the job should run after the given time.
+	Next(time.Time) time.Time
+}
+
+// Interval is a Schedule which runs a job at a fixed interval after its
+// previous run.
+type Interval time.Duration
+
+// Next implements Schedule.
+func (i Interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+// Parse parses a schedule, which is either an interval such as "6h" or "7d",
+// or a standard 5 field cron expression such as "0 3 * * *". Cron descriptors
+// such as "@daily" are also accepted. Cron expressions are evaluated in the
+// local time zone.
+func Parse(s string) (Schedule, error) {
+	if d, err := backup.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q, interval must be greater than 0", s)
+		}
+		return Interval(d), nil
+	}
+
+	sched, err := cron.ParseStandard(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q, must be an interval or cron expression: %w", s, err)
+	}
+	return sched, nil
+}
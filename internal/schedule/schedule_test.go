@@ -0,0 +1,37 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Parse(t *testing.T) {
+	from := time.Date(2020, 5, 1, 10, 30, 0, 0, time.Local)
+
+	tests := map[string]struct {
+		exp    time.Time
+		expErr bool
+	}{
+		"6h":           {exp: from.Add(time.Hour * 6)},
+		"7d":           {exp: from.Add(time.Hour * 24 * 7)},
+		"0 3 * * *":    {exp: time.Date(2020, 5, 2, 3, 0, 0, 0, time.Local)},
+		"*/15 * * * *": {exp: time.Date(2020, 5, 1, 10, 45, 0, 0, time.Local)},
+		"@daily":       {exp: time.Date(2020, 5, 2, 0, 0, 0, 0, time.Local)},
+		"0s":           {expErr: true},
+		"0 3 * *":      {expErr: true},
+		"sometimes":    {expErr: true},
+	}
+
+	for input, test := range tests {
+		t.Run(input, func(t *testing.T) {
+			sched, err := Parse(input)
+			require.Equal(t, test.expErr, err != nil, "%v", err)
+			if !test.expErr {
+				assert.Equal(t, test.exp, sched.Next(from))
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Package fanout provides the Fanout type which copies a single stream to many
+// destination readers.
+package fanout
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// chunkSize is the size of each chunk read from the source stream.
+	chunkSize = 1 << 20 // 1MiB
+)
+
+// ErrAllClosed is returned by Run when all destinations were closed before the
+// end of the source stream was reached.
+var ErrAllClosed = errors.New("all destinations closed")
+
+// Fanout copies a single source stream to many destination readers. Each
+// destination has its own bounded buffer. Reading from the source blocks
+// whilst any open destination's buffer is full, so the source is only read as
+// fast as the slowest destination. Destinations which are closed before the
+// end of the stream are dropped, and the remaining destinations continue.
+type Fanout struct {
+	dests []*Destination
+}
+
+// Destination is a reader of the source stream of a Fanout.
+// Implements the io.ReadCloser interface.
+type Destination struct {
+	// ch is the channel of chunks read from the source.
+	ch chan []byte
+
+	// closed is closed once the destination has been closed by the reader.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// buf is the remaining bytes of the current chunk.
+	buf []byte
+
+	// err is the error returned once all chunks have been read. Written
+	// before ch is closed.
+	err error
+}
+
+// New returns a new Fanout with n destinations, each buffering up to buffer
+// chunks of the source stream.
+func New(n, buffer int) *Fanout {
+	f := &Fanout{dests: make([]*Destination, n)}
+	for i := range f.dests {
+		f.dests[i] = &Destination{
+			ch:     make(chan []byte, buffer),
+			closed: make(chan struct{}),
+		}
+	}
+	return f
+}
+
+// Destination returns the i'th destination reader.
+func (f *Fanout) Destination(i int) *Destination {
+	return f.dests[i]
+}
+
+// Run copies the source stream to all destinations until the end of the
+// stream, the source errors, the context is cancelled, or all destinations
+// have been closed. The source is closed once Run returns. Destinations
+// receive io.EOF at the end of the stream, or the error which caused Run to
+// return.
+func (f *Fanout) Run(ctx context.Context, src io.ReadCloser) (err error) {
+	defer src.Close()
+	defer func() {
+		derr := err
+		if derr == nil {
+			derr = io.EOF
+		}
+		for _, d := range f.dests {
+			d.err = derr
+			close(d.ch)
+		}
+	}()
+
+	dropped := make([]bool, len(f.dests))
+	for {
+		buf := make([]byte, chunkSize)
+		n, rerr := io.ReadFull(src, buf)
+
+		if n > 0 {
+			var open int
+			for i, d := range f.dests {
+				if dropped[i] {
+					continue
+				}
+
+				select {
+				case <-d.closed:
+					dropped[i] = true
+					continue
+				default:
+				}
+
+				select {
+				case d.ch <- buf[:n]:
+					open++
+				case <-d.closed:
+					dropped[i] = true
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			if open == 0 {
+				return ErrAllClosed
+			}
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// Read implements the io.Reader interface.
+func (d *Destination) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		chunk, ok := <-d.ch
+		if !ok {
+			return 0, d.err
+		}
+		d.buf = chunk
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Close implements the io.Closer interface. Once closed, the destination is
+// dropped from the Fanout and no more chunks are sent to it.
+func (d *Destination) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
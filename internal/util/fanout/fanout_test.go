@@ -0,0 +1,82 @@
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Fanout(t *testing.T) {
+	data := make([]byte, chunkSize*3+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	t.Run("all destinations should receive the full stream", func(t *testing.T) {
+		f := New(3, 1)
+
+		var wg sync.WaitGroup
+		results := make([][]byte, 3)
+		wg.Add(3)
+		for i := 0; i < 3; i++ {
+			go func(i int) {
+				defer wg.Done()
+				b, err := io.ReadAll(f.Destination(i))
+				assert.NoError(t, err)
+				results[i] = b
+			}(i)
+		}
+
+		assert.NoError(t, f.Run(context.Background(), io.NopCloser(bytes.NewReader(data))))
+		wg.Wait()
+
+		for i := range results {
+			assert.Equal(t, data, results[i])
+		}
+	})
+
+	t.Run("closed destinations should be dropped, and others continue", func(t *testing.T) {
+		f := New(2, 1)
+		assert.NoError(t, f.Destination(0).Close())
+
+		var got []byte
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			var err error
+			got, err = io.ReadAll(f.Destination(1))
+			assert.NoError(t, err)
+		}()
+
+		assert.NoError(t, f.Run(context.Background(), io.NopCloser(bytes.NewReader(data))))
+		<-done
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("if all destinations are closed, expect error", func(t *testing.T) {
+		f := New(2, 1)
+		assert.NoError(t, f.Destination(0).Close())
+		assert.NoError(t, f.Destination(1).Close())
+		assert.ErrorIs(t, f.Run(context.Background(), io.NopCloser(bytes.NewReader(data))), ErrAllClosed)
+	})
+
+	t.Run("if source errors, destinations should receive the error", func(t *testing.T) {
+		f := New(1, 4)
+		srcErr := errors.New("source error")
+		src := io.NopCloser(io.MultiReader(bytes.NewReader(data[:10]), &errReader{srcErr}))
+
+		assert.ErrorIs(t, f.Run(context.Background(), src), srcErr)
+		_, err := io.ReadAll(f.Destination(0))
+		assert.ErrorIs(t, err, srcErr)
+	})
+}
+
+type errReader struct{ err error }
+
+func (e *errReader) Read([]byte) (int, error) { return 0, e.err }
@@ -0,0 +1,616 @@
+// Package fake implements an in-memory zfs.Interface, for testing backup,
+// restore, and snapshot management flows without a zfs pool.
+//
+// Datasets are modelled as append-only byte logs. A snapshot captures the
+// contents of its dataset at the time it was taken, so an incremental send
+// stream between two snapshots is the data appended between them. Bookmarks
+// may be used as incremental sources. Send streams are deterministic, and
+// carry a header so that a received stream can be validated and applied to
+// the base snapshot with the matching GUID.
+package fake
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"k8s.io/utils/clock"
+
+	"github.com/joshvanl/yazbu/internal/zfs"
+)
+
+const (
+	// streamMagic is the first field of every send stream header.
+	streamMagic = "yazbu-fake-zfs"
+)
+
+// ZFS is an in-memory implementation of zfs.Interface.
+type ZFS struct {
+	lock  sync.Mutex
+	clock clock.Clock
+
+	// datasets are the datasets on the fake host, keyed by name.
+	datasets map[string]*dataset
+
+	// txg is the last transaction group number, incremented for each
+	// snapshot created or received.
+	txg uint64
+
+	// sends are the send streams produced, in order.
+	sends []Send
+
+	// sendErr, if set, fails the next send stream partway through.
+	sendErr error
+}
+
+// Send is a record of a send stream produced by the fake.
+type Send struct {
+	// From is the incremental source of the stream. Empty for full streams.
+	From string
+
+	// To is the snapshot sent.
+	To string
+
+	// Flags are the additional zfs send flags the stream was sent with.
+	Flags []string
+}
+
+// dataset is a fake zfs dataset.
+type dataset struct {
+	// data is the current contents of the dataset.
+	data []byte
+
+	// snapshots are the snapshots of the dataset, ordered oldest first.
+	snapshots []snapshot
+
+	// bookmarks are the bookmarks of the dataset, ordered oldest first.
+	bookmarks []snapshot
+}
+
+// snapshot is a fake zfs snapshot or bookmark.
+type snapshot struct {
+	// name is the name of the snapshot, excluding the dataset.
+	name string
+
+	// guid is the GUID of the snapshot. Bookmarks share the GUID of the
+	// snapshot they were created from, as do received snapshots with their
+	// sent snapshot.
+	guid uint64
+
+	// txg is the transaction group the snapshot was created in, and orders
+	// snapshots and bookmarks.
+	txg uint64
+
+	// data is the contents of the dataset when the snapshot was taken.
+	// Bookmarks keep the data so that incremental streams can be computed
+	// from them.
+	data []byte
+}
+
+// header is the header of a fake send stream.
+type header struct {
+	// from is the base snapshot or bookmark of an incremental stream. Empty
+	// for a full stream.
+	from string
+
+	// fromGUID is the GUID of the base of an incremental stream.
+	fromGUID uint64
+
+	// to is the snapshot that the stream sends.
+	to string
+
+	// toGUID is the GUID of the snapshot that the stream sends.
+	toGUID uint64
+
+	// size is the size of the stream payload.
+	size int
+}
+
+var _ zfs.Interface = &ZFS{}
+
+// New returns a new fake ZFS with no datasets. The clock is used to name
+// created snapshots.
+func New(clock clock.Clock) *ZFS {
+	return &ZFS{
+		clock:    clock,
+		datasets: make(map[string]*dataset),
+	}
+}
+
+// Write appends the given data to the dataset, creating the dataset if it
+// does not exist.
+func (z *ZFS) Write(name string, data []byte) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	ds, ok := z.datasets[name]
+	if !ok {
+		ds = new(dataset)
+		z.datasets[name] = ds
+	}
+	ds.data = append(ds.data, data...)
+}
+
+// Data returns the current contents of the dataset, and whether it exists.
+func (z *ZFS) Data(name string) ([]byte, bool) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	ds, ok := z.datasets[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), ds.data...), true
+}
+
+// Snapshot creates a snapshot with the given full name, for example to
+// simulate snapshots which were not created by yazbu.
+func (z *ZFS) Snapshot(full string) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	name, snap, ok := strings.Cut(full, "@")
+	if !ok {
+		return fmt.Errorf("%q is not a snapshot", full)
+	}
+	ds, ok := z.datasets[name]
+	if !ok {
+		return fmt.Errorf("dataset %q does not exist", name)
+	}
+	if ds.index(snap) >= 0 {
+		return fmt.Errorf("snapshot %q already exists", full)
+	}
+
+	ds.snapshots = append(ds.snapshots, z.newSnapshot(full, ds.data))
+	return nil
+}
+
+// Sends returns the send streams produced, in order.
+func (z *ZFS) Sends() []Send {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	return append([]Send(nil), z.sends...)
+}
+
+// FailSend causes the next send stream to fail with the given error after
+// half of the stream has been read.
+func (z *ZFS) FailSend(err error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	z.sendErr = err
+}
+
+// SnapshotCreate implements zfs.Interface. Snapshots are named the same as
+// the exec implementation, using the fake's clock.
+func (z *ZFS) SnapshotCreate(_ context.Context, _ logr.Logger, filesystem, prefix string) (string, uint64, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	ds, ok := z.datasets[filesystem]
+	if !ok {
+		return "", 0, fmt.Errorf("dataset %q does not exist", filesystem)
+	}
+
+	full := zfs.SnapshotName(filesystem, prefix, z.clock.Now())
+	if ds.index(full[len(filesystem)+1:]) >= 0 {
+		return "", 0, fmt.Errorf("snapshot %s already exists", full)
+	}
+
+	snap := z.newSnapshot(full, ds.data)
+	ds.snapshots = append(ds.snapshots, snap)
+
+	return full, uint64(len(encode(header{to: full, toGUID: snap.guid, size: len(snap.data)}, snap.data))), nil
+}
+
+// SnapshotSendFull implements zfs.Interface. The flags are recorded, but do
+// not change the stream.
+func (z *ZFS) SnapshotSendFull(_ context.Context, _ logr.Logger, snapshot string, flags []string) (zfs.ZFSReader, error) {
+	b, err := z.streamFull(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return z.recordSend(Send{To: snapshot, Flags: flags}, b), nil
+}
+
+// SnapshotSendInc implements zfs.Interface. The flags are recorded, but do not
+// change the stream.
+func (z *ZFS) SnapshotSendInc(_ context.Context, _ logr.Logger, fromSnapshot, toSnapshot string, flags []string) (zfs.ZFSReader, error) {
+	b, err := z.streamInc(fromSnapshot, toSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	return z.recordSend(Send{From: fromSnapshot, To: toSnapshot, Flags: flags}, b), nil
+}
+
+// SnapshotSize implements zfs.Interface.
+func (z *ZFS) SnapshotSize(_ context.Context, _ logr.Logger, snapshot string, _ []string) (uint64, error) {
+	b, err := z.streamFull(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(b)), nil
+}
+
+// SnapshotSizeInc implements zfs.Interface.
+func (z *ZFS) SnapshotSizeInc(_ context.Context, _ logr.Logger, fromSnapshot, toSnapshot string, _ []string) (uint64, error) {
+	b, err := z.streamInc(fromSnapshot, toSnapshot)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(b)), nil
+}
+
+// EstimateSize implements zfs.Interface. The estimate is the size of the data
+// of the dataset written since the given snapshot or bookmark, or all data.
+func (z *ZFS) EstimateSize(_ context.Context, _ logr.Logger, filesystem, from string) (uint64, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	ds, ok := z.datasets[filesystem]
+	if !ok {
+		return 0, fmt.Errorf("dataset %q does not exist", filesystem)
+	}
+	if len(from) == 0 {
+		return uint64(len(ds.data)), nil
+	}
+
+	fromSnap, ok := z.lookup(from)
+	if !ok {
+		return 0, fmt.Errorf("%q does not exist", from)
+	}
+	return uint64(len(ds.data) - len(fromSnap.data)), nil
+}
+
+// SnapshotExists implements zfs.Interface.
+func (z *ZFS) SnapshotExists(_ context.Context, _ logr.Logger, snapshot string) (bool, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	_, ok := z.lookup(snapshot)
+	return ok && strings.Contains(snapshot, "@"), nil
+}
+
+// SnapshotDestroy implements zfs.Interface.
+func (z *ZFS) SnapshotDestroy(_ context.Context, _ logr.Logger, snapshot string) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	name, snap, ok := strings.Cut(snapshot, "@")
+	if !ok {
+		return fmt.Errorf("refusing to destroy %q: not a snapshot", snapshot)
+	}
+
+	ds, ok := z.datasets[name]
+	if !ok || ds.index(snap) < 0 {
+		return fmt.Errorf("snapshot %q does not exist", snapshot)
+	}
+
+	i := ds.index(snap)
+	ds.snapshots = append(ds.snapshots[:i], ds.snapshots[i+1:]...)
+	return nil
+}
+
+// SnapshotList implements zfs.Interface.
+func (z *ZFS) SnapshotList(_ context.Context, _ logr.Logger, filesystem string) ([]string, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	ds, ok := z.datasets[filesystem]
+	if !ok {
+		return nil, fmt.Errorf("dataset %q does not exist", filesystem)
+	}
+
+	var snapshots []string
+	for _, snap := range ds.snapshots {
+		snapshots = append(snapshots, filesystem+"@"+snap.name)
+	}
+	return snapshots, nil
+}
+
+// GUID implements zfs.Interface.
+func (z *ZFS) GUID(_ context.Context, _ logr.Logger, name string) (uint64, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	snap, ok := z.lookup(name)
+	if !ok {
+		return 0, fmt.Errorf("%q does not exist", name)
+	}
+	return snap.guid, nil
+}
+
+// BookmarkCreate implements zfs.Interface.
+func (z *ZFS) BookmarkCreate(_ context.Context, _ logr.Logger, snapshot string) (string, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	snap, ok := z.lookup(snapshot)
+	if !ok || !strings.Contains(snapshot, "@") {
+		return "", fmt.Errorf("snapshot %q does not exist", snapshot)
+	}
+
+	bookmark := zfs.BookmarkName(snapshot)
+	if _, ok := z.lookup(bookmark); ok {
+		return "", fmt.Errorf("bookmark %q already exists", bookmark)
+	}
+
+	ds := z.datasets[strings.SplitN(snapshot, "@", 2)[0]]
+	ds.bookmarks = append(ds.bookmarks, snap)
+	return bookmark, nil
+}
+
+// BookmarkDestroy implements zfs.Interface.
+func (z *ZFS) BookmarkDestroy(_ context.Context, _ logr.Logger, bookmark string) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	name, mark, ok := strings.Cut(bookmark, "#")
+	if !ok {
+		return fmt.Errorf("refusing to destroy %q: not a bookmark", bookmark)
+	}
+
+	ds, ok := z.datasets[name]
+	if !ok || index(ds.bookmarks, mark) < 0 {
+		return fmt.Errorf("bookmark %q does not exist", bookmark)
+	}
+
+	i := index(ds.bookmarks, mark)
+	ds.bookmarks = append(ds.bookmarks[:i], ds.bookmarks[i+1:]...)
+	return nil
+}
+
+// BookmarkList implements zfs.Interface.
+func (z *ZFS) BookmarkList(_ context.Context, _ logr.Logger, filesystem string) ([]string, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	ds, ok := z.datasets[filesystem]
+	if !ok {
+		return nil, fmt.Errorf("dataset %q does not exist", filesystem)
+	}
+
+	var bookmarks []string
+	for _, mark := range ds.bookmarks {
+		bookmarks = append(bookmarks, filesystem+"#"+mark.name)
+	}
+	return bookmarks, nil
+}
+
+// Receive implements zfs.Interface. A full stream creates the dataset, which
+// must not already exist. An incremental stream is applied to the dataset,
+// whose latest snapshot must be the stream's base.
+func (z *ZFS) Receive(_ context.Context, _ logr.Logger, name string, r io.Reader) error {
+	h, payload, err := decode(r)
+	if err != nil {
+		return err
+	}
+
+	_, to, _ := strings.Cut(h.to, "@")
+
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	ds, ok := z.datasets[name]
+	if len(h.from) == 0 {
+		if ok {
+			return fmt.Errorf("destination %q exists", name)
+		}
+		z.txg++
+		z.datasets[name] = &dataset{
+			data:      payload,
+			snapshots: []snapshot{{name: to, guid: h.toGUID, txg: z.txg, data: payload}},
+		}
+		return nil
+	}
+
+	if !ok {
+		return fmt.Errorf("destination %q does not exist", name)
+	}
+
+	// As zfs, the base is matched by GUID, as the stream may be sent from a
+	// bookmark.
+	if len(ds.snapshots) == 0 || ds.snapshots[len(ds.snapshots)-1].guid != h.fromGUID {
+		return fmt.Errorf("destination %q does not have most recent snapshot %q", name, h.from)
+	}
+	if ds.index(to) >= 0 {
+		return fmt.Errorf("destination snapshot %s@%s exists", name, to)
+	}
+
+	// Receiving rolls the dataset back to the base snapshot before applying
+	// the stream.
+	base := ds.snapshots[len(ds.snapshots)-1]
+	data := append(append([]byte(nil), base.data...), payload...)
+	ds.data = data
+	z.txg++
+	ds.snapshots = append(ds.snapshots, snapshot{name: to, guid: h.toGUID, txg: z.txg, data: append([]byte(nil), data...)})
+	return nil
+}
+
+// StreamDump implements zfs.Interface.
+func (z *ZFS) StreamDump(_ context.Context, _ logr.Logger, r io.Reader) error {
+	if _, _, err := decode(r); err != nil {
+		return fmt.Errorf("invalid zfs send stream: %w", err)
+	}
+	return nil
+}
+
+// streamFull returns the full send stream of the given snapshot.
+func (z *ZFS) streamFull(name string) ([]byte, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	snap, ok := z.lookup(name)
+	if !ok || !strings.Contains(name, "@") {
+		return nil, fmt.Errorf("snapshot %q does not exist", name)
+	}
+
+	return encode(header{to: name, toGUID: snap.guid, size: len(snap.data)}, snap.data), nil
+}
+
+// streamInc returns the incremental send stream between the given snapshot
+// or bookmark, and snapshot. Both must be of the same dataset, with from
+// created before to.
+func (z *ZFS) streamInc(from, to string) ([]byte, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	fromSnap, ok := z.lookup(from)
+	if !ok {
+		return nil, fmt.Errorf("%q does not exist", from)
+	}
+	toSnap, ok := z.lookup(to)
+	if !ok || !strings.Contains(to, "@") {
+		return nil, fmt.Errorf("snapshot %q does not exist", to)
+	}
+
+	fromDS := from[:strings.IndexAny(from, "@#")]
+	toDS, _, _ := strings.Cut(to, "@")
+	if fromDS != toDS || fromSnap.txg >= toSnap.txg {
+		return nil, fmt.Errorf("incremental source %q is not earlier than %q", from, to)
+	}
+
+	payload := toSnap.data[len(fromSnap.data):]
+	return encode(header{from: from, fromGUID: fromSnap.guid, to: to, toGUID: toSnap.guid, size: len(payload)}, payload), nil
+}
+
+// recordSend records the given send stream, and returns a reader of its bytes.
+func (z *ZFS) recordSend(send Send, b []byte) zfs.ZFSReader {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	send.Flags = append([]string(nil), send.Flags...)
+	z.sends = append(z.sends, send)
+
+	if err := z.sendErr; err != nil {
+		z.sendErr = nil
+		return failingReader(b[:len(b)/2], err)
+	}
+	return reader(b)
+}
+
+// newSnapshot returns a new snapshot of the given full name and data, with a
+// new transaction group and a GUID derived from both.
+func (z *ZFS) newSnapshot(full string, data []byte) snapshot {
+	z.txg++
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", full, z.txg)
+	_, name, _ := strings.Cut(full, "@")
+	return snapshot{name: name, guid: h.Sum64(), txg: z.txg, data: append([]byte(nil), data...)}
+}
+
+// lookup returns the snapshot or bookmark with the given full name.
+func (z *ZFS) lookup(name string) (snapshot, bool) {
+	i := strings.IndexAny(name, "@#")
+	if i < 0 {
+		return snapshot{}, false
+	}
+	ds, ok := z.datasets[name[:i]]
+	if !ok {
+		return snapshot{}, false
+	}
+
+	list := ds.snapshots
+	if name[i] == '#' {
+		list = ds.bookmarks
+	}
+	j := index(list, name[i+1:])
+	if j < 0 {
+		return snapshot{}, false
+	}
+	return list[j], true
+}
+
+// index returns the index of the named snapshot, or -1 if it doesn't exist.
+func (d *dataset) index(name string) int {
+	return index(d.snapshots, name)
+}
+
+// index returns the index of the named snapshot or bookmark in the list, or
+// -1 if it doesn't exist.
+func index(list []snapshot, name string) int {
+	for i, snap := range list {
+		if snap.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// reader returns a zfs.ZFSReader of the given stream.
+func reader(b []byte) zfs.ZFSReader {
+	return func(context.Context, logr.Logger) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+// failingReader returns a zfs.ZFSReader which reads the given bytes, then
+// returns the given error, as zfs send does when it exits partway through a
+// stream.
+func failingReader(b []byte, err error) zfs.ZFSReader {
+	return func(context.Context, logr.Logger) (io.ReadCloser, error) {
+		return io.NopCloser(io.MultiReader(bytes.NewReader(b), errReader{err})), nil
+	}
+}
+
+// errReader is an io.Reader which always returns the given error.
+type errReader struct {
+	err error
+}
+
+// Read implements io.Reader.
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// encode returns the send stream of the given header and payload.
+func encode(h header, payload []byte) []byte {
+	var b bytes.Buffer
+	if len(h.from) == 0 {
+		fmt.Fprintf(&b, "%s full %s %d %d\n", streamMagic, h.to, h.toGUID, h.size)
+	} else {
+		fmt.Fprintf(&b, "%s inc %s %d %s %d %d\n", streamMagic, h.from, h.fromGUID, h.to, h.toGUID, h.size)
+	}
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// decode reads and validates a send stream, returning its header and
+// payload.
+func decode(r io.Reader) (header, []byte, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return header{}, nil, fmt.Errorf("failed to read stream header: %w", err)
+	}
+
+	var h header
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 5 && fields[0] == streamMagic && fields[1] == "full":
+		h.to = fields[2]
+		_, err = fmt.Sscanf(strings.Join(fields[3:], " "), "%d %d", &h.toGUID, &h.size)
+	case len(fields) == 7 && fields[0] == streamMagic && fields[1] == "inc":
+		h.from, h.to = fields[2], fields[4]
+		_, err = fmt.Sscanf(strings.Join(fields[3:], " "), "%d %s %d %d", &h.fromGUID, new(string), &h.toGUID, &h.size)
+	default:
+		err = errors.New("unrecognised stream header")
+	}
+	if err != nil {
+		return header{}, nil, fmt.Errorf("invalid stream header %q: %w", strings.TrimSpace(line), err)
+	}
+
+	payload, err := io.ReadAll(br)
+	if err != nil {
+		return header{}, nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+	if len(payload) != h.size {
+		return header{}, nil, fmt.Errorf("stream payload is %d bytes, expected %d", len(payload), h.size)
+	}
+
+	return h, payload, nil
+}
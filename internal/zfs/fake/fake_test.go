@@ -0,0 +1,179 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/joshvanl/yazbu/internal/zfs"
+)
+
+func read(t *testing.T, zr zfs.ZFSReader) []byte {
+	t.Helper()
+	rc, err := zr(context.Background(), logr.Discard())
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	return b
+}
+
+func Test_SendReceive(t *testing.T) {
+	ctx := context.Background()
+	log := logr.Discard()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	z := New(clock)
+
+	_, _, err := z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+	assert.Error(t, err, "dataset should not exist")
+
+	z.Write("tank/foo", []byte("a"))
+	snapA, size, err := z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, "tank/foo@yazbu_2020-05-01_00-00-00", snapA)
+
+	_, _, err = z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+	assert.Error(t, err, "snapshot should already exist")
+
+	clock.Step(time.Second)
+	z.Write("tank/foo", []byte("b"))
+	snapB, _, err := z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+	require.NoError(t, err)
+
+	sendFull, err := z.SnapshotSendFull(ctx, log, snapA, nil)
+	require.NoError(t, err)
+	full := read(t, sendFull)
+	assert.Equal(t, size, uint64(len(full)))
+	assert.Equal(t, full, read(t, sendFull), "stream should be deterministic")
+
+	sendInc, err := z.SnapshotSendInc(ctx, log, snapA, snapB, nil)
+	require.NoError(t, err)
+	inc := read(t, sendInc)
+	incSize, err := z.SnapshotSizeInc(ctx, log, snapA, snapB, nil)
+	require.NoError(t, err)
+	assert.Equal(t, incSize, uint64(len(inc)))
+
+	z.Write("tank/foo", []byte("cd"))
+	estimate, err := z.EstimateSize(ctx, log, "tank/foo", "")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), estimate)
+	estimate, err = z.EstimateSize(ctx, log, "tank/foo", snapA)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), estimate)
+
+	_, err = z.SnapshotSendInc(ctx, log, snapB, snapA, nil)
+	assert.Error(t, err, "incremental source must be earlier")
+
+	assert.NoError(t, z.StreamDump(ctx, log, bytes.NewReader(inc)))
+	assert.Error(t, z.StreamDump(ctx, log, bytes.NewReader(inc[:len(inc)-1])), "truncated stream")
+	assert.Error(t, z.StreamDump(ctx, log, bytes.NewReader([]byte("garbage\n"))))
+
+	assert.Error(t, z.Receive(ctx, log, "tank/bar", bytes.NewReader(inc)), "incremental needs an existing destination")
+	require.NoError(t, z.Receive(ctx, log, "tank/bar", bytes.NewReader(full)))
+	assert.Error(t, z.Receive(ctx, log, "tank/bar", bytes.NewReader(full)), "full needs a new destination")
+	require.NoError(t, z.Receive(ctx, log, "tank/bar", bytes.NewReader(inc)))
+
+	data, ok := z.Data("tank/bar")
+	require.True(t, ok)
+	assert.Equal(t, "ab", string(data))
+
+	snapshots, err := z.SnapshotList(ctx, log, "tank/bar")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"tank/bar@yazbu_2020-05-01_00-00-00",
+		"tank/bar@yazbu_2020-05-01_00-00-01",
+	}, snapshots)
+}
+
+func Test_SnapshotDestroy(t *testing.T) {
+	ctx := context.Background()
+	log := logr.Discard()
+	z := New(clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)))
+
+	z.Write("tank/foo", []byte("a"))
+	snap, _, err := z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+	require.NoError(t, err)
+
+	assert.Error(t, z.SnapshotDestroy(ctx, log, "tank/foo"), "should refuse to destroy a dataset")
+	require.NoError(t, z.SnapshotDestroy(ctx, log, snap))
+	assert.Error(t, z.SnapshotDestroy(ctx, log, snap))
+
+	exists, err := z.SnapshotExists(ctx, log, snap)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	snapshots, err := z.SnapshotList(ctx, log, "tank/foo")
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	_, err = z.SnapshotSendFull(ctx, log, snap, nil)
+	assert.Error(t, err)
+}
+
+func Test_Bookmark(t *testing.T) {
+	ctx := context.Background()
+	log := logr.Discard()
+	clock := clocktesting.NewFakeClock(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	z := New(clock)
+
+	z.Write("tank/foo", []byte("a"))
+	snapA, _, err := z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+	require.NoError(t, err)
+	sendFull, err := z.SnapshotSendFull(ctx, log, snapA, nil)
+	require.NoError(t, err)
+	require.NoError(t, z.Receive(ctx, log, "tank/bar", bytes.NewReader(read(t, sendFull))))
+
+	bookmark, err := z.BookmarkCreate(ctx, log, snapA)
+	require.NoError(t, err)
+	assert.Equal(t, "tank/foo#yazbu_2020-05-01_00-00-00", bookmark)
+	_, err = z.BookmarkCreate(ctx, log, snapA)
+	assert.Error(t, err, "bookmark should already exist")
+
+	snapGUID, err := z.GUID(ctx, log, snapA)
+	require.NoError(t, err)
+	bookmarkGUID, err := z.GUID(ctx, log, bookmark)
+	require.NoError(t, err)
+	assert.Equal(t, snapGUID, bookmarkGUID)
+	receivedGUID, err := z.GUID(ctx, log, "tank/bar@yazbu_2020-05-01_00-00-00")
+	require.NoError(t, err)
+	assert.Equal(t, snapGUID, receivedGUID, "received snapshot should keep its GUID")
+
+	require.NoError(t, z.SnapshotDestroy(ctx, log, snapA))
+	exists, err := z.SnapshotExists(ctx, log, bookmark)
+	require.NoError(t, err)
+	assert.False(t, exists, "bookmark is not a snapshot")
+
+	clock.Step(time.Second)
+	z.Write("tank/foo", []byte("b"))
+	snapB, _, err := z.SnapshotCreate(ctx, log, "tank/foo", zfs.DefaultSnapshotPrefix)
+	require.NoError(t, err)
+
+	sendInc, err := z.SnapshotSendInc(ctx, log, bookmark, snapB, nil)
+	require.NoError(t, err)
+	require.NoError(t, z.Receive(ctx, log, "tank/bar", bytes.NewReader(read(t, sendInc))))
+	data, ok := z.Data("tank/bar")
+	require.True(t, ok)
+	assert.Equal(t, "ab", string(data))
+
+	// A snapshot of the same name has a different GUID, so can't receive
+	// the incremental.
+	require.NoError(t, z.SnapshotDestroy(ctx, log, "tank/bar@yazbu_2020-05-01_00-00-01"))
+	require.NoError(t, z.SnapshotDestroy(ctx, log, "tank/bar@yazbu_2020-05-01_00-00-00"))
+	require.NoError(t, z.Snapshot("tank/bar@yazbu_2020-05-01_00-00-00"))
+	assert.Error(t, z.Receive(ctx, log, "tank/bar", bytes.NewReader(read(t, sendInc))))
+
+	bookmarks, err := z.BookmarkList(ctx, log, "tank/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{bookmark}, bookmarks)
+	assert.Error(t, z.BookmarkDestroy(ctx, log, snapB), "should refuse to destroy a snapshot")
+	require.NoError(t, z.BookmarkDestroy(ctx, log, bookmark))
+	_, err = z.SnapshotSendInc(ctx, log, bookmark, snapB, nil)
+	assert.Error(t, err)
+}
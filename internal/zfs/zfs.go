@@ -2,31 +2,122 @@ package zfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 )
 
+const (
+	// DefaultSnapshotPrefix is the default prefix of the names of snapshots
+	// created by yazbu. Only snapshots with the configured prefix are managed,
+	// and so destroyed, by yazbu.
+	DefaultSnapshotPrefix = "yazbu_"
+)
+
+var (
+	// snapshotPrefixRegex matches the characters which are valid in a zfs
+	// snapshot name.
+	snapshotPrefixRegex = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+
+	// sendFlags are the zfs send flags which may be configured. Flags which
+	// change which snapshots are sent are not allowed.
+	sendFlags = map[string]bool{
+		"-L": true, "--large-block": true,
+		"-c": true, "--compressed": true,
+		"-e": true, "--embed": true,
+		"-p": true, "--props": true,
+		"-b": true, "--backup": true,
+		"-h": true, "--holds": true,
+	}
+)
+
 // ZFSReader is a function that returns a reader for a zfs snapshot, configured
 // with the given logger.
 type ZFSReader func(context.Context, logr.Logger) (io.ReadCloser, error)
 
-// SnapshotCreate creates a snapshot of the given filesystem. Returns the name
-// of the zfs snapshot, and its size.
-func SnapshotCreate(ctx context.Context, log logr.Logger, filesystem string) (string, uint64, error) {
-	log = log.WithName("zfs_create_snapshot")
-	now := time.Now().UTC()
+// Interface is the set of zfs operations used to create, send, receive, and
+// manage snapshots.
+type Interface interface {
+	// SnapshotCreate creates a snapshot of the given filesystem, whose name
+	// begins with the given prefix. Returns the name of the zfs snapshot, and
+	// its size.
+	SnapshotCreate(ctx context.Context, log logr.Logger, filesystem, prefix string) (string, uint64, error)
 
-	snapshot := fmt.Sprintf("%s@yazbu_%04d-%02d-%02d_%02d-%02d-%02d",
-		filesystem,
-		now.Year(), now.Month(), now.Day(),
-		now.Hour(), now.Minute(), now.Second(),
-	)
+	// SnapshotSendFull sends the given zfs full snapshot to the returned
+	// reader, with the given additional zfs send flags.
+	SnapshotSendFull(ctx context.Context, log logr.Logger, snapshot string, flags []string) (ZFSReader, error)
+
+	// SnapshotSendInc sends the given zfs incremental snapshot to the returned
+	// reader, with the given additional zfs send flags. The incremental source
+	// may be a snapshot or a bookmark.
+	SnapshotSendInc(ctx context.Context, log logr.Logger, fromSnapshot, toSnapshot string, flags []string) (ZFSReader, error)
+
+	// Receive receives the given zfs send stream into the given dataset.
+	Receive(ctx context.Context, log logr.Logger, dataset string, r io.Reader) error
+
+	// StreamDump validates that the given stream is a valid zfs send stream.
+	StreamDump(ctx context.Context, log logr.Logger, r io.Reader) error
+
+	// SnapshotSize returns the size of the given zfs snapshot, when sent with
+	// the given additional zfs send flags.
+	SnapshotSize(ctx context.Context, log logr.Logger, snapshot string, flags []string) (uint64, error)
+
+	// SnapshotSizeInc returns the size of the incremental zfs snapshot between
+	// the two given snapshots, when sent with the given additional zfs send
+	// flags. The incremental source may be a snapshot or a bookmark.
+	SnapshotSizeInc(ctx context.Context, log logr.Logger, fromSnapshot, toSnapshot string, flags []string) (uint64, error)
+
+	// EstimateSize estimates the size of a snapshot of the given filesystem
+	// taken now, without creating it. If from is given, the size of an
+	// incremental from the given snapshot or bookmark is estimated instead.
+	EstimateSize(ctx context.Context, log logr.Logger, filesystem, from string) (uint64, error)
+
+	// SnapshotExists returns true if the given zfs snapshot exists on the
+	// host.
+	SnapshotExists(ctx context.Context, log logr.Logger, snapshot string) (bool, error)
+
+	// SnapshotDestroy destroys the given zfs snapshot.
+	SnapshotDestroy(ctx context.Context, log logr.Logger, snapshot string) error
+
+	// SnapshotList returns the names of the snapshots of the given
+	// filesystem, ordered oldest first.
+	SnapshotList(ctx context.Context, log logr.Logger, filesystem string) ([]string, error)
+
+	// GUID returns the zfs GUID of the given snapshot or bookmark. A bookmark
+	// has the same GUID as the snapshot it was created from.
+	GUID(ctx context.Context, log logr.Logger, name string) (uint64, error)
+
+	// BookmarkCreate creates a bookmark of the given snapshot, with the same
+	// name as the snapshot. Returns the name of the bookmark.
+	BookmarkCreate(ctx context.Context, log logr.Logger, snapshot string) (string, error)
+
+	// BookmarkDestroy destroys the given zfs bookmark.
+	BookmarkDestroy(ctx context.Context, log logr.Logger, bookmark string) error
+
+	// BookmarkList returns the names of the bookmarks of the given filesystem,
+	// ordered oldest first.
+	BookmarkList(ctx context.Context, log logr.Logger, filesystem string) ([]string, error)
+}
+
+// Exec is the Interface implementation which executes the zfs and zstream
+// binaries on the host.
+type Exec struct{}
+
+var _ Interface = Exec{}
+
+// SnapshotCreate creates a snapshot of the given filesystem, whose name begins
+// with the given prefix. Returns the name of the zfs snapshot, and its size.
+func (e Exec) SnapshotCreate(ctx context.Context, log logr.Logger, filesystem, prefix string) (string, uint64, error) {
+	log = log.WithName("zfs_create_snapshot")
+	snapshot := SnapshotName(filesystem, prefix, time.Now())
 
 	log.Info("creating snapshot", "snapshot", snapshot)
 	cmd := exec.CommandContext(ctx, "zfs", "snapshot", snapshot)
@@ -36,7 +127,7 @@ func SnapshotCreate(ctx context.Context, log logr.Logger, filesystem string) (st
 		return snapshot, 0, err
 	}
 
-	size, err := SnapshotSize(ctx, log, snapshot)
+	size, err := e.SnapshotSize(ctx, log, snapshot, nil)
 	if err != nil {
 		return "", 0, err
 	}
@@ -44,12 +135,13 @@ func SnapshotCreate(ctx context.Context, log logr.Logger, filesystem string) (st
 	return snapshot, size, nil
 }
 
-// SnapshotSendFull sends the given zfs full snapshot to the returned reader.
-func SnapshotSendFull(ctx context.Context, log logr.Logger, snapshot string) (ZFSReader, error) {
+// SnapshotSendFull sends the given zfs full snapshot to the returned reader,
+// with the given additional zfs send flags.
+func (e Exec) SnapshotSendFull(ctx context.Context, log logr.Logger, snapshot string, flags []string) (ZFSReader, error) {
 	log = log.WithName("zfs_send_full")
-	log.Info("sending snapshot", "snapshot", snapshot)
+	log.Info("sending snapshot", "snapshot", snapshot, "flags", flags)
 
-	cmd := exec.CommandContext(ctx, "zfs", "send", "--raw", snapshot)
+	cmd := exec.CommandContext(ctx, "zfs", sendArgs(flags, snapshot)...)
 	cmd.Stderr = logWriter(log, logStderr)
 
 	rc, err := cmd.StdoutPipe()
@@ -61,24 +153,18 @@ func SnapshotSendFull(ctx context.Context, log logr.Logger, snapshot string) (ZF
 		if err := cmd.Start(); err != nil {
 			return nil, fmt.Errorf("failed to start sending full snapshot: %w", err)
 		}
-
-		go func() {
-			if err := cmd.Wait(); err != nil {
-				log.Error(err, "error sending full snapshot")
-			}
-		}()
-
-		return rc, nil
+		return &sendReader{rc: rc, cmd: cmd}, nil
 	}, nil
 }
 
 // SnapshotSendInc sends the given zfs incremental snapshot to the returned
-// reader.
-func SnapshotSendInc(ctx context.Context, log logr.Logger, fromSnapshot, toSnapshot string) (ZFSReader, error) {
+// reader, with the given additional zfs send flags. The incremental source may
+// be a snapshot or a bookmark.
+func (e Exec) SnapshotSendInc(ctx context.Context, log logr.Logger, fromSnapshot, toSnapshot string, flags []string) (ZFSReader, error) {
 	log = log.WithName("zfs_send_inc")
 
-	log.Info("sending incremental snapshot", "from", fromSnapshot, "to", toSnapshot)
-	cmd := exec.CommandContext(ctx, "zfs", "send", "--raw", "-i", fromSnapshot, toSnapshot)
+	log.Info("sending incremental snapshot", "from", fromSnapshot, "to", toSnapshot, "flags", flags)
+	cmd := exec.CommandContext(ctx, "zfs", sendArgs(flags, "-i", fromSnapshot, toSnapshot)...)
 	cmd.Stderr = logWriter(log, logStderr)
 
 	rc, err := cmd.StdoutPipe()
@@ -90,22 +176,308 @@ func SnapshotSendInc(ctx context.Context, log logr.Logger, fromSnapshot, toSnaps
 		if err := cmd.Start(); err != nil {
 			return nil, fmt.Errorf("failed to start sending incremental snapshot: %w", err)
 		}
+		return &sendReader{rc: rc, cmd: cmd}, nil
+	}, nil
+}
 
-		go func() {
-			if err := cmd.Wait(); err != nil {
-				log.Error(err, "error sending incremental snapshot")
-			}
-		}()
+// sendReader is the stdout of a started zfs send command. The exit status of
+// the command is returned as the read error in place of io.EOF, so that a
+// send which fails partway is never mistaken for a complete stream.
+type sendReader struct {
+	rc  io.ReadCloser
+	cmd *exec.Cmd
 
-		return rc, nil
-	}, nil
+	once sync.Once
+	err  error
+}
+
+// Read implements io.Reader.
+func (s *sendReader) Read(p []byte) (int, error) {
+	n, err := s.rc.Read(p)
+	if errors.Is(err, io.EOF) {
+		if werr := s.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close closes stdout, stopping the command if it is still sending, and waits
+// for it to exit. Stdout is also closed by waiting, so its error is ignored.
+func (s *sendReader) Close() error {
+	s.rc.Close()
+	return s.wait()
+}
+
+// wait waits for the command to exit, returning its error.
+func (s *sendReader) wait() error {
+	s.once.Do(func() {
+		if err := s.cmd.Wait(); err != nil {
+			s.err = fmt.Errorf("zfs send failed: %w", err)
+		}
+	})
+	return s.err
+}
+
+// Receive receives the given zfs send stream into the given dataset.
+func (e Exec) Receive(ctx context.Context, log logr.Logger, dataset string, r io.Reader) error {
+	log = log.WithName("zfs_receive")
+	log.Info("receiving snapshot", "dataset", dataset)
+
+	cmd := exec.CommandContext(ctx, "zfs", "receive", dataset)
+	cmd.Stdin = r
+	cmd.Stdout, cmd.Stderr = logWriter(log, logStdout), logWriter(log, logStderr)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to receive snapshot into %q: %w", dataset, err)
+	}
+
+	return nil
+}
+
+// StreamDump validates that the given stream is a valid zfs send stream by
+// parsing it with zstream dump. The dump output is discarded.
+func (e Exec) StreamDump(ctx context.Context, log logr.Logger, r io.Reader) error {
+	log = log.WithName("zstream_dump")
+
+	cmd := exec.CommandContext(ctx, "zstream", "dump")
+	cmd.Stdin = r
+	cmd.Stdout, cmd.Stderr = io.Discard, logWriter(log, logStderr)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("invalid zfs send stream: %w", err)
+	}
+
+	return nil
+}
+
+// SnapshotSize returns the size of the given zfs snapshot, when sent with the
+// given additional zfs send flags.
+func (e Exec) SnapshotSize(ctx context.Context, log logr.Logger, snapshot string, flags []string) (uint64, error) {
+	return sendSize(ctx, log.WithName("zfs_size"), flags, snapshot)
 }
 
-// SnapshotSize returns the size of the given zfs snapshot.
-func SnapshotSize(ctx context.Context, log logr.Logger, snapshot string) (uint64, error) {
-	log = log.WithName("zfs_size")
+// SnapshotSizeInc returns the size of the incremental zfs snapshot between the
+// two given snapshots, when sent with the given additional zfs send flags. The
+// incremental source may be a snapshot or a bookmark.
+func (e Exec) SnapshotSizeInc(ctx context.Context, log logr.Logger, fromSnapshot, toSnapshot string, flags []string) (uint64, error) {
+	return sendSize(ctx, log.WithName("zfs_size_inc"), flags, "-i", fromSnapshot, toSnapshot)
+}
+
+// EstimateSize estimates the size of a snapshot of the given filesystem taken
+// now, without creating it, from the referenced property of the filesystem.
+// If from is given, the size of an incremental from the given snapshot or
+// bookmark is estimated from the written property since it instead.
+func (e Exec) EstimateSize(ctx context.Context, log logr.Logger, filesystem, from string) (uint64, error) {
+	log = log.WithName("zfs_estimate_size")
 
-	cmd := exec.CommandContext(ctx, "zfs", "send", "--raw", "--parsable", "--dryrun", snapshot)
+	property := "referenced"
+	if i := strings.IndexAny(from, "@#"); i >= 0 {
+		property = "written" + from[i:]
+	}
+
+	cmd := exec.CommandContext(ctx, "zfs", "get", "-H", "-p", "-o", "value", property, filesystem)
+	cmd.Stderr = logWriter(log, logStderr)
+
+	b, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get %s of %q: %w", property, filesystem, err)
+	}
+
+	size, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s of %q: %w", property, filesystem, err)
+	}
+
+	return size, nil
+}
+
+// SnapshotExists returns true if the given zfs snapshot exists on the host.
+func (e Exec) SnapshotExists(ctx context.Context, log logr.Logger, snapshot string) (bool, error) {
+	log = log.WithName("zfs_exists")
+
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "zfs", "list", "-H", "-t", "snapshot", "-o", "name", snapshot)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "does not exist") {
+			return false, nil
+		}
+		log.Error(err, "failed to list snapshot", "snapshot", snapshot, "stderr", stderr.String())
+		return false, fmt.Errorf("failed to check snapshot %q exists: %w", snapshot, err)
+	}
+
+	return true, nil
+}
+
+// SnapshotName returns the name of the snapshot of the given filesystem with
+// the given prefix, created at the given time.
+func SnapshotName(filesystem, prefix string, t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%s@%s%04d-%02d-%02d_%02d-%02d-%02d",
+		filesystem, prefix,
+		t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(),
+	)
+}
+
+// Managed returns true if the given snapshot or bookmark was created by yazbu
+// with the given prefix.
+func Managed(name, prefix string) bool {
+	i := strings.IndexAny(name, "@#")
+	return i >= 0 && strings.HasPrefix(name[i+1:], prefix)
+}
+
+// ValidSnapshotPrefix returns an error if the given snapshot prefix contains
+// characters which are not valid in a zfs snapshot name.
+func ValidSnapshotPrefix(prefix string) error {
+	if !snapshotPrefixRegex.MatchString(prefix) {
+		return fmt.Errorf("invalid snapshot prefix %q, must only contain alphanumeric characters, or any of '_.:-'", prefix)
+	}
+	return nil
+}
+
+// ValidSendFlags returns an error if any of the given zfs send flags are not
+// allowed to be configured.
+func ValidSendFlags(flags []string) error {
+	var invalid []string
+	for _, flag := range flags {
+		if !sendFlags[flag] {
+			invalid = append(invalid, fmt.Sprintf("%q", flag))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("unsupported send flags [%s]", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// sendArgs returns the arguments of a raw zfs send with the given additional
+// flags.
+func sendArgs(flags []string, args ...string) []string {
+	return append(append([]string{"send", "--raw"}, flags...), args...)
+}
+
+// BookmarkName returns the name of the bookmark of the given snapshot.
+func BookmarkName(snapshot string) string {
+	return strings.Replace(snapshot, "@", "#", 1)
+}
+
+// SnapshotDestroy destroys the given zfs snapshot.
+func (e Exec) SnapshotDestroy(ctx context.Context, log logr.Logger, snapshot string) error {
+	log = log.WithName("zfs_destroy")
+
+	// Guard against destroying the filesystem itself.
+	if !strings.Contains(snapshot, "@") {
+		return fmt.Errorf("refusing to destroy %q: not a snapshot", snapshot)
+	}
+
+	log.Info("destroying snapshot", "snapshot", snapshot)
+	cmd := exec.CommandContext(ctx, "zfs", "destroy", snapshot)
+	cmd.Stdout, cmd.Stderr = logWriter(log, logStdout), logWriter(log, logStderr)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to destroy snapshot %q: %w", snapshot, err)
+	}
+
+	return nil
+}
+
+// SnapshotList returns the names of the snapshots of the given filesystem,
+// ordered oldest first.
+func (e Exec) SnapshotList(ctx context.Context, log logr.Logger, filesystem string) ([]string, error) {
+	return list(ctx, log.WithName("zfs_list"), "snapshot", filesystem)
+}
+
+// GUID returns the zfs GUID of the given snapshot or bookmark.
+func (e Exec) GUID(ctx context.Context, log logr.Logger, name string) (uint64, error) {
+	log = log.WithName("zfs_guid")
+
+	cmd := exec.CommandContext(ctx, "zfs", "get", "-H", "-p", "-o", "value", "guid", name)
+	cmd.Stderr = logWriter(log, logStderr)
+
+	b, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get guid of %q: %w", name, err)
+	}
+
+	guid, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse guid of %q: %w", name, err)
+	}
+
+	return guid, nil
+}
+
+// BookmarkCreate creates a bookmark of the given snapshot, with the same name
+// as the snapshot.
+func (e Exec) BookmarkCreate(ctx context.Context, log logr.Logger, snapshot string) (string, error) {
+	log = log.WithName("zfs_bookmark")
+	bookmark := BookmarkName(snapshot)
+
+	log.Info("creating bookmark", "snapshot", snapshot, "bookmark", bookmark)
+	cmd := exec.CommandContext(ctx, "zfs", "bookmark", snapshot, bookmark)
+	cmd.Stdout, cmd.Stderr = logWriter(log, logStdout), logWriter(log, logStderr)
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to create bookmark %q: %w", bookmark, err)
+	}
+
+	return bookmark, nil
+}
+
+// BookmarkDestroy destroys the given zfs bookmark.
+func (e Exec) BookmarkDestroy(ctx context.Context, log logr.Logger, bookmark string) error {
+	log = log.WithName("zfs_destroy_bookmark")
+
+	// Guard against destroying the filesystem itself.
+	if !strings.Contains(bookmark, "#") {
+		return fmt.Errorf("refusing to destroy %q: not a bookmark", bookmark)
+	}
+
+	log.Info("destroying bookmark", "bookmark", bookmark)
+	cmd := exec.CommandContext(ctx, "zfs", "destroy", bookmark)
+	cmd.Stdout, cmd.Stderr = logWriter(log, logStdout), logWriter(log, logStderr)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to destroy bookmark %q: %w", bookmark, err)
+	}
+
+	return nil
+}
+
+// BookmarkList returns the names of the bookmarks of the given filesystem,
+// ordered oldest first.
+func (e Exec) BookmarkList(ctx context.Context, log logr.Logger, filesystem string) ([]string, error) {
+	return list(ctx, log.WithName("zfs_list_bookmarks"), "bookmark", filesystem)
+}
+
+// list returns the names of the datasets of the given type which are direct
+// children of the filesystem, ordered oldest first.
+func list(ctx context.Context, log logr.Logger, typ, filesystem string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "zfs", "list", "-H", "-t", typ, "-o", "name", "-s", "createtxg", "-d", "1", filesystem)
+	cmd.Stderr = logWriter(log, logStderr)
+
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %ss of %q: %w", typ, filesystem, err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			names = append(names, line)
+		}
+	}
+
+	return names, nil
+}
+
+// sendSize returns the estimated size of the zfs send stream for the given
+// send flags and arguments.
+func sendSize(ctx context.Context, log logr.Logger, flags []string, args ...string) (uint64, error) {
+	cmd := exec.CommandContext(ctx, "zfs", sendArgs(append([]string{"--parsable", "--dryrun"}, flags...), args...)...)
 	cmd.Stderr = logWriter(log, logStderr)
 
 	rc, err := cmd.StdoutPipe()
@@ -123,6 +495,9 @@ func SnapshotSize(ctx context.Context, log logr.Logger, snapshot string) (uint64
 	}
 
 	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("failed to parse size of snapshot: empty output")
+	}
 	size, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse size of snapshot: %w", err)